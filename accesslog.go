@@ -0,0 +1,52 @@
+package websocketproxy
+
+import "time"
+
+// AccessLogEntry is the summary of a completed connection.
+type AccessLogEntry struct {
+	// ConnectionID is the id of the connection, as in ConnectionInfo.
+	ConnectionID string
+	// CorrelationID is the correlation id of the connection, if the proxy has a CorrelationHeader.
+	CorrelationID string
+
+	RemoteAddr  string
+	BackendURL  string
+	Subprotocol string
+
+	StartTime time.Time
+	Duration  time.Duration
+
+	// Bytes is the number of bytes of the data messages forwarded in each direction, indexed by Direction.
+	Bytes [2]int64
+	// Messages is the number of data messages forwarded in each direction, indexed by Direction.
+	Messages [2]int64
+
+	// CloseCode is the close code, websocket.CloseAbnormalClosure if the connection was dropped without a close frame.
+	CloseCode int
+	// CloseText is the close reason.
+	CloseText string
+	// Initiator is the peer that terminated the connection.
+	Initiator Peer
+}
+
+// callAccessLog calls AccessLog with the summary of the terminated connection.
+func (p *ReverseProxy) callAccessLog(c *connection, info CloseInfo) {
+	entry := AccessLogEntry{
+		ConnectionID:  c.id,
+		CorrelationID: info.CorrelationID,
+		RemoteAddr:    c.req.RemoteAddr,
+		BackendURL:    c.target,
+		Subprotocol:   c.clientConn.Subprotocol(),
+		StartTime:     c.start,
+		Duration:      time.Since(c.start),
+		Bytes:         info.Bytes,
+		Messages:      info.Messages,
+		CloseCode:     info.Code,
+		CloseText:     info.Text,
+		Initiator:     info.Initiator,
+	}
+
+	p.callHook(c.req.Context(), "AccessLog", func() {
+		p.AccessLog(entry)
+	})
+}
@@ -0,0 +1,76 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLog(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{Subprotocols: []string{"chat"}}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = conn.WriteMessage(msgType, append(msg, msg...)); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	entries := make(chan AccessLogEntry, 1)
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.CorrelationHeader = "X-Request-Id"
+		p.AccessLog = func(entry AccessLogEntry) {
+			entries <- entry
+		}
+	})
+	defer proxy.Close()
+
+	dialer := gorillawebsocket.Dialer{Subprotocols: []string{"chat"}}
+	conn, _, err := dialer.Dial(wsURL(proxy, "/ws"), http.Header{"X-Request-Id": {"abc-123"}})
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	for _, msg := range []string{"hello", "world!"} {
+		require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte(msg)))
+		_, _, err = conn.ReadMessage()
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, "bye")))
+	_, _, _ = conn.ReadMessage()
+
+	select {
+	case entry := <-entries:
+		assert.NotEmpty(t, entry.ConnectionID)
+		assert.Equal(t, "abc-123", entry.CorrelationID)
+		assert.Equal(t, conn.LocalAddr().String(), entry.RemoteAddr)
+		assert.Equal(t, "ws://"+backend.Listener.Addr().String()+"/ws", entry.BackendURL)
+		assert.Equal(t, "chat", entry.Subprotocol)
+		assert.False(t, entry.StartTime.IsZero())
+		assert.Greater(t, entry.Duration, time.Duration(0))
+		assert.Equal(t, [2]int64{11, 22}, entry.Bytes)
+		assert.Equal(t, [2]int64{2, 2}, entry.Messages)
+		assert.Equal(t, gorillawebsocket.CloseNormalClosure, entry.CloseCode)
+		assert.Equal(t, "bye", entry.CloseText)
+		assert.Equal(t, PeerClient, entry.Initiator)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the access log")
+	}
+}
@@ -0,0 +1,59 @@
+package websocketproxy
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// AuthFailurePolicy selects the outcome of a request when Authorize fails to decide,
+// by returning an *AuthFailureError.
+type AuthFailurePolicy int
+
+// Auth failure policies.
+const (
+	// FailClosed rejects the request with a 503 Service Unavailable.
+	FailClosed AuthFailurePolicy = iota
+	// FailOpen proxies the request as if it was authorized.
+	FailOpen
+)
+
+// AuthFailureError is returned by Authorize when it fails to decide, e.g. when the authorization service is down,
+// as opposed to any other error, which denies the request.
+type AuthFailureError struct {
+	Err error
+}
+
+func (e *AuthFailureError) Error() string {
+	return "websocket: authorization failure: " + e.Err.Error()
+}
+
+func (e *AuthFailureError) Unwrap() error {
+	return e.Err
+}
+
+// authorize calls Authorize, and returns the error rejecting the request, if any.
+// A failure of Authorize is handled according to the AuthFailurePolicy.
+func (p *ReverseProxy) authorize(req *http.Request) error {
+	err := p.callAuthorize(req)
+	if err == nil {
+		return nil
+	}
+
+	var failure *AuthFailureError
+	if !errors.As(err, &failure) {
+		p.logEvent(req.Context(), slog.LevelInfo, "websocket: Connection unauthorized",
+			remoteAddrAttr(req), errorAttr(err))
+		return &StatusError{Status: p.authorizeStatus(), Err: err}
+	}
+
+	if p.AuthFailurePolicy == FailOpen {
+		p.logEvent(req.Context(), slog.LevelWarn, "websocket: Authorization failed, connection allowed",
+			remoteAddrAttr(req), errorAttr(err))
+		return nil
+	}
+
+	p.logEvent(req.Context(), slog.LevelError, "websocket: Authorization failed, connection refused",
+		remoteAddrAttr(req), errorAttr(err))
+	return &StatusError{Status: http.StatusServiceUnavailable, Err: err}
+}
@@ -0,0 +1,188 @@
+package websocketproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ErrCircuitOpen is reported when a request is refused because the circuit breaker of its backend is open.
+var ErrCircuitOpen = errors.New("websocket: circuit breaker open")
+
+// CircuitBreaker sheds the load of failing backends.
+// After Threshold dial failures of a backend within Window, the breaker of the backend opens:
+// the requests to the backend fail fast with a 503 Service Unavailable for Cooldown.
+// Then a single request probes the backend: its success closes the breaker, its failure opens it again.
+// The dials canceled by the clients are not failures.
+type CircuitBreaker struct {
+	// Threshold is the number of dial failures opening the breaker.
+	Threshold int
+
+	// Window is the period over which the dial failures are counted.
+	Window time.Duration
+
+	// Cooldown is the time the breaker stays open before a probe.
+	Cooldown time.Duration
+}
+
+// BreakerState the state of the circuit breaker of a backend.
+type BreakerState int
+
+// Breaker states.
+const (
+	// BreakerClosed lets the requests reach the backend.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails the requests fast.
+	BreakerOpen
+	// BreakerHalfOpen lets a single request probe the backend.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker the circuit breaker of a backend.
+type breaker struct {
+	state       BreakerState
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	probing     bool
+}
+
+// BreakerState returns the state of the circuit breaker of the backend, identified by its scheme and host,
+// e.g. "ws://127.0.0.1:8080".
+func (p *ReverseProxy) BreakerState(target string) BreakerState {
+	p.breakersMu.Lock()
+	defer p.breakersMu.Unlock()
+
+	b, ok := p.breakers[target]
+	if !ok {
+		return BreakerClosed
+	}
+	if b.state == BreakerOpen && p.clock().Now().Sub(b.openedAt) >= p.CircuitBreaker.Cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allowDial reports whether the backend can be dialed.
+// Once the cooldown is over, only the first dial is allowed, as the probe of the backend.
+func (p *ReverseProxy) allowDial(target *url.URL) bool {
+	p.breakersMu.Lock()
+	defer p.breakersMu.Unlock()
+
+	b, ok := p.breakers[breakerKey(target)]
+	if !ok {
+		return true
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		if p.clock().Now().Sub(b.openedAt) < p.CircuitBreaker.Cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// recordDial records the result of a dial to the backend.
+func (p *ReverseProxy) recordDial(target *url.URL, failed bool) {
+	p.breakersMu.Lock()
+	defer p.breakersMu.Unlock()
+
+	key := breakerKey(target)
+	b, ok := p.breakers[key]
+
+	if !failed {
+		if ok {
+			delete(p.breakers, key)
+		}
+		return
+	}
+
+	if !ok {
+		if p.breakers == nil {
+			p.breakers = make(map[string]*breaker)
+		}
+		b = &breaker{}
+		p.breakers[key] = b
+	}
+
+	now := p.clock().Now()
+	if b.state == BreakerHalfOpen {
+		// the probe failed.
+		b.open(now)
+		return
+	}
+
+	if b.failures == 0 || now.Sub(b.windowStart) > p.CircuitBreaker.Window {
+		b.failures = 0
+		b.windowStart = now
+	}
+
+	b.failures++
+	if b.failures >= p.CircuitBreaker.Threshold {
+		b.open(now)
+	}
+}
+
+// recordDialResult records the result of a dial to the backend.
+// A dial canceled by the client is not a result: it only lets another request probe the backend.
+func (p *ReverseProxy) recordDialResult(req *http.Request, target *url.URL, resp *http.Response, err error) {
+	if req.Context().Err() != nil && errors.Is(err, context.Canceled) {
+		p.releaseProbe(target)
+		return
+	}
+	p.recordDial(target, isBackendFailure(resp, err))
+}
+
+// releaseProbe lets another request probe the backend, once a probe is canceled.
+func (p *ReverseProxy) releaseProbe(target *url.URL) {
+	p.breakersMu.Lock()
+	defer p.breakersMu.Unlock()
+
+	if b, ok := p.breakers[breakerKey(target)]; ok && b.state == BreakerHalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.probing = false
+	b.failures = 0
+}
+
+// breakerKey returns the key of the breaker of the backend.
+func breakerKey(target *url.URL) string {
+	return target.Scheme + "://" + target.Host
+}
+
+// isBackendFailure reports whether the dial result counts as a failure of the backend.
+func isBackendFailure(resp *http.Response, err error) bool {
+	if err == nil {
+		return false
+	}
+	return resp == nil || resp.StatusCode >= http.StatusInternalServerError
+}
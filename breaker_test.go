@@ -0,0 +1,148 @@
+package websocketproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+	var hits int32
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	uri, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+	target := "ws://" + uri.Host
+
+	cooldown := 100 * time.Millisecond
+	p := NewSingleHostReverseProxy(uri)
+	p.Logger = &printfRecorder{}
+	p.CircuitBreaker = &CircuitBreaker{Threshold: 2, Window: time.Minute, Cooldown: cooldown}
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	dial := func() int {
+		t.Helper()
+
+		conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+		if err == nil {
+			_ = conn.Close()
+		}
+		require.NotNil(t, resp)
+		return resp.StatusCode
+	}
+
+	// closed: the failures reach the backend.
+	assert.Equal(t, BreakerClosed, p.BreakerState(target))
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusServiceUnavailable, dial())
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+
+	// open: the requests fail fast.
+	assert.Equal(t, BreakerOpen, p.BreakerState(target))
+	assert.Equal(t, http.StatusServiceUnavailable, dial())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+
+	// half-open: the failed probe opens the breaker again.
+	time.Sleep(cooldown)
+	assert.Equal(t, BreakerHalfOpen, p.BreakerState(target))
+	assert.Equal(t, http.StatusServiceUnavailable, dial())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+	assert.Equal(t, BreakerOpen, p.BreakerState(target))
+
+	// half-open: the successful probe closes the breaker.
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(cooldown)
+	assert.Equal(t, BreakerHalfOpen, p.BreakerState(target))
+	assert.Equal(t, http.StatusSwitchingProtocols, dial())
+	assert.Equal(t, BreakerClosed, p.BreakerState(target))
+
+	assert.Equal(t, http.StatusSwitchingProtocols, dial())
+	assert.Equal(t, int32(5), atomic.LoadInt32(&hits))
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	target, err := url.Parse("ws://backend")
+	require.NoError(t, err)
+
+	p := &ReverseProxy{CircuitBreaker: &CircuitBreaker{Threshold: 1, Window: time.Minute}}
+	p.recordDial(target, true)
+	assert.Equal(t, BreakerHalfOpen, p.BreakerState("ws://backend"))
+
+	assert.True(t, p.allowDial(target), "the probe")
+	assert.False(t, p.allowDial(target), "a concurrent request during the probe")
+}
+
+// hangingDialer is a dialer blocked until its context is canceled.
+type hangingDialer struct {
+	dialing chan struct{}
+}
+
+func (d *hangingDialer) DialContext(ctx context.Context, _ string, _ http.Header) (*gorillawebsocket.Conn, *http.Response, error) {
+	d.dialing <- struct{}{}
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
+
+func TestCircuitBreakerClientCanceled(t *testing.T) {
+	target, err := url.Parse("ws://backend")
+	require.NoError(t, err)
+
+	dialer := &hangingDialer{dialing: make(chan struct{})}
+	p := NewSingleHostReverseProxy(target)
+	p.Logger = &printfRecorder{}
+	p.Dialer = dialer
+	p.CircuitBreaker = &CircuitBreaker{Threshold: 1, Window: time.Minute, Cooldown: time.Minute}
+
+	// cancelDial serves a request aborted by the client during the dial.
+	cancelDial := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		req := httptest.NewRequest(http.MethodGet, "http://proxy/ws", nil).WithContext(ctx)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+		go func() {
+			<-dialer.dialing
+			cancel()
+		}()
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// the canceled dial is not a failure of the backend.
+	cancelDial()
+	assert.Equal(t, BreakerClosed, p.BreakerState("ws://backend"))
+
+	// the canceled probe lets another request probe the backend.
+	p.breakers = map[string]*breaker{"ws://backend": {state: BreakerHalfOpen}}
+	cancelDial()
+	assert.Equal(t, BreakerHalfOpen, p.BreakerState("ws://backend"))
+	assert.True(t, p.allowDial(target))
+}
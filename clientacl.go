@@ -0,0 +1,75 @@
+package websocketproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrClientNotAllowed is reported when a request is refused because its client IP is not in AllowedClientCIDRs.
+var ErrClientNotAllowed = errors.New("websocket: client not allowed")
+
+// parseClientCIDRs parses the ranges of AllowedClientCIDRs.
+func parseClientCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("websocket: invalid allowed client CIDR: %w", err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// clientCIDRs returns the ranges of AllowedClientCIDRs, parsed once, by Validate or by the first request.
+func (p *ReverseProxy) clientCIDRs() ([]*net.IPNet, error) {
+	p.clientNetsOnce.Do(func() {
+		p.clientNets, p.clientNetsErr = parseClientCIDRs(p.AllowedClientCIDRs)
+	})
+	return p.clientNets, p.clientNetsErr
+}
+
+// checkClientIP checks the client IP of the request against the ranges of AllowedClientCIDRs.
+// An invalid range, not reported by Validate, refuses all the requests with a 403 status code.
+func (p *ReverseProxy) checkClientIP(req *http.Request) error {
+	if len(p.AllowedClientCIDRs) == 0 {
+		return nil
+	}
+
+	nets, err := p.clientCIDRs()
+	if err != nil {
+		return &StatusError{Status: http.StatusForbidden, Err: fmt.Errorf("%w: %w", ErrClientNotAllowed, err)}
+	}
+
+	ip := net.ParseIP(p.realClientIP(req))
+	if ip == nil || !containsIP(nets, ip) {
+		return &StatusError{Status: http.StatusForbidden, Err: ErrClientNotAllowed}
+	}
+	return nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// realClientIP returns the IP of the client: the last address of the X-Forwarded-For header,
+// set by the proxy in front, if TrustForwardedFor is set, else the remote address.
+func (p *ReverseProxy) realClientIP(req *http.Request) string {
+	if p.TrustForwardedFor {
+		if values := req.Header.Values(XForwardedFor); len(values) > 0 {
+			addrs := strings.Split(values[len(values)-1], ",")
+			if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	return clientIP(req)
+}
@@ -0,0 +1,114 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowedClientCIDRs(t *testing.T) {
+	testCases := []struct {
+		desc              string
+		cidrs             []string
+		trustForwardedFor bool
+		forwardedFor      []string
+		notValidated      bool
+		expectedStatus    int
+	}{
+		{
+			desc:           "allowed",
+			cidrs:          []string{"10.0.0.0/8", "127.0.0.0/8"},
+			expectedStatus: http.StatusSwitchingProtocols,
+		},
+		{
+			desc:           "denied",
+			cidrs:          []string{"10.0.0.0/8"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			desc:           "forwarded for ignored",
+			cidrs:          []string{"10.0.0.0/8"},
+			forwardedFor:   []string{"10.0.0.1"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			desc:              "forwarded for allowed",
+			cidrs:             []string{"10.0.0.0/8"},
+			trustForwardedFor: true,
+			forwardedFor:      []string{"192.168.0.1, 10.0.0.1"},
+			expectedStatus:    http.StatusSwitchingProtocols,
+		},
+		{
+			desc:              "forwarded for denied",
+			cidrs:             []string{"10.0.0.0/8"},
+			trustForwardedFor: true,
+			// only the address set by the trusted proxy is checked.
+			forwardedFor:   []string{"10.0.0.1, 192.168.0.1"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			desc:              "forwarded for IPv6",
+			cidrs:             []string{"2001:db8::/32"},
+			trustForwardedFor: true,
+			forwardedFor:      []string{"10.0.0.1", "2001:db8::1"},
+			expectedStatus:    http.StatusSwitchingProtocols,
+		},
+		{
+			desc:           "not validated",
+			cidrs:          []string{"127.0.0.0/8"},
+			notValidated:   true,
+			expectedStatus: http.StatusSwitchingProtocols,
+		},
+		{
+			desc:           "invalid CIDR not validated",
+			cidrs:          []string{"127.0.0.1"},
+			notValidated:   true,
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var dialed int32
+			upgrader := gorillawebsocket.Upgrader{}
+			backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&dialed, 1)
+				conn, err := upgrader.Upgrade(rw, req, nil)
+				if err != nil {
+					return
+				}
+				_ = conn.Close()
+			}))
+			defer backend.Close()
+
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.AllowedClientCIDRs = test.cidrs
+				p.TrustForwardedFor = test.trustForwardedFor
+				if !test.notValidated {
+					require.NoError(t, p.Validate())
+				}
+			})
+			defer proxy.Close()
+
+			headers := http.Header{XForwardedFor: test.forwardedFor}
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), headers)
+			require.NotNil(t, resp)
+			assert.Equal(t, test.expectedStatus, resp.StatusCode)
+			if test.expectedStatus != http.StatusSwitchingProtocols {
+				require.Error(t, err)
+				assert.Equal(t, int32(0), atomic.LoadInt32(&dialed))
+				return
+			}
+			require.NoError(t, err)
+			_ = conn.Close()
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package websocketproxy
+
+import "time"
+
+// Clock is the source of time of the timeouts of the proxy:
+// the connection lifetime, the first message timeout, the keepalive pings, the connection queue,
+// the backend reconnections and the circuit breaker cooldown.
+// A test can replace it, e.g. with a websocketproxytest.Clock, to fire a timeout without waiting for it.
+// The deadlines of the network connections always follow the real time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel receiving the current time once the duration elapsed.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTimer returns a channel receiving the current time once the duration elapsed,
+	// and a function stopping the timer, which reports whether it stopped the timer before it fired.
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+
+	// AfterFunc calls f in its own goroutine once the duration elapsed,
+	// and returns a function stopping the timer, which reports whether it stopped the timer before it fired.
+	AfterFunc(d time.Duration, f func()) func() bool
+}
+
+// realClock is the Clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// clock returns the Clock of the proxy.
+func (p *ReverseProxy) clock() Clock {
+	if p.Clock == nil {
+		return realClock{}
+	}
+	return p.Clock
+}
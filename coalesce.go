@@ -0,0 +1,121 @@
+package websocketproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// defaultCoalesceMaxBytes is the default maximum size of a coalesced message.
+const defaultCoalesceMaxBytes = 64 * 1024
+
+func (p *ReverseProxy) coalesceMaxBytes() int {
+	if p.CoalesceMaxBytes <= 0 {
+		return defaultCoalesceMaxBytes
+	}
+	return p.CoalesceMaxBytes
+}
+
+// coalescer merges the consecutive data messages of the same type forwarded within the CoalesceWindow into one message.
+// It serializes its writes with the flushes of the window timer.
+type coalescer struct {
+	p    *ReverseProxy
+	c    *connection
+	send forwardFunc
+
+	mu          sync.Mutex
+	messageType int
+	buf         bytes.Buffer
+	stopTimer   func() bool
+	// err is the error of a flush of the window timer, reported by the next forward.
+	err error
+}
+
+func newCoalescer(p *ReverseProxy, c *connection, send forwardFunc) *coalescer {
+	return &coalescer{p: p, c: c, send: send}
+}
+
+// forward buffers a data message, flushing the buffered messages first if the type differs or the size would exceed the maximum.
+// A control message flushes the buffered messages, then is sent.
+func (m *coalescer) forward(messageType int, reader io.Reader) (int64, error) {
+	if !isDataMessage(messageType) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if err := m.flushLocked(); err != nil {
+			return 0, err
+		}
+		return m.send(messageType, reader)
+	}
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	max := m.p.coalesceMaxBytes()
+	if m.buf.Len() > 0 && (messageType != m.messageType || m.buf.Len()+len(m.p.CoalesceSeparator)+len(data) > max) {
+		if err = m.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+
+	if m.buf.Len() > 0 {
+		m.buf.Write(m.p.CoalesceSeparator)
+	}
+	m.messageType = messageType
+	m.buf.Write(data)
+
+	if m.buf.Len() >= max {
+		if err = m.flushLocked(); err != nil {
+			return 0, err
+		}
+		return int64(len(data)), nil
+	}
+
+	if m.stopTimer == nil {
+		m.stopTimer = m.p.clock().AfterFunc(m.p.CoalesceWindow, m.flushWindow)
+	}
+	return int64(len(data)), nil
+}
+
+// flushWindow flushes the buffered messages once the window elapsed.
+func (m *coalescer) flushWindow() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.c.ctx.Err() != nil {
+		// the connection terminated.
+		return
+	}
+	if err := m.flushLocked(); err != nil && m.err == nil {
+		m.err = err
+	}
+}
+
+// flushLocked sends the buffered messages as one message, and stops the window timer.
+func (m *coalescer) flushLocked() error {
+	if m.err != nil {
+		return m.err
+	}
+
+	if m.stopTimer != nil {
+		m.stopTimer()
+		m.stopTimer = nil
+	}
+	if m.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := m.send(m.messageType, bytes.NewReader(m.buf.Bytes()))
+	m.buf.Reset()
+	return err
+}
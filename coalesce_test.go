@@ -0,0 +1,64 @@
+package websocketproxy
+
+import (
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/juliens/websocketproxy/websocketproxytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalesce(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	clock := websocketproxytest.NewClock(time.Now())
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.Clock = clock
+		p.CoalesceWindow = time.Second
+		p.CoalesceMaxBytes = 8
+		p.CoalesceSeparator = []byte("\n")
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+
+	expectMessage := func(expectedType int, expected string) {
+		t.Helper()
+
+		msgType, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, expectedType, msgType)
+		assert.Equal(t, expected, string(msg))
+	}
+
+	// the window elapses.
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("a")))
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("b")))
+	// a type change flushes the buffered messages.
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.BinaryMessage, []byte("c")))
+	expectMessage(gorillawebsocket.TextMessage, "a\nb")
+
+	clock.Advance(time.Second)
+	expectMessage(gorillawebsocket.BinaryMessage, "c")
+
+	// the maximum size flushes the buffered messages.
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("123")))
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("4567")))
+	expectMessage(gorillawebsocket.TextMessage, "123\n4567")
+
+	// a message exceeding the maximum size once merged is not merged.
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("123")))
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("45678")))
+	expectMessage(gorillawebsocket.TextMessage, "123")
+
+	// a control message flushes the buffered messages.
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.PingMessage, []byte("ping")))
+	expectMessage(gorillawebsocket.TextMessage, "45678")
+}
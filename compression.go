@@ -0,0 +1,203 @@
+package websocketproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+const permessageDeflate = "permessage-deflate"
+
+// hasExtension reports whether the Sec-WebSocket-Extensions header lists the extension.
+func hasExtension(header http.Header, name string) bool {
+	for _, ext := range extensionNames(header) {
+		if strings.EqualFold(ext, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// extensionNames returns the names of the extensions listed by the Sec-WebSocket-Extensions header, without their parameters.
+// The header may not be canonicalized, as the websocket dialer sets it as "Sec-WebSocket-Extensions".
+func extensionNames(header http.Header) []string {
+	var values []string
+	for k, vv := range header {
+		if strings.EqualFold(k, SecWebsocketExtensions) {
+			values = append(values, vv...)
+		}
+	}
+
+	var names []string
+	for _, v := range values {
+		for _, ext := range strings.Split(v, ",") {
+			if i := strings.Index(ext, ";"); i >= 0 {
+				ext = ext[:i]
+			}
+			if ext = strings.TrimSpace(ext); ext != "" {
+				names = append(names, ext)
+			}
+		}
+	}
+	return names
+}
+
+// setCompressionLevel applies the compression level to the connection, if set.
+// An invalid level is reported, and the default level is kept.
+func (p *ReverseProxy) setCompressionLevel(req *http.Request, conn *websocket.Conn) {
+	if p.CompressionLevel == 0 {
+		return
+	}
+
+	if err := conn.SetCompressionLevel(p.CompressionLevel); err != nil {
+		p.logEvent(req.Context(), slog.LevelWarn, "websocket: Invalid compression level",
+			remoteAddrAttr(req), slog.Int("level", p.CompressionLevel), errorAttr(err))
+	}
+}
+
+// enableWriteCompression compresses the next message written to the connection if its size reaches the threshold.
+// It has no effect when the compression is not negotiated.
+func (p *ReverseProxy) enableWriteCompression(conn *websocket.Conn, size int) {
+	if p.CompressionThreshold > 0 {
+		conn.EnableWriteCompression(size >= p.CompressionThreshold)
+	}
+}
+
+// readHead extends the head of a message with what is read from src, up to size bytes.
+// It reports whether the whole message was read.
+func readHead(head []byte, src io.Reader, size int) ([]byte, bool, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	buf.Write(head)
+
+	_, err := io.CopyN(buf, src, int64(size-len(head)))
+	switch err {
+	case nil:
+		return buf.Bytes(), false, nil
+	case io.EOF:
+		return buf.Bytes(), true, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// CompressionStats describes the effectiveness of the compression on the connection to a peer.
+type CompressionStats struct {
+	// PayloadBytes is the number of bytes of the data messages exchanged with the peer, before compression.
+	PayloadBytes int64
+	// WireBytes is the number of bytes exchanged with the peer after the handshake,
+	// including the frame headers and the control frames, and the TLS records to a wss backend.
+	WireBytes int64
+}
+
+// Ratio returns the number of wire bytes per payload byte, or 0 if no payload was exchanged.
+// It is below 1 when the compression saves bytes.
+func (s CompressionStats) Ratio() float64 {
+	if s.PayloadBytes == 0 {
+		return 0
+	}
+	return float64(s.WireBytes) / float64(s.PayloadBytes)
+}
+
+// wireCounter counts the bytes read and written on the net.Conn of a peer, wrapped by wrap.
+type wireCounter struct {
+	bytes     int64
+	handshake int64
+}
+
+func (w *wireCounter) wrap(conn net.Conn) net.Conn {
+	return &wireConn{Conn: conn, counter: w}
+}
+
+// handshakeDone excludes the bytes of the handshake of the connection from the count.
+// It reports whether the net.Conn of the connection is counted.
+func (w *wireCounter) handshakeDone(conn *websocket.Conn) bool {
+	netConn := conn.UnderlyingConn()
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		netConn = tlsConn.NetConn()
+	}
+
+	wc, ok := netConn.(*wireConn)
+	if !ok || wc.counter != w {
+		return false
+	}
+	atomic.AddInt64(&w.handshake, atomic.LoadInt64(&wc.bytes))
+	return true
+}
+
+// stats returns the compression stats of the connection, given the payload bytes.
+func (w *wireCounter) stats(payload int64) *CompressionStats {
+	return &CompressionStats{
+		PayloadBytes: payload,
+		WireBytes:    atomic.LoadInt64(&w.bytes) - atomic.LoadInt64(&w.handshake),
+	}
+}
+
+// wireConn is a net.Conn counted by a wireCounter.
+type wireConn struct {
+	net.Conn
+	counter *wireCounter
+	// bytes counts the bytes of this net.Conn, as the backend connection of a counter can be redialed.
+	bytes int64
+}
+
+func (c *wireConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.add(n)
+	return n, err
+}
+
+func (c *wireConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.add(n)
+	return n, err
+}
+
+func (c *wireConn) add(n int) {
+	atomic.AddInt64(&c.bytes, int64(n))
+	atomic.AddInt64(&c.counter.bytes, int64(n))
+}
+
+// countWire makes the dialer count the bytes of its connections with the counter.
+func countWire(d *websocket.Dialer, counter *wireCounter) {
+	next := netDialOf(d)
+	d.NetDial = nil
+	d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return counter.wrap(conn), nil
+	}
+}
+
+// wireResponseWriter is a response writer hijacked as a net.Conn counted by a wireCounter.
+type wireResponseWriter struct {
+	http.ResponseWriter
+	counter *wireCounter
+}
+
+func (w *wireResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("websocket: response does not implement http.Hijacker")
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil || brw.Reader.Buffered() > 0 {
+		// the upgrader rejects the data sent before the end of the handshake.
+		return conn, brw, err
+	}
+
+	wire := w.counter.wrap(conn)
+	return wire, bufio.NewReadWriter(bufio.NewReader(wire), bufio.NewWriter(wire)), nil
+}
@@ -0,0 +1,391 @@
+package websocketproxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingListener counts the bytes read from the accepted connections.
+type countingListener struct {
+	net.Listener
+	read int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, read: &l.read}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+func TestEnableCompression(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		enabled     bool
+		clientOffer bool
+		expected    bool
+	}{
+		{
+			desc: "disabled",
+		},
+		{
+			desc:        "disabled with a client offer",
+			clientOffer: true,
+		},
+		{
+			desc:    "enabled without a client offer",
+			enabled: true,
+		},
+		{
+			desc:        "enabled with a client offer",
+			enabled:     true,
+			clientOffer: true,
+			expected:    true,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			offers := make(chan bool, 1)
+			upgrader := gorillawebsocket.Upgrader{EnableCompression: true}
+
+			listener := &countingListener{Listener: newLocalListener(t)}
+			backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				offers <- hasExtension(req.Header, permessageDeflate)
+
+				conn, err := upgrader.Upgrade(rw, req, nil)
+				if err != nil {
+					return
+				}
+				defer func() { _ = conn.Close() }()
+
+				msgType, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				_ = conn.WriteMessage(msgType, msg)
+			}))
+			backend.Listener = listener
+			backend.Start()
+			defer backend.Close()
+
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.EnableCompression = test.enabled
+			})
+			defer proxy.Close()
+
+			dialer := gorillawebsocket.Dialer{EnableCompression: test.clientOffer}
+			conn, resp, err := dialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			assert.Equal(t, test.expected, <-offers)
+			assert.Equal(t, test.expected, hasExtension(resp.Header, permessageDeflate))
+
+			msg := strings.Repeat("compressible ", 5000)
+			err = conn.WriteMessage(gorillawebsocket.TextMessage, []byte(msg))
+			require.NoError(t, err)
+
+			_, received, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, msg, string(received))
+
+			if test.expected {
+				assert.True(t, atomic.LoadInt64(&listener.read) < int64(len(msg)/10), "read %d bytes", atomic.LoadInt64(&listener.read))
+			} else {
+				assert.True(t, atomic.LoadInt64(&listener.read) > int64(len(msg)), "read %d bytes", atomic.LoadInt64(&listener.read))
+			}
+		})
+	}
+}
+
+func TestPeerCompression(t *testing.T) {
+	testCases := []struct {
+		desc               string
+		clientCompression  bool
+		backendCompression bool
+	}{
+		{
+			desc:              "client only",
+			clientCompression: true,
+		},
+		{
+			desc:               "backend only",
+			backendCompression: true,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			offers := make(chan bool, 1)
+			upgrader := gorillawebsocket.Upgrader{EnableCompression: true}
+			backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				offers <- hasExtension(req.Header, permessageDeflate)
+
+				conn, err := upgrader.Upgrade(rw, req, nil)
+				if err != nil {
+					return
+				}
+				defer func() { _ = conn.Close() }()
+
+				msgType, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				_ = conn.WriteMessage(msgType, msg)
+			}))
+			defer backend.Close()
+
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.ClientCompression = test.clientCompression
+				p.BackendCompression = test.backendCompression
+			})
+			defer proxy.Close()
+
+			dialer := gorillawebsocket.Dialer{EnableCompression: true}
+			conn, resp, err := dialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			assert.Equal(t, test.backendCompression, <-offers)
+			assert.Equal(t, test.clientCompression, hasExtension(resp.Header, permessageDeflate))
+
+			msg := strings.Repeat("compressible ", 5000)
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte(msg)))
+
+			_, received, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, msg, string(received))
+		})
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	for _, threshold := range []int{100, 2 * smallMessageSize} {
+		threshold := threshold
+		t.Run(strconv.Itoa(threshold), func(t *testing.T) {
+			upgrader := gorillawebsocket.Upgrader{EnableCompression: true}
+			backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				conn, err := upgrader.Upgrade(rw, req, nil)
+				if err != nil {
+					return
+				}
+				defer func() { _ = conn.Close() }()
+
+				for {
+					msgType, msg, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					if err = conn.WriteMessage(msgType, msg); err != nil {
+						return
+					}
+				}
+			}))
+			defer backend.Close()
+
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.EnableCompression = true
+				p.CompressionLevel = 9
+				p.CompressionThreshold = threshold
+			})
+			defer proxy.Close()
+
+			recorder := &frameRecorder{}
+			dialer := gorillawebsocket.Dialer{
+				EnableCompression: true,
+				NetDial: func(network, addr string) (net.Conn, error) {
+					conn, err := net.Dial(network, addr)
+					if err != nil {
+						return nil, err
+					}
+					return &frameConn{Conn: conn, recorder: recorder}, nil
+				},
+			}
+
+			conn, _, err := dialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			sizes := []int{10, threshold - 1, threshold, 5 * threshold}
+			for _, size := range sizes {
+				msg := strings.Repeat("a", size)
+				require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte(msg)))
+
+				_, received, err := conn.ReadMessage()
+				require.NoError(t, err)
+				assert.Equal(t, msg, string(received))
+			}
+
+			frames := recorder.frames()
+			require.Len(t, frames, len(sizes))
+			for i, size := range sizes {
+				assert.Equal(t, size >= threshold, frames[i].compressed, "message of %d bytes", size)
+			}
+		})
+	}
+}
+
+// compressionMetrics records the compression stats.
+type compressionMetrics struct {
+	*recordingMetrics
+	compression sync.Map
+}
+
+func (m *compressionMetrics) AddCompression(peer Peer, stats CompressionStats) {
+	m.compression.Store(peer, stats)
+}
+
+func TestCompressionStats(t *testing.T) {
+	incompressible := make([]byte, 64*1024)
+	_, err := rand.Read(incompressible)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc        string
+		compression bool
+		payload     []byte
+		minRatio    float64
+		maxRatio    float64
+	}{
+		{
+			desc:        "compressible",
+			compression: true,
+			payload:     bytes.Repeat([]byte("websocket"), 8*1024),
+			maxRatio:    0.1,
+		},
+		{
+			desc:        "incompressible",
+			compression: true,
+			payload:     incompressible,
+			minRatio:    0.95,
+			maxRatio:    1.1,
+		},
+		{
+			desc:    "not negotiated",
+			payload: incompressible,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			upgrader := gorillawebsocket.Upgrader{EnableCompression: true}
+			backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				conn, err := upgrader.Upgrade(rw, req, nil)
+				if err != nil {
+					return
+				}
+				defer func() { _ = conn.Close() }()
+
+				for {
+					msgType, msg, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					if err = conn.WriteMessage(msgType, msg); err != nil {
+						return
+					}
+				}
+			}))
+			defer backend.Close()
+
+			closed := make(chan CloseInfo, 1)
+			metrics := &compressionMetrics{recordingMetrics: newRecordingMetrics()}
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.EnableCompression = true
+				p.Metrics = metrics
+				p.ConnectionClosedHook = func(_ *http.Request, info CloseInfo) {
+					closed <- info
+				}
+			})
+			defer proxy.Close()
+
+			dialer := gorillawebsocket.Dialer{EnableCompression: test.compression}
+			conn, _, err := dialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.BinaryMessage, test.payload))
+			_, received, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, test.payload, received)
+			_ = conn.Close()
+
+			var info CloseInfo
+			select {
+			case info = <-closed:
+			case <-time.After(2 * time.Second):
+				require.FailNow(t, "connection not closed")
+			}
+
+			if !test.compression {
+				assert.Nil(t, info.ClientCompression)
+				assert.Nil(t, info.BackendCompression)
+				_, ok := metrics.compression.Load(PeerClient)
+				assert.False(t, ok)
+				return
+			}
+
+			for peer, stats := range map[Peer]*CompressionStats{PeerClient: info.ClientCompression, PeerBackend: info.BackendCompression} {
+				require.NotNil(t, stats, peer)
+				assert.Equal(t, int64(2*len(test.payload)), stats.PayloadBytes, peer)
+				assert.Greater(t, stats.Ratio(), test.minRatio, peer)
+				assert.Less(t, stats.Ratio(), test.maxRatio, peer)
+
+				recorded, ok := metrics.compression.Load(peer)
+				require.True(t, ok, peer)
+				assert.Equal(t, *stats, recorded, peer)
+			}
+		})
+	}
+}
+
+func TestCompressionStatsRatio(t *testing.T) {
+	assert.Equal(t, 0.5, CompressionStats{PayloadBytes: 100, WireBytes: 50}.Ratio())
+	assert.Equal(t, 0.0, CompressionStats{WireBytes: 50}.Ratio())
+}
+
+func TestHasExtension(t *testing.T) {
+	header := make(http.Header)
+	header.Add(SecWebsocketExtensions, "x-webkit-deflate-frame, permessage-deflate; client_max_window_bits")
+
+	assert.True(t, hasExtension(header, permessageDeflate))
+	assert.True(t, hasExtension(header, "x-webkit-deflate-frame"))
+	assert.False(t, hasExtension(header, "permessage-foo"))
+	assert.False(t, hasExtension(http.Header{}, permessageDeflate))
+}
+
+func newLocalListener(t *testing.T) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return listener
+}
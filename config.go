@@ -0,0 +1,125 @@
+package websocketproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ConnConfig is the configuration of a connection, resolved when the client connects.
+// It replaces, for the connection, the corresponding settings of the proxy.
+type ConnConfig struct {
+	// Target is the backend of the connection: its scheme and host replace the ones set by the Director.
+	// The http and https schemes are mapped to ws and wss.
+	// If nil, the target set by the Director is used.
+	Target *url.URL
+
+	// RateLimit limits the messages forwarded from the client to the backend.
+	// If nil, the messages are not limited, apart from the GlobalRateLimit of the proxy.
+	RateLimit *RateLimit
+
+	// MaxMessagesPerConnection is the maximum number of messages, in both directions, carried by the connection.
+	// If zero, there is no limit.
+	MaxMessagesPerConnection int64
+
+	// DialTimeout limits the dial of the backend, including the handshake.
+	// If zero, only the timeouts of the dialer apply.
+	DialTimeout time.Duration
+
+	// EnableCompression negotiates permessage-deflate with the peers of the connection.
+	EnableCompression bool
+
+	// ClientCompression negotiates permessage-deflate with the client, regardless of the backend.
+	ClientCompression bool
+
+	// BackendCompression offers permessage-deflate to the backend, regardless of the client.
+	BackendCompression bool
+}
+
+// connConfig returns the configuration of the connection of the request.
+func (p *ReverseProxy) connConfig(req *http.Request) (*ConnConfig, error) {
+	if p.ConfigResolver != nil {
+		cfg, err := p.ConfigResolver(req)
+		if err != nil || cfg != nil {
+			return cfg, err
+		}
+	}
+
+	return &ConnConfig{
+		RateLimit:                p.RateLimit,
+		MaxMessagesPerConnection: p.MaxMessagesPerConnection,
+		EnableCompression:        p.EnableCompression,
+		ClientCompression:        p.ClientCompression,
+		BackendCompression:       p.BackendCompression,
+	}, nil
+}
+
+// backendCompression reports whether permessage-deflate is offered to the backend of the client request.
+func (c *ConnConfig) backendCompression(req *http.Request) bool {
+	return c.BackendCompression || c.EnableCompression && hasExtension(req.Header, permessageDeflate)
+}
+
+// clientCompression reports whether permessage-deflate is negotiated with the client, given the backend handshake response.
+func (c *ConnConfig) clientCompression(resp *http.Response) bool {
+	return c.ClientCompression || c.EnableCompression && hasExtension(resp.Header, permessageDeflate)
+}
+
+// applyTarget routes the backend request to the target.
+func applyTarget(outReq *http.Request, target *url.URL) {
+	u := *outReq.URL
+	u.Host = target.Host
+	u.Scheme = websocketScheme(target.Scheme)
+	outReq.URL = &u
+}
+
+// Validate checks the configuration of the proxy, e.g. the key of the Resumption, and parses AllowedClientCIDRs.
+// It is meant to be called once the proxy is configured, before serving the requests, and must not run while the proxy is serving.
+func (p *ReverseProxy) Validate() error {
+	if err := checkForceScheme(p.ForceScheme); err != nil {
+		return err
+	}
+
+	if p.Resumption != nil {
+		if len(p.Resumption.Key) == 0 {
+			return errResumptionKey
+		}
+		if _, ok := p.Picker.(TargetLister); !ok {
+			return errResumptionPicker
+		}
+	}
+
+	_, err := p.clientCIDRs()
+	return err
+}
+
+// websocketScheme maps the http and https schemes to ws and wss.
+func websocketScheme(scheme string) string {
+	switch scheme {
+	case "https":
+		return "wss"
+	case "http":
+		return "ws"
+	default:
+		return scheme
+	}
+}
+
+// checkForceScheme reports an error if the forced scheme of the backend URL is not a websocket scheme.
+func checkForceScheme(scheme string) error {
+	switch scheme {
+	case "", "ws", "wss":
+		return nil
+	default:
+		return fmt.Errorf("websocket: invalid forced scheme %q, it must be ws or wss", scheme)
+	}
+}
+
+// dialContext returns the context of the dial of the backend.
+func (c *ConnConfig) dialContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.DialTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.DialTimeout)
+}
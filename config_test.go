@@ -0,0 +1,172 @@
+package websocketproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newNamedEchoBackend returns a backend sending its name as the first message, then echoing the messages.
+func newNamedEchoBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+
+	upgrader := gorillawebsocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		if err = conn.WriteMessage(gorillawebsocket.TextMessage, []byte(name)); err != nil {
+			return
+		}
+
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = conn.WriteMessage(msgType, msg); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestConfigResolver(t *testing.T) {
+	backendA := newNamedEchoBackend(t, "a")
+	defer backendA.Close()
+	backendB := newNamedEchoBackend(t, "b")
+	defer backendB.Close()
+
+	configs := map[string]*ConnConfig{}
+	for name, backend := range map[string]*httptest.Server{"a": backendA, "b": backendB} {
+		target, err := url.Parse(backend.URL)
+		require.NoError(t, err)
+		configs[name] = &ConnConfig{Target: target}
+	}
+	// the name sent by the backend is the only message allowed.
+	configs["a"].MaxMessagesPerConnection = 1
+
+	// the Director targets a backend that doesn't exist.
+	uri, err := url.Parse("http://127.0.0.1:1")
+	require.NoError(t, err)
+
+	p := NewSingleHostReverseProxy(uri)
+	p.Logger = &printfRecorder{}
+	p.ConfigResolver = func(req *http.Request) (*ConnConfig, error) {
+		cfg, ok := configs[req.Header.Get("X-Tenant")]
+		if !ok {
+			return nil, errors.New("unknown tenant")
+		}
+		return cfg, nil
+	}
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	dial := func(tenant string) (*gorillawebsocket.Conn, *http.Response, error) {
+		header := http.Header{}
+		header.Set("X-Tenant", tenant)
+		return gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), header)
+	}
+
+	t.Run("tenant a", func(t *testing.T) {
+		conn, _, err := dial("a")
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, name, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "a", string(name))
+
+		require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("OK")))
+
+		_, _, err = conn.ReadMessage()
+		assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.ClosePolicyViolation), "got: %v", err)
+	})
+
+	t.Run("tenant b", func(t *testing.T) {
+		conn, _, err := dial("b")
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, name, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "b", string(name))
+
+		for i := 0; i < 3; i++ {
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("OK")))
+
+			_, msg, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, "OK", string(msg))
+		}
+	})
+
+	t.Run("unknown tenant", func(t *testing.T) {
+		_, resp, err := dial("c")
+		require.Error(t, err)
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		configure   func(p *ReverseProxy)
+		expectedErr string
+	}{
+		{
+			desc:      "valid",
+			configure: func(p *ReverseProxy) { p.AllowedClientCIDRs = []string{"10.0.0.0/8", " 2001:db8::/32"} },
+		},
+		{
+			desc:        "invalid client CIDR",
+			configure:   func(p *ReverseProxy) { p.AllowedClientCIDRs = []string{"10.0.0.0/8", "127.0.0.1"} },
+			expectedErr: "websocket: invalid allowed client CIDR: invalid CIDR address: 127.0.0.1",
+		},
+		{
+			desc: "resumption without key",
+			configure: func(p *ReverseProxy) {
+				p.Picker = NewWeightedRoundRobinPicker(nil)
+				p.Resumption = &Resumption{}
+			},
+			expectedErr: "websocket: the resumption tokens require a Key",
+		},
+		{
+			desc:        "resumption without target lister",
+			configure:   func(p *ReverseProxy) { p.Resumption = &Resumption{Key: []byte("secret")} },
+			expectedErr: "websocket: the resumption tokens require a Picker implementing TargetLister",
+		},
+		{
+			desc:        "invalid forced scheme",
+			configure:   func(p *ReverseProxy) { p.ForceScheme = "https" },
+			expectedErr: `websocket: invalid forced scheme "https", it must be ws or wss`,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			p := &ReverseProxy{}
+			test.configure(p)
+
+			err := p.Validate()
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+				assert.Nil(t, p.clientNets)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, p.clientNets, len(p.AllowedClientCIDRs))
+		})
+	}
+}
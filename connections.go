@@ -0,0 +1,347 @@
+package websocketproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrConnectionNotFound is returned when no active connection matches the given id.
+var ErrConnectionNotFound = errors.New("websocket: connection not found")
+
+// ConnectionInfo describes an active proxied connection.
+type ConnectionInfo struct {
+	ID            string
+	RemoteAddr    string
+	BackendURL    string
+	StartTime     time.Time
+	CorrelationID string
+}
+
+// Peer identifies a side of a proxied connection.
+type Peer string
+
+// Peers of a proxied connection.
+const (
+	PeerClient  Peer = "client"
+	PeerBackend Peer = "backend"
+	PeerProxy   Peer = "proxy"
+)
+
+// ClosePropagation selects the peers receiving a close frame when the proxy terminates a connection.
+// The other peers are disconnected without a close frame.
+type ClosePropagation int
+
+// Close propagations.
+const (
+	// ClosePropagationBoth sends a close frame to the client, then to the backend.
+	ClosePropagationBoth ClosePropagation = iota
+	// ClosePropagationClient sends a close frame to the client only.
+	ClosePropagationClient
+	// ClosePropagationBackend sends a close frame to the backend only.
+	ClosePropagationBackend
+)
+
+// sendClose sends the close frames of a proxy-initiated close to the selected peers.
+func (c ClosePropagation) sendClose(clientConn, backendConn *websocket.Conn, clientMsg, backendMsg []byte) {
+	deadline := time.Now().Add(closeWriteTimeout)
+	if c != ClosePropagationBackend {
+		_ = clientConn.WriteControl(websocket.CloseMessage, clientMsg, deadline)
+	}
+	if c != ClosePropagationClient {
+		_ = backendConn.WriteControl(websocket.CloseMessage, backendMsg, deadline)
+	}
+}
+
+// CloseInfo describes the termination of a proxied connection.
+type CloseInfo struct {
+	// Code is the close code, websocket.CloseAbnormalClosure if the connection was dropped without a close frame.
+	Code int
+	// Text is the close reason.
+	Text string
+	// Initiator is the peer that terminated the connection.
+	Initiator Peer
+
+	// Bytes is the number of bytes of the data messages forwarded in each direction, indexed by Direction.
+	Bytes [2]int64
+	// Messages is the number of data messages forwarded in each direction, indexed by Direction.
+	Messages [2]int64
+
+	// ClientCompression and BackendCompression are the compression stats of the connections to the client and to the backend,
+	// if permessage-deflate is negotiated with them.
+	ClientCompression  *CompressionStats
+	BackendCompression *CompressionStats
+
+	// CorrelationID is the correlation id of the connection, if the proxy has a CorrelationHeader.
+	CorrelationID string
+}
+
+// newCloseInfo returns the close info of a connection terminated by the peer, with the error returned when reading from it.
+func newCloseInfo(peer Peer, err error) CloseInfo {
+	if e, ok := err.(*websocket.CloseError); ok {
+		return CloseInfo{Code: e.Code, Text: e.Text, Initiator: peer}
+	}
+	return CloseInfo{Code: websocket.CloseAbnormalClosure, Initiator: peer}
+}
+
+// connection a proxied websocket connection.
+type connection struct {
+	id          string
+	req         *http.Request
+	target      string
+	clientConn  *websocket.Conn
+	backendConn *websocket.Conn
+	start       time.Time
+	limiters    []*rateLimiter
+	propagation ClosePropagation
+	maxMessages int64
+	messages    int64
+
+	// correlationID is the id forwarded in the CorrelationHeader, if any.
+	correlationID string
+
+	// ctx is canceled when the connection terminates.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	closeOnce sync.Once
+	// closing is closed when the proxy terminates the connection.
+	closing chan struct{}
+	// closeInfo is the close sent by the proxy, set before closing is closed.
+	closeInfo CloseInfo
+
+	// stopFirstMessageTimer stops the timer closing the connection if the client sends no message in time, if set.
+	stopFirstMessageTimer func() bool
+	firstMessageOnce      sync.Once
+
+	// closeSent marks the peers which received a close frame from the relays, indexed by the direction toward them.
+	closeSent [2]int32
+
+	// forwardedBytes and forwardedMessages count the data messages forwarded by the relays, indexed by direction.
+	forwardedBytes    [2]int64
+	forwardedMessages [2]int64
+
+	// link is the backend connection, when the backend is reconnected on drops.
+	link *backendLink
+
+	// clientWire and backendWire count the bytes of the compressed connections to the peers, if any.
+	clientWire  *wireCounter
+	backendWire *wireCounter
+}
+
+func newConnection(req *http.Request, target string, clientConn, backendConn *websocket.Conn) *connection {
+	ctx, cancel := context.WithCancel(req.Context())
+
+	id := ConnectionIDFromContext(ctx)
+	if id == "" {
+		id = newUUID()
+	}
+
+	return &connection{
+		id:          id,
+		req:         req,
+		target:      target,
+		clientConn:  clientConn,
+		backendConn: backendConn,
+		start:       time.Now(),
+		ctx:         ctx,
+		cancel:      cancel,
+		closing:     make(chan struct{}),
+	}
+}
+
+// close sends a close frame to the peers selected by the propagation and signals the termination of the connection.
+func (c *connection) close(code int, text string) {
+	c.closeOnce.Do(func() {
+		msg := formatCloseMessage(code, text)
+		c.propagation.sendClose(c.clientConn, c.backend(), msg, msg)
+		c.closeInfo = CloseInfo{Code: code, Text: text, Initiator: PeerProxy}
+		close(c.closing)
+		c.cancel()
+	})
+}
+
+// backend returns the current backend connection.
+func (c *connection) backend() *websocket.Conn {
+	if c.link != nil {
+		return c.link.current()
+	}
+	return c.backendConn
+}
+
+// closed reports whether the proxy terminated the connection.
+func (c *connection) closed() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// markCloseSent marks the close frame toward the destination of the direction as sent,
+// and reports whether it was not sent yet.
+func (c *connection) markCloseSent(dir Direction) bool {
+	return atomic.CompareAndSwapInt32(&c.closeSent[dir], 0, 1)
+}
+
+// isCloseSent reports whether a close frame was sent toward the destination of the direction.
+func (c *connection) isCloseSent(dir Direction) bool {
+	return atomic.LoadInt32(&c.closeSent[dir]) == 1
+}
+
+// addForwarded records a data message forwarded in the direction.
+func (c *connection) addForwarded(dir Direction, n int64) {
+	atomic.AddInt64(&c.forwardedBytes[dir], n)
+	atomic.AddInt64(&c.forwardedMessages[dir], 1)
+}
+
+// withForwarded returns the close info with the counts of the forwarded data messages,
+// and the compression stats of the compressed connections.
+func (c *connection) withForwarded(info CloseInfo) CloseInfo {
+	for _, dir := range []Direction{ClientToBackend, BackendToClient} {
+		info.Bytes[dir] = atomic.LoadInt64(&c.forwardedBytes[dir])
+		info.Messages[dir] = atomic.LoadInt64(&c.forwardedMessages[dir])
+	}
+
+	// the messages forwarded in both directions are exchanged with each peer.
+	payload := info.Bytes[ClientToBackend] + info.Bytes[BackendToClient]
+	if c.clientWire != nil {
+		info.ClientCompression = c.clientWire.stats(payload)
+	}
+	if c.backendWire != nil {
+		info.BackendCompression = c.backendWire.stats(payload)
+	}
+	return info
+}
+
+// messageReceived records a message from the client.
+func (c *connection) messageReceived() {
+	if c.stopFirstMessageTimer != nil {
+		c.firstMessageOnce.Do(func() {
+			c.stopFirstMessageTimer()
+		})
+	}
+}
+
+// incMessages increments the number of messages carried by the connection, and returns it.
+func (c *connection) incMessages() int64 {
+	return atomic.AddInt64(&c.messages, 1)
+}
+
+// registerConnection registers the connection, unless the proxy is shutting down.
+// The check and the registration are atomic with the beginning of a shutdown.
+func (p *ReverseProxy) registerConnection(c *connection) bool {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	if p.shuttingDown {
+		return false
+	}
+
+	if p.conns == nil {
+		p.conns = make(map[string]*connection)
+	}
+	p.conns[c.id] = c
+	return true
+}
+
+func (p *ReverseProxy) unregisterConnection(c *connection) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	delete(p.conns, c.id)
+}
+
+func (p *ReverseProxy) getConnection(id string) (*connection, bool) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	c, ok := p.conns[id]
+	return c, ok
+}
+
+// ActiveConnections returns the active connections, oldest first.
+func (p *ReverseProxy) ActiveConnections() []ConnectionInfo {
+	p.connsMu.Lock()
+	infos := make([]ConnectionInfo, 0, len(p.conns))
+	for _, c := range p.conns {
+		infos = append(infos, c.info())
+	}
+	p.connsMu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartTime.Before(infos[j].StartTime)
+	})
+	return infos
+}
+
+func (c *connection) info() ConnectionInfo {
+	return ConnectionInfo{
+		ID:            c.id,
+		RemoteAddr:    c.req.RemoteAddr,
+		BackendURL:    c.target,
+		StartTime:     c.start,
+		CorrelationID: c.correlationID,
+	}
+}
+
+// CloseConnectionWithReason closes the active connection with the given id,
+// sending a close frame with the given code and reason to the peers selected by ClosePropagation before the teardown.
+func (p *ReverseProxy) CloseConnectionWithReason(id string, code int, text string) error {
+	if !isValidCloseCode(code) {
+		return fmt.Errorf("websocket: invalid close code %d", code)
+	}
+
+	if len(text) > maxCloseReasonLength || !utf8.ValidString(text) {
+		return fmt.Errorf("websocket: invalid close reason, it must be valid UTF-8 of at most %d bytes", maxCloseReasonLength)
+	}
+
+	c, ok := p.getConnection(id)
+	if !ok {
+		return ErrConnectionNotFound
+	}
+
+	c.close(code, text)
+	return nil
+}
+
+// isValidCloseCode reports whether the code can be sent in a close frame.
+// See RFC 6455, section 7.4.
+func isValidCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	default:
+		return false
+	}
+}
+
+// newConnID generates the id of a connection with NewConnID, if set.
+func (p *ReverseProxy) newConnID() string {
+	if p.NewConnID == nil {
+		return newUUID()
+	}
+	return p.NewConnID()
+}
+
+// newUUID generates a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,531 @@
+package websocketproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/juliens/websocketproxy/websocketproxytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForConnection returns the id of the active connection opened by the given client.
+func waitForConnection(t *testing.T, p *ReverseProxy, client *gorillawebsocket.Conn) string {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		p.connsMu.Lock()
+		for id, c := range p.conns {
+			if c.req.RemoteAddr == client.LocalAddr().String() {
+				p.connsMu.Unlock()
+				return id
+			}
+		}
+		p.connsMu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.FailNow(t, "connection not registered")
+	return ""
+}
+
+func newRegistryProxy(t *testing.T, backend *httptest.Server) (*ReverseProxy, *httptest.Server) {
+	t.Helper()
+
+	uri, err := url.ParseRequestURI(backend.URL)
+	require.NoError(t, err)
+
+	p := NewSingleHostReverseProxy(uri)
+	return p, httptest.NewServer(p)
+}
+
+func TestCloseConnectionWithReason(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	p, proxy := newRegistryProxy(t, backend)
+	defer proxy.Close()
+
+	target, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = target.Close() }()
+
+	other, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = other.Close() }()
+
+	id := waitForConnection(t, p, target)
+	waitForConnection(t, p, other)
+
+	err = p.CloseConnectionWithReason(id, 4001, "closed by admin")
+	require.NoError(t, err)
+
+	_, _, err = target.ReadMessage()
+	closeErr, ok := err.(*gorillawebsocket.CloseError)
+	require.True(t, ok, "expected a close frame, got: %v", err)
+	assert.Equal(t, 4001, closeErr.Code)
+	assert.Equal(t, "closed by admin", closeErr.Text)
+
+	err = other.WriteMessage(gorillawebsocket.TextMessage, []byte("OK"))
+	require.NoError(t, err)
+	_, msg, err := other.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "OK", string(msg))
+
+	err = p.CloseConnectionWithReason(id, gorillawebsocket.CloseNormalClosure, "")
+	assert.Equal(t, ErrConnectionNotFound, err)
+}
+
+func TestCloseConnectionWithReasonValidation(t *testing.T) {
+	p := &ReverseProxy{}
+
+	testCases := []struct {
+		desc string
+		code int
+		text string
+	}{
+		{desc: "reserved code", code: gorillawebsocket.CloseNoStatusReceived},
+		{desc: "abnormal closure", code: gorillawebsocket.CloseAbnormalClosure},
+		{desc: "out of range", code: 5000},
+		{desc: "reason too long", code: gorillawebsocket.CloseNormalClosure, text: strings.Repeat("a", 124)},
+		{desc: "invalid UTF-8", code: gorillawebsocket.CloseNormalClosure, text: "\xff"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			err := p.CloseConnectionWithReason("id", test.code, test.text)
+			require.Error(t, err)
+			assert.NotEqual(t, ErrConnectionNotFound, err)
+		})
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	id := newUUID()
+	assert.Len(t, id, 36)
+	assert.Equal(t, byte('4'), id[14])
+	assert.NotEqual(t, id, newUUID())
+}
+
+func TestNewConnID(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	var n int32
+	authorized := make(chan string, 1)
+	closed := make(chan string, 1)
+
+	p, proxy := newRegistryProxy(t, backend)
+	p.NewConnID = func() string {
+		return fmt.Sprintf("conn-%d", atomic.AddInt32(&n, 1))
+	}
+	p.Authorize = func(req *http.Request) error {
+		authorized <- ConnectionIDFromContext(req.Context())
+		return nil
+	}
+	p.ConnectionClosedHook = func(req *http.Request, info CloseInfo) {
+		closed <- ConnectionIDFromContext(req.Context())
+	}
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, "conn-1", <-authorized)
+	waitForActiveConnections(t, p, 1)
+	assert.Equal(t, "conn-1", p.ActiveConnections()[0].ID)
+
+	_ = conn.Close()
+	select {
+	case id := <-closed:
+		assert.Equal(t, "conn-1", id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the closed hook")
+	}
+}
+
+func TestActiveConnections(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	p, proxy := newRegistryProxy(t, backend)
+	defer proxy.Close()
+
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = p.ActiveConnections()
+			}
+		}
+	}()
+
+	var clients []*gorillawebsocket.Conn
+	for i := 0; i < 3; i++ {
+		conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+		require.NoError(t, err)
+		clients = append(clients, conn)
+		waitForConnection(t, p, conn)
+	}
+
+	infos := p.ActiveConnections()
+	require.Len(t, infos, 3)
+	for i, info := range infos {
+		assert.NotEmpty(t, info.ID)
+		assert.Equal(t, clients[i].LocalAddr().String(), info.RemoteAddr)
+		assert.Equal(t, "ws://"+backend.Listener.Addr().String()+"/ws", info.BackendURL)
+		assert.False(t, info.StartTime.IsZero())
+	}
+
+	// a normal close.
+	err := clients[0].WriteMessage(gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, ""))
+	require.NoError(t, err)
+	// an abnormal close.
+	_ = clients[1].Close()
+
+	waitForActiveConnections(t, p, 1)
+	assert.Equal(t, clients[2].LocalAddr().String(), p.ActiveConnections()[0].RemoteAddr)
+
+	_ = clients[2].Close()
+	_ = clients[0].Close()
+	waitForActiveConnections(t, p, 0)
+
+	close(stop)
+	<-polled
+}
+
+func waitForActiveConnections(t *testing.T, p *ReverseProxy, expected int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(p.ActiveConnections()) == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.Len(t, p.ActiveConnections(), expected)
+}
+
+func TestMaxMessagesPerConnection(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	p, proxy := newRegistryProxy(t, backend)
+	p.MaxMessagesPerConnection = 3
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// the message and its echo.
+	err = conn.WriteMessage(gorillawebsocket.TextMessage, []byte("1"))
+	require.NoError(t, err)
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(msg))
+
+	// the message is forwarded, its echo exceeds the limit.
+	err = conn.WriteMessage(gorillawebsocket.TextMessage, []byte("2"))
+	require.NoError(t, err)
+
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*gorillawebsocket.CloseError)
+	require.True(t, ok, "expected a close frame, got: %v", err)
+	assert.Equal(t, gorillawebsocket.ClosePolicyViolation, closeErr.Code)
+
+	waitForActiveConnections(t, p, 0)
+}
+
+func TestMaxConnectionLifetime(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		closeCode    int
+		expectedCode int
+	}{
+		{
+			desc:         "default close code",
+			expectedCode: gorillawebsocket.CloseGoingAway,
+		},
+		{
+			desc:         "custom close code",
+			closeCode:    4000,
+			expectedCode: 4000,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			received := make(chan error, 1)
+			upgrader := gorillawebsocket.Upgrader{}
+			backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				conn, err := upgrader.Upgrade(rw, req, nil)
+				if err != nil {
+					return
+				}
+				defer func() { _ = conn.Close() }()
+
+				for {
+					msgType, msg, err := conn.ReadMessage()
+					if err != nil {
+						received <- err
+						return
+					}
+					_ = conn.WriteMessage(msgType, msg)
+				}
+			}))
+			defer backend.Close()
+
+			lifetime := 100 * time.Millisecond
+			p, proxy := newRegistryProxy(t, backend)
+			p.MaxConnectionLifetime = lifetime
+			p.MaxConnectionLifetimeCloseCode = test.closeCode
+			defer proxy.Close()
+
+			start := time.Now()
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			// the activity does not extend the lifetime.
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("OK")))
+			_, _, err = conn.ReadMessage()
+			require.NoError(t, err)
+
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+			_, _, err = conn.ReadMessage()
+			assert.True(t, gorillawebsocket.IsCloseError(err, test.expectedCode), "client: %v", err)
+			assert.True(t, time.Since(start) >= lifetime)
+
+			select {
+			case err = <-received:
+				assert.True(t, gorillawebsocket.IsCloseError(err, test.expectedCode), "backend: %v", err)
+			case <-time.After(time.Second):
+				require.FailNow(t, "backend not closed")
+			}
+
+			waitForActiveConnections(t, p, 0)
+		})
+	}
+}
+
+func TestFirstMessageTimeout(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	timeout := 100 * time.Millisecond
+	p, proxy := newRegistryProxy(t, backend)
+	p.FirstMessageTimeout = timeout
+	p.FirstMessageTimeoutCloseCode = 4008
+	defer proxy.Close()
+
+	// a silent client.
+	silent, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = silent.Close() }()
+
+	// a client sending its first message in time.
+	prompt, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = prompt.Close() }()
+
+	require.NoError(t, prompt.WriteMessage(gorillawebsocket.TextMessage, []byte("auth")))
+	_, _, err = prompt.ReadMessage()
+	require.NoError(t, err)
+
+	require.NoError(t, silent.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, _, err = silent.ReadMessage()
+	assert.True(t, gorillawebsocket.IsCloseError(err, 4008), "silent client: %v", err)
+
+	waitForActiveConnections(t, p, 1)
+
+	// the timeout no longer applies once the first message is received.
+	time.Sleep(timeout)
+	require.NoError(t, prompt.WriteMessage(gorillawebsocket.TextMessage, []byte("OK")))
+	_, msg, err := prompt.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "OK", string(msg))
+}
+
+func TestFirstMessageTimeoutClock(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	clock := websocketproxytest.NewClock(time.Now())
+	p, proxy := newRegistryProxy(t, backend)
+	p.Clock = clock
+	p.FirstMessageTimeout = time.Hour
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, clock.WaitForTimers(ctx, 1))
+
+	clock.Advance(time.Hour)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.ClosePolicyViolation), "client: %v", err)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	received := make(chan error, 1)
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		// floods the client until the proxy gives up on it.
+		go func() {
+			msg := make([]byte, 64*1024)
+			for {
+				if err := conn.WriteMessage(gorillawebsocket.BinaryMessage, msg); err != nil {
+					return
+				}
+			}
+		}()
+
+		_, _, err = conn.ReadMessage()
+		received <- err
+	}))
+	defer backend.Close()
+
+	p, proxy := newRegistryProxy(t, backend)
+	p.Logger = &printfRecorder{}
+	p.WriteTimeout = 100 * time.Millisecond
+	defer proxy.Close()
+
+	// a client that never reads.
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	select {
+	case err := <-received:
+		assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.ClosePolicyViolation), "backend: %v", err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "slow client not dropped")
+	}
+
+	waitForActiveConnections(t, p, 0)
+}
+
+func TestWriteTimeoutSlowSender(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	p, proxy := newRegistryProxy(t, backend)
+	p.Logger = &printfRecorder{}
+	p.WriteTimeout = 100 * time.Millisecond
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// a streamed message sent slower than the write timeout, to a healthy backend.
+	writer, err := conn.NextWriter(gorillawebsocket.BinaryMessage)
+	require.NoError(t, err)
+	chunk := bytes.Repeat([]byte("a"), 8*1024)
+	for i := 0; i < 6; i++ {
+		_, err = writer.Write(chunk)
+		require.NoError(t, err)
+		time.Sleep(40 * time.Millisecond)
+	}
+	require.NoError(t, writer.Close())
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Len(t, msg, 6*len(chunk))
+}
+
+func TestClosePropagation(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		propagation     ClosePropagation
+		expectedClient  int
+		expectedBackend int
+	}{
+		{
+			desc:            "both",
+			propagation:     ClosePropagationBoth,
+			expectedClient:  4001,
+			expectedBackend: 4001,
+		},
+		{
+			desc:            "client only",
+			propagation:     ClosePropagationClient,
+			expectedClient:  4001,
+			expectedBackend: gorillawebsocket.CloseAbnormalClosure,
+		},
+		{
+			desc:            "backend only",
+			propagation:     ClosePropagationBackend,
+			expectedClient:  gorillawebsocket.CloseAbnormalClosure,
+			expectedBackend: 4001,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			received := make(chan error, 1)
+			upgrader := gorillawebsocket.Upgrader{}
+			backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				conn, err := upgrader.Upgrade(rw, req, nil)
+				if err != nil {
+					return
+				}
+				defer func() { _ = conn.Close() }()
+
+				_, _, err = conn.ReadMessage()
+				received <- err
+			}))
+			defer backend.Close()
+
+			p, proxy := newRegistryProxy(t, backend)
+			defer proxy.Close()
+			p.ClosePropagation = test.propagation
+
+			client, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = client.Close() }()
+
+			id := waitForConnection(t, p, client)
+			require.NoError(t, p.CloseConnectionWithReason(id, 4001, "closed by admin"))
+
+			_, _, err = client.ReadMessage()
+			assert.True(t, gorillawebsocket.IsCloseError(err, test.expectedClient), "client: %v", err)
+
+			err = <-received
+			assert.True(t, gorillawebsocket.IsCloseError(err, test.expectedBackend), "backend: %v", err)
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package websocketproxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTooManyConnections is reported when a request is refused because MaxConnections is reached,
+// and it can't be queued, or it waited too long in the queue.
+var ErrTooManyConnections = errors.New("websocket: too many connections")
+
+// Connection queue defaults.
+const (
+	defaultMaxQueued    = 100
+	defaultMaxQueueWait = 5 * time.Second
+)
+
+// ConnectionQueue queues the requests exceeding MaxConnections,
+// admitted in their arrival order as the connections terminate, e.g. to smooth the bursts during a scale-up of the backends.
+// A queued request is rejected with a 503 Service Unavailable once it waited MaxWait,
+// or when its context is done.
+type ConnectionQueue struct {
+	// MaxQueued is the maximum number of queued requests.
+	// Past it, the requests are rejected with a 503 Service Unavailable.
+	// If zero, 100 requests are queued.
+	MaxQueued int
+
+	// MaxWait is the maximum wait of a queued request.
+	// If zero, 5s is used.
+	MaxWait time.Duration
+}
+
+func (q *ConnectionQueue) maxQueued() int {
+	if q == nil {
+		return 0
+	}
+	if q.MaxQueued <= 0 {
+		return defaultMaxQueued
+	}
+	return q.MaxQueued
+}
+
+func (q *ConnectionQueue) maxWait() time.Duration {
+	if q.MaxWait <= 0 {
+		return defaultMaxQueueWait
+	}
+	return q.MaxWait
+}
+
+// connectionSlots the slots of the connections limited by MaxConnections,
+// handed over to the queued requests in their arrival order.
+type connectionSlots struct {
+	mu      sync.Mutex
+	used    int
+	max     int
+	waiters []chan struct{}
+}
+
+func (p *ReverseProxy) slots() *connectionSlots {
+	p.connectionSlotsOnce.Do(func() {
+		p.connectionSlots = &connectionSlots{max: p.MaxConnections}
+	})
+	return p.connectionSlots
+}
+
+// acquireConnection reserves a slot for a connection, queuing the request if MaxConnections is reached and ConnectionQueue is set.
+// It returns the function releasing the slot, which can be called more than once.
+func (p *ReverseProxy) acquireConnection(ctx context.Context) (func(), error) {
+	if p.MaxConnections <= 0 {
+		return func() {}, nil
+	}
+
+	s := p.slots()
+
+	var once sync.Once
+	release := func() {
+		once.Do(s.release)
+	}
+
+	s.mu.Lock()
+	if s.used < s.max && len(s.waiters) == 0 {
+		s.used++
+		s.mu.Unlock()
+		return release, nil
+	}
+	if len(s.waiters) >= p.ConnectionQueue.maxQueued() {
+		s.mu.Unlock()
+		return nil, ErrTooManyConnections
+	}
+	admitted := make(chan struct{})
+	s.waiters = append(s.waiters, admitted)
+	s.mu.Unlock()
+
+	timeout, stop := p.clock().NewTimer(p.ConnectionQueue.maxWait())
+	defer stop()
+
+	var err error
+	select {
+	case <-admitted:
+		return release, nil
+	case <-timeout:
+		err = ErrTooManyConnections
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-p.doneChan():
+		err = ErrShuttingDown
+	}
+
+	if !s.dequeue(admitted) {
+		// the slot was handed over meanwhile.
+		release()
+	}
+	return nil, err
+}
+
+// release releases a slot, handing it over to the first queued request, if any.
+func (s *connectionSlots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.waiters) == 0 {
+		s.used--
+		return
+	}
+
+	close(s.waiters[0])
+	s.waiters = s.waiters[1:]
+}
+
+// dequeue removes a queued request, and reports whether it was still queued.
+func (s *connectionSlots) dequeue(admitted chan struct{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, w := range s.waiters {
+		if w == admitted {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// QueuedConnections returns the number of requests queued by ConnectionQueue.
+func (p *ReverseProxy) QueuedConnections() int {
+	if p.MaxConnections <= 0 {
+		return 0
+	}
+
+	s := p.slots()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.waiters)
+}
@@ -0,0 +1,121 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type dialResult struct {
+	conn   *gorillawebsocket.Conn
+	status int
+	err    error
+}
+
+// dialAsync dials the proxy in the background.
+func dialAsync(url string) chan dialResult {
+	result := make(chan dialResult, 1)
+	go func() {
+		conn, resp, err := gorillawebsocket.DefaultDialer.Dial(url, nil)
+		r := dialResult{conn: conn, err: err}
+		if resp != nil {
+			r.status = resp.StatusCode
+		}
+		result <- r
+	}()
+	return result
+}
+
+func waitForQueuedConnections(t *testing.T, p *ReverseProxy, expected int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for p.QueuedConnections() != expected {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "unexpected queued connections", "expected %d, got %d", expected, p.QueuedConnections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func receiveDial(t *testing.T, result chan dialResult) dialResult {
+	t.Helper()
+
+	select {
+	case r := <-result:
+		return r
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "dial not completed")
+		return dialResult{}
+	}
+}
+
+func TestConnectionQueue(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	p, proxy := newRegistryProxy(t, backend)
+	p.Logger = &printfRecorder{}
+	p.MaxConnections = 1
+	p.ConnectionQueue = &ConnectionQueue{MaxQueued: 2, MaxWait: 5 * time.Second}
+	defer proxy.Close()
+
+	first := receiveDial(t, dialAsync(wsURL(proxy, "/ws")))
+	require.NoError(t, first.err)
+	defer func() { _ = first.conn.Close() }()
+
+	second := dialAsync(wsURL(proxy, "/ws"))
+	waitForQueuedConnections(t, p, 1)
+	third := dialAsync(wsURL(proxy, "/ws"))
+	waitForQueuedConnections(t, p, 2)
+
+	// the queue is full.
+	rejected := receiveDial(t, dialAsync(wsURL(proxy, "/ws")))
+	require.Error(t, rejected.err)
+	assert.Equal(t, http.StatusServiceUnavailable, rejected.status)
+
+	// the queued requests are admitted in order, as the connections terminate.
+	_ = first.conn.Close()
+
+	r := receiveDial(t, second)
+	require.NoError(t, r.err)
+	defer func() { _ = r.conn.Close() }()
+	assert.Equal(t, 1, p.QueuedConnections())
+
+	select {
+	case <-third:
+		require.FailNow(t, "third request admitted before the second connection terminated")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_ = r.conn.Close()
+
+	r = receiveDial(t, third)
+	require.NoError(t, r.err)
+	defer func() { _ = r.conn.Close() }()
+	assert.Equal(t, 0, p.QueuedConnections())
+}
+
+func TestConnectionQueueMaxWait(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	p, proxy := newRegistryProxy(t, backend)
+	p.Logger = &printfRecorder{}
+	p.MaxConnections = 1
+	p.ConnectionQueue = &ConnectionQueue{MaxWait: 100 * time.Millisecond}
+	defer proxy.Close()
+
+	first := receiveDial(t, dialAsync(wsURL(proxy, "/ws")))
+	require.NoError(t, first.err)
+	defer func() { _ = first.conn.Close() }()
+
+	r := receiveDial(t, dialAsync(wsURL(proxy, "/ws")))
+	require.Error(t, r.err)
+	assert.Equal(t, http.StatusServiceUnavailable, r.status)
+	assert.Equal(t, 0, p.QueuedConnections())
+}
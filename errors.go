@@ -0,0 +1,226 @@
+package websocketproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// Errors reported to the error handler, wrapped in a *ProxyError.
+var (
+	// ErrDialFailed is reported when the backend can not be reached.
+	ErrDialFailed = errors.New("websocket: dial failed")
+	// ErrHandshakeRejected is reported when the backend rejects the handshake, or answers with a malformed response.
+	ErrHandshakeRejected = errors.New("websocket: handshake rejected")
+	// ErrUpgradeFailed is reported when the client connection can not be upgraded.
+	ErrUpgradeFailed = errors.New("websocket: upgrade failed")
+)
+
+// ProxyError is an error proxying a connection, classified by its Kind:
+// ErrDialFailed, ErrHandshakeRejected or ErrUpgradeFailed.
+// Both the kind and the underlying error can be matched with errors.Is and errors.As.
+type ProxyError struct {
+	// Kind is the class of the error.
+	Kind error
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of the error.
+func (e *ProxyError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// HandshakeError is returned when the backend answers the handshake with
+// a 101 Switching Protocols response that is not a consistent websocket upgrade.
+type HandshakeError struct {
+	// Reason describes the inconsistency.
+	Reason string
+	// Err is the error returned by the dialer, if any.
+	Err error
+}
+
+func (e *HandshakeError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("websocket: malformed backend handshake response: %s: %v", e.Reason, e.Err)
+	}
+	return fmt.Sprintf("websocket: malformed backend handshake response: %s", e.Reason)
+}
+
+// Unwrap returns the error returned by the dialer.
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is an error reported to the client with a specific status code,
+// e.g. by a Picker, a ConfigResolver or a RewriteURL function.
+// The default error handler sends its Status; a custom ErrorHandler can read it with errors.As.
+type StatusError struct {
+	// Status is the HTTP status code of the response.
+	Status int
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// errorStatus returns the status code reported to the client for the error.
+func errorStatus(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Status
+	}
+	return http.StatusBadGateway
+}
+
+// validateBackendHandshake checks the upgrade headers of the backend handshake response.
+// The Sec-WebSocket-Accept value is checked by the dialer, which owns the challenge key.
+func validateBackendHandshake(resp *http.Response, dialErr error) error {
+	switch {
+	case !strings.EqualFold(resp.Header.Get(Upgrade), "websocket"):
+		return &HandshakeError{Reason: "invalid Upgrade header", Err: dialErr}
+	case !headerContainsToken(resp.Header, Connection, "upgrade"):
+		return &HandshakeError{Reason: "invalid Connection header", Err: dialErr}
+	case resp.Header.Get(SecWebsocketAccept) == "":
+		return &HandshakeError{Reason: "missing Sec-WebSocket-Accept header", Err: dialErr}
+	case dialErr != nil:
+		return &HandshakeError{Reason: "invalid Sec-WebSocket-Accept header", Err: dialErr}
+	}
+	return nil
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, v := range header[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DialErrorCategory the category of an error dialing the backend.
+type DialErrorCategory int
+
+// Dial error categories.
+const (
+	DialErrorOther DialErrorCategory = iota
+	DialErrorDNS
+	DialErrorConnectionRefused
+	DialErrorTLS
+	DialErrorTimeout
+	// DialErrorHandshake the backend rejected the handshake, or answered with a malformed response.
+	DialErrorHandshake
+)
+
+func (c DialErrorCategory) String() string {
+	switch c {
+	case DialErrorDNS:
+		return "dns"
+	case DialErrorConnectionRefused:
+		return "connection_refused"
+	case DialErrorTLS:
+		return "tls"
+	case DialErrorTimeout:
+		return "timeout"
+	case DialErrorHandshake:
+		return "handshake"
+	default:
+		return "other"
+	}
+}
+
+// classifyDialError returns the category of an error dialing the backend.
+// resp is the backend handshake response, if any.
+func classifyDialError(err error, resp *http.Response) DialErrorCategory {
+	var dnsErr *net.DNSError
+	var handshakeErr *HandshakeError
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var netErr net.Error
+
+	switch {
+	case resp != nil || errors.As(err, &handshakeErr):
+		return DialErrorHandshake
+	case errors.As(err, &dnsErr):
+		return DialErrorDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DialErrorConnectionRefused
+	case errors.As(err, &recordErr), errors.As(err, &certErr), errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return DialErrorTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return DialErrorTimeout
+	default:
+		return DialErrorOther
+	}
+}
+
+// partialMessageError an error forwarding a message, once a part of it has been written to the destination.
+type partialMessageError struct {
+	written int64
+	err     error
+}
+
+func (e *partialMessageError) Error() string {
+	return fmt.Sprintf("websocket: message partially forwarded (%d bytes): %v", e.written, e.err)
+}
+
+func (e *partialMessageError) Unwrap() error {
+	return e.err
+}
+
+// transformError an error of the transform of a message.
+type transformError struct {
+	dir Direction
+	err error
+}
+
+func (e *transformError) Error() string {
+	return fmt.Sprintf("websocket: message transform failed (%s): %v", e.dir, e.err)
+}
+
+func (e *transformError) Unwrap() error {
+	return e.err
+}
+
+// messageTypeError an error of a client message of a type not in AllowedMessageTypes.
+type messageTypeError struct {
+	messageType int
+}
+
+func (e *messageTypeError) Error() string {
+	return fmt.Sprintf("websocket: message type %d not allowed", e.messageType)
+}
+
+// isTimeout reports whether the error is a timeout of a read or a write.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,551 @@
+package websocketproxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func computeAcceptKey(challengeKey string) string {
+	h := sha1.New()
+	_, _ = h.Write([]byte(challengeKey + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// newRawBackend returns the URL of a backend answering the handshake with the response built by respond.
+func newRawBackend(t *testing.T, respond func(req *http.Request) string) (*url.URL, func()) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() { _ = conn.Close() }()
+
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte(respond(req)))
+			}()
+		}
+	}()
+
+	uri, err := url.Parse("http://" + listener.Addr().String())
+	require.NoError(t, err)
+
+	return uri, func() { _ = listener.Close() }
+}
+
+func TestMalformedBackendHandshake(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		respond        func(req *http.Request) string
+		expectedReason string
+	}{
+		{
+			desc: "bad Sec-WebSocket-Accept",
+			respond: func(req *http.Request) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: invalid\r\n\r\n"
+			},
+			expectedReason: "invalid Sec-WebSocket-Accept header",
+		},
+		{
+			desc: "missing Sec-WebSocket-Accept",
+			respond: func(req *http.Request) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+			},
+			expectedReason: "missing Sec-WebSocket-Accept header",
+		},
+		{
+			desc: "bad Upgrade",
+			respond: func(req *http.Request) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: h2c\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+					computeAcceptKey(req.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"
+			},
+			expectedReason: "invalid Upgrade header",
+		},
+		{
+			desc: "bad Connection",
+			respond: func(req *http.Request) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: keep-alive\r\nSec-WebSocket-Accept: " +
+					computeAcceptKey(req.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"
+			},
+			expectedReason: "invalid Connection header",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			uri, closeBackend := newRawBackend(t, test.respond)
+			defer closeBackend()
+
+			errs := make(chan error, 1)
+			p := NewSingleHostReverseProxy(uri)
+			p.Logger = &printfRecorder{}
+			p.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+				errs <- err
+				rw.WriteHeader(http.StatusBadGateway)
+			}
+			proxy := httptest.NewServer(p)
+			defer proxy.Close()
+
+			_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.Error(t, err)
+			require.NotNil(t, resp)
+			assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+			var handshakeErr *HandshakeError
+			require.True(t, errors.As(<-errs, &handshakeErr))
+			assert.Equal(t, test.expectedReason, handshakeErr.Reason)
+		})
+	}
+}
+
+func TestStrictExtensions(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		compression    bool
+		extensions     string
+		expectedReason string
+	}{
+		{
+			desc: "no extension",
+		},
+		{
+			desc:        "offered extension",
+			compression: true,
+			extensions:  "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		},
+		{
+			desc:           "unrequested extension",
+			compression:    true,
+			extensions:     "permessage-deflate; server_no_context_takeover; client_no_context_takeover, x-custom",
+			expectedReason: `unrequested extension "x-custom"`,
+		},
+		{
+			desc:           "extension without offer",
+			extensions:     "x-custom",
+			expectedReason: `unrequested extension "x-custom"`,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			uri, closeBackend := newRawBackend(t, func(req *http.Request) string {
+				resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+					computeAcceptKey(req.Header.Get("Sec-WebSocket-Key")) + "\r\n"
+				if test.extensions != "" {
+					resp += "Sec-WebSocket-Extensions: " + test.extensions + "\r\n"
+				}
+				return resp + "\r\n"
+			})
+			defer closeBackend()
+
+			errs := make(chan error, 1)
+			p := NewSingleHostReverseProxy(uri)
+			p.Logger = &printfRecorder{}
+			p.StrictExtensions = true
+			p.EnableCompression = test.compression
+			p.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+				errs <- err
+				rw.WriteHeader(http.StatusBadGateway)
+			}
+			proxy := httptest.NewServer(p)
+			defer proxy.Close()
+
+			dialer := gorillawebsocket.Dialer{EnableCompression: test.compression}
+			conn, resp, err := dialer.Dial(wsURL(proxy, "/ws"), nil)
+			if test.expectedReason == "" {
+				require.NoError(t, err)
+				_ = conn.Close()
+				return
+			}
+
+			require.Error(t, err)
+			require.NotNil(t, resp)
+			assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+			var handshakeErr *HandshakeError
+			require.True(t, errors.As(<-errs, &handshakeErr))
+			assert.Equal(t, test.expectedReason, handshakeErr.Reason)
+		})
+	}
+}
+
+func TestOnDialErrorCategories(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL, err := url.Parse(closed.URL)
+	require.NoError(t, err)
+	closed.Close()
+
+	tlsBackend := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsBackend.Close()
+	tlsURL, err := url.Parse(tlsBackend.URL)
+	require.NoError(t, err)
+
+	rejecting := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer rejecting.Close()
+	rejectingURL, err := url.Parse(rejecting.URL)
+	require.NoError(t, err)
+
+	// accepts the connection but never answers the handshake.
+	silent := newLocalListener(t)
+	defer func() { _ = silent.Close() }()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+	silentURL, err := url.Parse("http://" + silent.Addr().String())
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc     string
+		target   *url.URL
+		dialer   Dialer
+		expected DialErrorCategory
+	}{
+		{
+			desc:     "DNS",
+			target:   &url.URL{Scheme: "http", Host: "backend.invalid"},
+			expected: DialErrorDNS,
+		},
+		{
+			desc:     "connection refused",
+			target:   closedURL,
+			expected: DialErrorConnectionRefused,
+		},
+		{
+			desc:     "TLS",
+			target:   tlsURL,
+			expected: DialErrorTLS,
+		},
+		{
+			desc:     "timeout",
+			target:   silentURL,
+			dialer:   &gorillawebsocket.Dialer{HandshakeTimeout: 50 * time.Millisecond},
+			expected: DialErrorTimeout,
+		},
+		{
+			desc:     "handshake",
+			target:   rejectingURL,
+			expected: DialErrorHandshake,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			categories := make(chan DialErrorCategory, 1)
+
+			p := NewSingleHostReverseProxy(test.target)
+			p.Logger = &printfRecorder{}
+			p.Dialer = test.dialer
+			p.OnDialError = func(req *http.Request, category DialErrorCategory, err error) {
+				assert.Error(t, err)
+				categories <- category
+			}
+			proxy := httptest.NewServer(p)
+			defer proxy.Close()
+
+			_, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.Error(t, err)
+
+			select {
+			case category := <-categories:
+				assert.Equal(t, test.expected, category, category.String())
+			case <-time.After(5 * time.Second):
+				require.FailNow(t, "OnDialError not called")
+			}
+		})
+	}
+}
+
+func TestProxyErrorKinds(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL, err := url.Parse(closed.URL)
+	require.NoError(t, err)
+	closed.Close()
+
+	malformedURL, closeMalformed := newRawBackend(t, func(req *http.Request) string {
+		return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+	})
+	defer closeMalformed()
+
+	rejecting := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer rejecting.Close()
+	rejectingURL, err := url.Parse(rejecting.URL)
+	require.NoError(t, err)
+
+	backend := newEchoBackend(t)
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc           string
+		target         *url.URL
+		method         string
+		expectedKind   error
+		expectedStatus int
+		check          func(t *testing.T, err error)
+	}{
+		{
+			desc:           "dial failed",
+			target:         closedURL,
+			expectedKind:   ErrDialFailed,
+			expectedStatus: http.StatusBadGateway,
+			check: func(t *testing.T, err error) {
+				t.Helper()
+				assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+			},
+		},
+		{
+			desc:           "malformed handshake",
+			target:         malformedURL,
+			expectedKind:   ErrHandshakeRejected,
+			expectedStatus: http.StatusBadGateway,
+			check: func(t *testing.T, err error) {
+				t.Helper()
+				var handshakeErr *HandshakeError
+				assert.ErrorAs(t, err, &handshakeErr)
+			},
+		},
+		{
+			desc:           "rejected handshake",
+			target:         rejectingURL,
+			expectedKind:   ErrHandshakeRejected,
+			expectedStatus: http.StatusBadGateway,
+			check: func(t *testing.T, err error) {
+				t.Helper()
+				assert.ErrorIs(t, err, gorillawebsocket.ErrBadHandshake)
+			},
+		},
+		{
+			desc:           "upgrade failed",
+			target:         backendURL,
+			method:         http.MethodPost,
+			expectedKind:   ErrUpgradeFailed,
+			expectedStatus: http.StatusMethodNotAllowed,
+			check: func(t *testing.T, err error) {
+				t.Helper()
+				var handshakeErr gorillawebsocket.HandshakeError
+				assert.ErrorAs(t, err, &handshakeErr)
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			errs := make(chan error, 1)
+			p := NewSingleHostReverseProxy(test.target)
+			p.Logger = &printfRecorder{}
+			p.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+				errs <- err
+				p.defaultErrorHandler(rw, req, err)
+			}
+
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			// the recorder can not be hijacked: the rejected handshakes go through the error handler.
+			req := httptest.NewRequest(method, "http://proxy/ws", nil)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+			rw := httptest.NewRecorder()
+			p.ServeHTTP(rw, req)
+			assert.Equal(t, test.expectedStatus, rw.Code)
+
+			err := <-errs
+			assert.ErrorIs(t, err, test.expectedKind)
+			for _, kind := range []error{ErrDialFailed, ErrHandshakeRejected, ErrUpgradeFailed} {
+				if kind != test.expectedKind {
+					assert.NotErrorIs(t, err, kind)
+				}
+			}
+
+			var proxyErr *ProxyError
+			require.ErrorAs(t, err, &proxyErr)
+			assert.NotNil(t, errors.Unwrap(proxyErr))
+			test.check(t, err)
+		})
+	}
+}
+
+func TestDialErrorCategoryString(t *testing.T) {
+	assert.Equal(t, "dns", DialErrorDNS.String())
+	assert.Equal(t, "connection_refused", DialErrorConnectionRefused.String())
+	assert.Equal(t, "tls", DialErrorTLS.String())
+	assert.Equal(t, "timeout", DialErrorTimeout.String())
+	assert.Equal(t, "handshake", DialErrorHandshake.String())
+	assert.Equal(t, "other", DialErrorOther.String())
+}
+
+func TestRelayHandshakeStatus(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		status int
+		header string
+	}{
+		{
+			desc:   "unauthorized",
+			status: http.StatusUnauthorized,
+			header: "Www-Authenticate",
+		},
+		{
+			desc:   "forbidden",
+			status: http.StatusForbidden,
+			header: "X-Reason",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set(test.header, "upstream")
+				rw.Header().Set("Keep-Alive", "timeout=5")
+				rw.WriteHeader(test.status)
+				_, _ = rw.Write([]byte("rejected by the backend"))
+			}))
+			defer backend.Close()
+
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.RelayHandshakeStatus = true
+			})
+			defer proxy.Close()
+
+			_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.Error(t, err)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, test.status, resp.StatusCode)
+			assert.Equal(t, "upstream", resp.Header.Get(test.header))
+			assert.Empty(t, resp.Header.Get("Keep-Alive"))
+
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "rejected by the backend", string(body))
+		})
+	}
+}
+
+func TestRejectionHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="backend"`)
+		rw.Header().Set("Retry-After", "120")
+		rw.WriteHeader(http.StatusUnauthorized)
+		_, _ = rw.Write([]byte("rejected by the backend"))
+	}))
+	defer backend.Close()
+
+	errs := make(chan error, 1)
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.RejectionHandler = func(rw http.ResponseWriter, req *http.Request, resp *http.Response, err error) {
+			errs <- err
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			rw.Header().Set("WWW-Authenticate", resp.Header.Get("WWW-Authenticate"))
+			rw.Header().Set("X-Upstream-Status", strconv.Itoa(resp.StatusCode))
+			rw.WriteHeader(http.StatusForbidden)
+			_, _ = rw.Write([]byte("custom: " + string(body)))
+		}
+	})
+	defer proxy.Close()
+
+	_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, `Bearer realm="backend"`, resp.Header.Get("WWW-Authenticate"))
+	assert.Equal(t, "401", resp.Header.Get("X-Upstream-Status"))
+	assert.Empty(t, resp.Header.Get("Retry-After"))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "custom: rejected by the backend", string(body))
+
+	assert.True(t, errors.Is(<-errs, ErrHandshakeRejected))
+}
+
+func TestPreserveTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum, X-Debug")
+		rw.WriteHeader(http.StatusForbidden)
+		_, _ = rw.Write([]byte("rejected by the backend"))
+		rw.Header().Set("X-Checksum", "abc")
+		rw.Header().Set("X-Debug", "debug")
+	}))
+	defer backend.Close()
+
+	for _, preserve := range []bool{false, true} {
+		preserve := preserve
+		t.Run(fmt.Sprintf("preserve %t", preserve), func(t *testing.T) {
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.RelayHandshakeStatus = true
+				p.PreserveTrailers = preserve
+				p.ResponseHeaderBlocklist = []string{"X-Debug"}
+			})
+			defer proxy.Close()
+
+			_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.Error(t, err)
+			require.NotNil(t, resp)
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "rejected by the backend", string(body))
+
+			if preserve {
+				assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+			} else {
+				assert.Empty(t, resp.Trailer.Get("X-Checksum"))
+			}
+			assert.Empty(t, resp.Trailer.Get("X-Debug"))
+		})
+	}
+}
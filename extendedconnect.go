@@ -0,0 +1,187 @@
+package websocketproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pseudoProtocol is the pseudo-header of the protocol of an HTTP/2 extended CONNECT,
+// which the HTTP/2 server sets in the request headers.
+const pseudoProtocol = ":protocol"
+
+// isExtendedConnect reports whether the request bootstraps a websocket over an HTTP/2 stream, with an extended CONNECT.
+// See RFC 8441.
+// The HTTP/2 server of net/http only accepts the extended CONNECT with GODEBUG=http2xconnect=1.
+func isExtendedConnect(req *http.Request) bool {
+	if req.ProtoMajor != 2 || req.Method != http.MethodConnect {
+		return false
+	}
+
+	protocol := req.Header[pseudoProtocol]
+	return len(protocol) == 1 && strings.EqualFold(protocol[0], "websocket")
+}
+
+// isWebsocketRequest reports whether the request opens a websocket,
+// with an HTTP/1.1 upgrade or with an HTTP/2 extended CONNECT.
+func isWebsocketRequest(req *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(req) || isExtendedConnect(req)
+}
+
+// upgrade upgrades the client connection, or the HTTP/2 stream of an extended CONNECT.
+// The bytes of the upgraded connection are counted by wire, if set.
+func upgrade(upgrader *websocket.Upgrader, rw http.ResponseWriter, req *http.Request, responseHeader http.Header, wire *wireCounter) (*websocket.Conn, error) {
+	if !isExtendedConnect(req) {
+		if wire != nil {
+			rw = &wireResponseWriter{ResponseWriter: rw, counter: wire}
+		}
+		return upgrader.Upgrade(rw, req, responseHeader)
+	}
+
+	// the upgrader only knows the HTTP/1.1 upgrades:
+	// it gets the equivalent upgrade request, and a connection over the stream,
+	// on which its handshake response is answered with a 200 response.
+	upgradeReq := req.Clone(req.Context())
+	upgradeReq.Method = http.MethodGet
+	delete(upgradeReq.Header, pseudoProtocol)
+	upgradeReq.Header.Set(Upgrade, "websocket")
+	upgradeReq.Header.Set(Connection, "Upgrade")
+	upgradeReq.Header.Set(SecWebsocketKey, newWebsocketKey())
+
+	var stream http.ResponseWriter = &streamResponseWriter{ResponseWriter: rw, req: req}
+	if wire != nil {
+		stream = &wireResponseWriter{ResponseWriter: stream, counter: wire}
+	}
+	return upgrader.Upgrade(stream, upgradeReq, responseHeader)
+}
+
+// newWebsocketKey generates a Sec-WebSocket-Key.
+func newWebsocketKey() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+// streamResponseWriter is the response writer of an extended CONNECT, hijacked as a streamConn.
+type streamResponseWriter struct {
+	http.ResponseWriter
+	req *http.Request
+}
+
+func (w *streamResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn := newStreamConn(w.ResponseWriter, w.req)
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+// streamConn is a net.Conn over an HTTP/2 stream: it reads the request body, and writes the response.
+// Its first write is the HTTP/1.1 handshake response of the upgrader,
+// answered on the stream with a 200 response and the same headers but the upgrade ones.
+type streamConn struct {
+	rw            http.ResponseWriter
+	rc            *http.ResponseController
+	body          io.ReadCloser
+	local, remote net.Addr
+
+	// answered is only accessed by the writes, which the websocket connection serializes.
+	answered  bool
+	closeOnce sync.Once
+}
+
+func newStreamConn(rw http.ResponseWriter, req *http.Request) *streamConn {
+	local, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if local == nil {
+		local = streamAddr("")
+	}
+
+	return &streamConn{
+		rw:     rw,
+		rc:     http.NewResponseController(rw),
+		body:   req.Body,
+		local:  local,
+		remote: streamAddr(req.RemoteAddr),
+	}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	if !c.answered {
+		c.answered = true
+		return c.answer(p)
+	}
+
+	n, err := c.rw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+// answer answers the stream with the headers of the handshake response of the upgrader.
+func (c *streamConn) answer(p []byte) (int, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(p)), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	header := c.rw.Header()
+	for k, vv := range resp.Header {
+		switch k {
+		case Upgrade, Connection, SecWebsocketAccept:
+			continue
+		}
+		header[k] = vv
+	}
+
+	c.rw.WriteHeader(http.StatusOK)
+	return len(p), c.rc.Flush()
+}
+
+// Close closes the request body, the stream ends when the handler returns.
+func (c *streamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.body.Close()
+	})
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
+
+// streamAddr is the address of a peer of an HTTP/2 stream.
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+func (a streamAddr) String() string  { return string(a) }
@@ -0,0 +1,251 @@
+package websocketproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2/hpack"
+)
+
+// writeClientFrame writes a masked frame, with a payload shorter than 126 bytes.
+func writeClientFrame(t *testing.T, w io.Writer, opcode int, payload []byte) {
+	t.Helper()
+
+	key := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | byte(opcode), 0x80 | byte(len(payload))}
+	frame = append(frame, key[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^key[i%4])
+	}
+
+	_, err := w.Write(frame)
+	require.NoError(t, err)
+}
+
+// readServerFrame reads an unmasked frame, with a payload shorter than 126 bytes.
+func readServerFrame(t *testing.T, r *bufio.Reader) (int, []byte) {
+	t.Helper()
+
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	require.NoError(t, err)
+	require.Less(t, int(header[1]), 126)
+
+	payload := make([]byte, header[1])
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+
+	return int(header[0] & 0x0f), payload
+}
+
+// HTTP/2 frame types and flags.
+const (
+	h2FrameData     = 0x0
+	h2FrameHeaders  = 0x1
+	h2FrameSettings = 0x4
+	h2FrameGoAway   = 0x7
+	h2FrameReset    = 0x3
+
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+)
+
+// h2Stream is a websocket stream opened with an extended CONNECT by a minimal HTTP/2 client,
+// as the HTTP/2 client of net/http rejects the :protocol pseudo-header.
+type h2Stream struct {
+	conn net.Conn
+	mu   sync.Mutex
+
+	data    *io.PipeReader
+	headers chan http.Header
+}
+
+// dialExtendedConnect opens a websocket stream on the server, and returns it with the response headers.
+func dialExtendedConnect(t *testing.T, server *httptest.Server, path string) (*h2Stream, http.Header) {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{RootCAs: pool, NextProtos: []string{"h2"}})
+	require.NoError(t, err)
+
+	data, dataWriter := io.Pipe()
+	s := &h2Stream{conn: conn, data: data, headers: make(chan http.Header, 1)}
+	go s.readFrames(dataWriter)
+
+	_, err = conn.Write([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, s.writeFrame(h2FrameSettings, 0, 0, nil))
+
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	for _, f := range []hpack.HeaderField{
+		{Name: ":method", Value: http.MethodConnect},
+		{Name: ":protocol", Value: "websocket"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: server.Listener.Addr().String()},
+		{Name: "sec-websocket-version", Value: "13"},
+	} {
+		require.NoError(t, encoder.WriteField(f))
+	}
+	require.NoError(t, s.writeFrame(h2FrameHeaders, h2FlagEndHeaders, 1, block.Bytes()))
+
+	select {
+	case header := <-s.headers:
+		return s, header
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no response headers")
+		return nil, nil
+	}
+}
+
+func (s *h2Stream) writeFrame(frameType, flags byte, streamID uint32, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	header := make([]byte, 9)
+	header[0], header[1], header[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	header[3] = frameType
+	header[4] = flags
+	binary.BigEndian.PutUint32(header[5:], streamID)
+
+	_, err := s.conn.Write(append(header, payload...))
+	return err
+}
+
+// readFrames reads the frames of the connection, writing the data of the stream to w.
+func (s *h2Stream) readFrames(w *io.PipeWriter) {
+	decoder := hpack.NewDecoder(4096, nil)
+	header := make([]byte, 9)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			_ = w.CloseWithError(err)
+			return
+		}
+
+		payload := make([]byte, int(header[0])<<16|int(header[1])<<8|int(header[2]))
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			_ = w.CloseWithError(err)
+			return
+		}
+
+		switch header[3] {
+		case h2FrameSettings:
+			if header[4]&h2FlagAck == 0 {
+				_ = s.writeFrame(h2FrameSettings, h2FlagAck, 0, nil)
+			}
+		case h2FrameHeaders:
+			fields, err := decoder.DecodeFull(payload)
+			if err != nil {
+				_ = w.CloseWithError(err)
+				return
+			}
+			h := make(http.Header)
+			for _, f := range fields {
+				h[http.CanonicalHeaderKey(f.Name)] = append(h[http.CanonicalHeaderKey(f.Name)], f.Value)
+			}
+			s.headers <- h
+		case h2FrameData:
+			if _, err := w.Write(payload); err != nil {
+				return
+			}
+		case h2FrameReset, h2FrameGoAway:
+			_ = w.CloseWithError(fmt.Errorf("stream closed: frame type %d", header[3]))
+			return
+		}
+	}
+}
+
+func (s *h2Stream) Read(p []byte) (int, error) {
+	return s.data.Read(p)
+}
+
+func (s *h2Stream) Write(p []byte) (int, error) {
+	if err := s.writeFrame(h2FrameData, 0, 1, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *h2Stream) Close() error {
+	return s.conn.Close()
+}
+
+func TestExtendedConnect(t *testing.T) {
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		// the HTTP/2 server reads the setting enabling the extended CONNECT at startup.
+		cmd := exec.Command(os.Args[0], "-test.run=^TestExtendedConnect$", "-test.v")
+		cmd.Env = append(os.Environ(), "GODEBUG="+os.Getenv("GODEBUG")+",http2xconnect=1")
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "%s", out)
+		return
+	}
+
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	uri, err := url.ParseRequestURI(backend.URL)
+	require.NoError(t, err)
+
+	p := NewSingleHostReverseProxy(uri)
+	p.Logger = &printfRecorder{}
+	proxy := httptest.NewUnstartedServer(p)
+	proxy.EnableHTTP2 = true
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	stream, header := dialExtendedConnect(t, proxy, "/ws")
+	defer func() { _ = stream.Close() }()
+
+	require.Equal(t, "200", header.Get(":status"))
+	assert.Empty(t, header.Get(SecWebsocketAccept))
+
+	reader := bufio.NewReader(stream)
+
+	writeClientFrame(t, stream, gorillawebsocket.TextMessage, []byte("hello"))
+	opcode, payload := readServerFrame(t, reader)
+	assert.Equal(t, gorillawebsocket.TextMessage, opcode)
+	assert.Equal(t, "hello", string(payload))
+
+	writeClientFrame(t, stream, gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, ""))
+	opcode, payload = readServerFrame(t, reader)
+	assert.Equal(t, gorillawebsocket.CloseMessage, opcode)
+	require.Len(t, payload, 2)
+	assert.Equal(t, gorillawebsocket.CloseNormalClosure, int(binary.BigEndian.Uint16(payload)))
+}
+
+func TestExtendedConnectDetection(t *testing.T) {
+	req := httptest.NewRequest(http.MethodConnect, "/ws", nil)
+	req.ProtoMajor = 2
+	req.Header[pseudoProtocol] = []string{"websocket"}
+	assert.True(t, isExtendedConnect(req))
+	assert.True(t, isWebsocketRequest(req))
+	assert.NoError(t, checkClientHandshake(req))
+
+	req.Header[pseudoProtocol] = []string{"webtransport"}
+	assert.False(t, isExtendedConnect(req))
+
+	req = httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header[pseudoProtocol] = []string{"websocket"}
+	assert.False(t, isExtendedConnect(req))
+}
@@ -0,0 +1,110 @@
+package websocketproxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrRequestHeaderTooLarge is reported when a request is refused because its headers exceed MaxHeaderBytes.
+var ErrRequestHeaderTooLarge = errors.New("websocket: request headers too large")
+
+// ErrSubprotocolNotAllowed is reported when a request is refused because it offers none of the AllowedSubprotocols.
+var ErrSubprotocolNotAllowed = errors.New("websocket: no allowed subprotocol offered")
+
+var (
+	errMissingWebsocketKey = errors.New("websocket: missing Sec-WebSocket-Key header")
+	errInvalidWebsocketKey = errors.New("websocket: invalid Sec-WebSocket-Key header, it must be a base64-encoded 16-byte value")
+)
+
+// checkClientHandshake checks the websocket headers of the client handshake.
+// An extended CONNECT has no Sec-WebSocket-Key, see RFC 8441, section 5.
+func checkClientHandshake(req *http.Request) error {
+	if isExtendedConnect(req) {
+		return nil
+	}
+	return checkWebsocketKey(req)
+}
+
+// checkWebsocketKey checks the Sec-WebSocket-Key header of the client handshake.
+// See RFC 6455, section 4.1.
+func checkWebsocketKey(req *http.Request) error {
+	key := req.Header.Get(SecWebsocketKey)
+	if key == "" {
+		return errMissingWebsocketKey
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 16 {
+		return errInvalidWebsocketKey
+	}
+	return nil
+}
+
+// checkHeaderSize checks the size of the request headers, the sum of the lengths of their names and values, against the limit.
+// A limit of zero disables the check.
+func checkHeaderSize(req *http.Request, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	size := 0
+	for name, values := range req.Header {
+		for _, value := range values {
+			size += len(name) + len(value)
+		}
+	}
+
+	if size > limit {
+		return &StatusError{Status: http.StatusRequestHeaderFieldsTooLarge, Err: ErrRequestHeaderTooLarge}
+	}
+	return nil
+}
+
+// checkSubprotocols checks that a client offering subprotocols offers at least one of the allowed ones.
+// An empty allowed list disables the check.
+func checkSubprotocols(req *http.Request, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	offered := websocket.Subprotocols(req)
+	if len(offered) > 0 && len(filterSubprotocols(offered, allowed)) == 0 {
+		return &StatusError{Status: http.StatusBadRequest, Err: ErrSubprotocolNotAllowed}
+	}
+	return nil
+}
+
+// filterSubprotocols returns the offered subprotocols which are allowed, in the order of the offer.
+func filterSubprotocols(offered, allowed []string) []string {
+	var kept []string
+	for _, protocol := range offered {
+		for _, a := range allowed {
+			if protocol == a {
+				kept = append(kept, protocol)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// checkBackendExtensions checks that the extensions selected by the backend were offered by the proxy.
+// The offer is the one of the handshake request sent by the dialer, if the response holds it,
+// else the headers of the backend request.
+func checkBackendExtensions(resp *http.Response, outReq *http.Request) error {
+	offered := outReq.Header
+	if resp.Request != nil {
+		offered = resp.Request.Header
+	}
+
+	for _, ext := range extensionNames(resp.Header) {
+		if !hasExtension(offered, ext) {
+			return &HandshakeError{Reason: fmt.Sprintf("unrequested extension %q", ext)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package websocketproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvalidWebsocketKey(t *testing.T) {
+	var dialed bool
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		dialed = true
+	}))
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, nil)
+	defer proxy.Close()
+
+	testCases := []struct {
+		desc     string
+		key      string
+		expected string
+	}{
+		{
+			desc:     "missing",
+			expected: errMissingWebsocketKey.Error(),
+		},
+		{
+			desc:     "not base64",
+			key:      "not a key!",
+			expected: errInvalidWebsocketKey.Error(),
+		},
+		{
+			desc:     "wrong length",
+			key:      "c2hvcnQ=",
+			expected: errInvalidWebsocketKey.Error(),
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, proxy.URL+"/ws", nil)
+			require.NoError(t, err)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			if test.key != "" {
+				req.Header.Set("Sec-WebSocket-Key", test.key)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			assert.Contains(t, string(body), test.expected)
+			assert.False(t, dialed)
+		})
+	}
+}
+
+func TestCheckWebsocketKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	assert.NoError(t, checkWebsocketKey(req))
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	var dialed int32
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&dialed, 1)
+		conn, err := (&gorillawebsocket.Upgrader{}).Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.MaxHeaderBytes = 1024
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	_ = conn.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dialed))
+
+	header := http.Header{"X-Padding": []string{strings.Repeat("a", 1024)}}
+	_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), header)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dialed))
+}
+
+func TestAllowedSubprotocols(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{Subprotocols: []string{"chat", "superchat", "evil"}}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := http.Header{"X-Received-Protocols": {req.Header.Get(SecWebsocketProtocol)}}
+		conn, err := upgrader.Upgrade(rw, req, header)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		desc             string
+		offered          []string
+		expectedStatus   int
+		expectedOffer    string
+		expectedSelected string
+	}{
+		{
+			desc:             "permitted offer",
+			offered:          []string{"chat", "superchat"},
+			expectedStatus:   http.StatusSwitchingProtocols,
+			expectedOffer:    "chat, superchat",
+			expectedSelected: "chat",
+		},
+		{
+			desc:             "partially permitted offer",
+			offered:          []string{"evil", "superchat"},
+			expectedStatus:   http.StatusSwitchingProtocols,
+			expectedOffer:    "superchat",
+			expectedSelected: "superchat",
+		},
+		{
+			desc:           "no offer",
+			expectedStatus: http.StatusSwitchingProtocols,
+		},
+		{
+			desc:           "empty intersection",
+			offered:        []string{"evil"},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.AllowedSubprotocols = []string{"chat", "superchat"}
+			})
+			defer proxy.Close()
+
+			dialer := gorillawebsocket.Dialer{Subprotocols: test.offered}
+			conn, resp, err := dialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NotNil(t, resp)
+			assert.Equal(t, test.expectedStatus, resp.StatusCode)
+			if test.expectedStatus != http.StatusSwitchingProtocols {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			assert.Equal(t, test.expectedOffer, resp.Header.Get("X-Received-Protocols"))
+			assert.Equal(t, test.expectedSelected, conn.Subprotocol())
+		})
+	}
+}
+
+func TestCheckHeaderSize(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	// 12 bytes in total, each value counting with its name.
+	req.Header.Set("Foo", "ab")
+	req.Header.Add("Foo", "c")
+	req.Header.Set("Ba", "r")
+
+	assert.NoError(t, checkHeaderSize(req, 0))
+	assert.NoError(t, checkHeaderSize(req, 13))
+	assert.NoError(t, checkHeaderSize(req, 12))
+
+	err := checkHeaderSize(req, 11)
+	assert.ErrorIs(t, err, ErrRequestHeaderTooLarge)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, errorStatus(err))
+}
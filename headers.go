@@ -1,6 +1,11 @@
 package websocketproxy
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
 	"net/http"
 	"strings"
 )
@@ -27,6 +32,8 @@ const (
 	SecWebsocketVersion    = "Sec-Websocket-Version"
 	SecWebsocketExtensions = "Sec-Websocket-Extensions"
 	SecWebsocketAccept     = "Sec-Websocket-Accept"
+	SecWebsocketProtocol   = "Sec-Websocket-Protocol"
+	Via                    = "Via"
 )
 
 // Hop-by-hop headers.
@@ -64,22 +71,87 @@ func copyHeader(dst, src http.Header) {
 }
 
 // removeConnectionHeaders removes hop-by-hop headers listed in the "Connection" header of h.
+// stripped, if not nil, is called with each removed value.
 // See RFC 7230, section 6.1
-func removeConnectionHeaders(header http.Header) {
+func removeConnectionHeaders(header http.Header, stripped func(name, value string)) {
 	if c := header.Get("Connection"); c != "" {
 		for _, f := range strings.Split(c, ",") {
 			if f = strings.TrimSpace(f); f != "" {
-				header.Del(f)
+				delHeader(header, f, stripped)
 			}
 		}
 	}
 }
 
-func removeHeaders(header http.Header, headers []string) {
+// removeHeaders removes the headers of h listed in headers.
+// stripped, if not nil, is called with each removed value.
+func removeHeaders(header http.Header, headers []string, stripped func(name, value string)) {
 	for _, h := range headers {
 		hv := header.Get(h)
 		if hv != "" {
-			header.Del(h)
+			delHeader(header, h, stripped)
 		}
 	}
 }
+
+// delHeader removes the header, calling stripped, if not nil, with each of its values.
+func delHeader(header http.Header, name string, stripped func(name, value string)) {
+	if stripped != nil {
+		for _, v := range header.Values(name) {
+			stripped(http.CanonicalHeaderKey(name), v)
+		}
+	}
+	header.Del(name)
+}
+
+// filterHeaders removes the headers of h not listed in allow, unless allow is nil, and the headers listed in block.
+// Sec-WebSocket-Protocol is always allowed.
+func filterHeaders(header http.Header, allow, block []string) {
+	if allow != nil {
+		keepHeaders(header, append([]string{SecWebsocketProtocol}, allow...))
+	}
+	for _, h := range block {
+		// removed even with an empty first value, unlike removeHeaders.
+		delHeader(header, h, nil)
+	}
+}
+
+// keepHeaders removes the headers of h not listed in headers.
+func keepHeaders(header http.Header, headers []string) {
+	keep := make(map[string]bool, len(headers))
+	for _, h := range headers {
+		keep[http.CanonicalHeaderKey(h)] = true
+	}
+
+	for h := range header {
+		if !keep[http.CanonicalHeaderKey(h)] {
+			delete(header, h)
+		}
+	}
+}
+
+// clientIP returns the IP of the client, from the remote address of the request.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// hashClientIP returns the hex-encoded HMAC-SHA256 of the IP.
+func hashClientIP(ip string, salt []byte) string {
+	mac := hmac.New(sha256.New, salt)
+	_, _ = mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// appendVia appends the proxy to the Via header, with the protocol version of the received message.
+// See RFC 7230, section 5.7.1.
+func appendVia(header http.Header, protoMajor, protoMinor int, pseudonym string) {
+	via := fmt.Sprintf("%d.%d %s", protoMajor, protoMinor, pseudonym)
+	if values := header.Values(Via); len(values) > 0 {
+		via = strings.Join(values, ", ") + ", " + via
+	}
+	header.Set(Via, via)
+}
@@ -0,0 +1,3 @@
+// Package tracingtest tests the tracing of the proxy with the OpenTelemetry SDK,
+// in a separate module so that the SDK is not a requirement of the websocketproxy module.
+package tracingtest
@@ -0,0 +1,130 @@
+package tracingtest
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/juliens/websocketproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newHeadersBackend returns a backend that reports the headers of the handshake requests,
+// and drops the connections after the handshake.
+func newHeadersBackend(t *testing.T) (*httptest.Server, <-chan http.Header) {
+	t.Helper()
+
+	headers := make(chan http.Header, 10)
+	upgrader := gorillawebsocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		headers <- req.Header
+
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+
+	return backend, headers
+}
+
+// newTracedProxy returns a proxy to the backend, tracing the connections with the provider.
+func newTracedProxy(t *testing.T, backend *httptest.Server, provider trace.TracerProvider) *httptest.Server {
+	t.Helper()
+
+	uri, err := url.ParseRequestURI(backend.URL)
+	require.NoError(t, err)
+
+	p := websocketproxy.NewSingleHostReverseProxy(uri)
+	p.Logger = log.New(io.Discard, "", 0)
+	p.TracerProvider = provider
+	return httptest.NewServer(p)
+}
+
+func wsURL(srv *httptest.Server, path string) string {
+	return "ws://" + srv.Listener.Addr().String() + path
+}
+
+func TestTracing(t *testing.T) {
+	backend, headers := newHeadersBackend(t)
+	defer backend.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	proxy := newTracedProxy(t, backend, sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer proxy.Close()
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	header := http.Header{}
+	header.Set("Traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), header)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// the backend drops the connection after the handshake.
+	received := <-headers
+
+	span := waitForSpan(t, exporter)
+
+	assert.Equal(t, "websocket.proxy", span.Name)
+	assert.Equal(t, trace.SpanKindServer, span.SpanKind)
+	assert.Equal(t, traceID, span.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", span.Parent.SpanID().String())
+
+	var events []string
+	for _, event := range span.Events {
+		events = append(events, event.Name)
+	}
+	assert.Equal(t, []string{"dial", "upgrade"}, events)
+
+	assert.Contains(t, span.Attributes, attribute.Int("websocket.close_code", gorillawebsocket.CloseAbnormalClosure))
+	assert.Contains(t, span.Attributes, attribute.String("websocket.close_initiator", string(websocketproxy.PeerBackend)))
+	assert.Equal(t, codes.Error, span.Status.Code)
+
+	// the backend continues the trace.
+	assert.Equal(t, "00-"+traceID+"-"+span.SpanContext.SpanID().String()+"-01", received.Get("Traceparent"))
+}
+
+func TestTracingDialError(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+
+	backend, _ := newHeadersBackend(t)
+	proxy := newTracedProxy(t, backend, sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer proxy.Close()
+	backend.Close()
+
+	_, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.Error(t, err)
+
+	span := waitForSpan(t, exporter)
+	assert.Equal(t, codes.Error, span.Status.Code)
+}
+
+// waitForSpan waits for the span of a connection to end, once the proxy handler returns.
+func waitForSpan(t *testing.T, exporter *tracetest.InMemoryExporter) tracetest.SpanStub {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if spans := exporter.GetSpans(); len(spans) > 0 {
+			require.Len(t, spans, 1)
+			return spans[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.FailNow(t, "span not ended")
+	return tracetest.SpanStub{}
+}
@@ -0,0 +1,54 @@
+package websocketproxy
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// keepalivePayload is the payload of the pings of the proxy, which tells their pongs apart from the ones of the peers.
+const keepalivePayload = "websocketproxy-keepalive"
+
+// pingWriteTimeout bounds the time spent writing a ping.
+const pingWriteTimeout = time.Second
+
+// pingJitter returns the maximum delay added to each PingInterval.
+func (p *ReverseProxy) pingJitter() time.Duration {
+	if p.PingJitter == 0 {
+		return p.PingInterval / 10
+	}
+	if p.PingJitter < 0 {
+		return 0
+	}
+	return p.PingJitter
+}
+
+// nextPing returns the delay before the next ping: PingInterval, plus a random jitter.
+func (p *ReverseProxy) nextPing() time.Duration {
+	delay := p.PingInterval
+	if jitter := p.pingJitter(); jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(jitter) + 1))
+	}
+	return delay
+}
+
+// keepalive pings both peers of the connection every PingInterval, until the connection terminates.
+// The pings are control frames, which can be written concurrently with the forwarded messages.
+func (p *ReverseProxy) keepalive(c *connection) {
+	for {
+		ping, stop := p.clock().NewTimer(p.nextPing())
+
+		select {
+		case <-c.ctx.Done():
+			stop()
+			return
+		case <-ping:
+		}
+
+		// a failed ping is reported by the reader of the peer.
+		deadline := time.Now().Add(pingWriteTimeout)
+		_ = c.clientConn.WriteControl(websocket.PingMessage, []byte(keepalivePayload), deadline)
+		_ = c.backend().WriteControl(websocket.PingMessage, []byte(keepalivePayload), deadline)
+	}
+}
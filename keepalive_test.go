@@ -0,0 +1,122 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPingInterval(t *testing.T) {
+	var backendPings, backendPongs int32
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		conn.SetPingHandler(func(data string) error {
+			atomic.AddInt32(&backendPings, 1)
+			return conn.WriteControl(gorillawebsocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		conn.SetPongHandler(func(string) error {
+			atomic.AddInt32(&backendPongs, 1)
+			return nil
+		})
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	interval, jitter := 50*time.Millisecond, 30*time.Millisecond
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.PingInterval = interval
+		p.PingJitter = jitter
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	var mu sync.Mutex
+	var pings []time.Time
+	conn.SetPingHandler(func(data string) error {
+		mu.Lock()
+		pings = append(pings, time.Now())
+		mu.Unlock()
+		return conn.WriteControl(gorillawebsocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(pings)
+		mu.Unlock()
+		if n >= 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			require.FailNow(t, "pings not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// each ping is sent within the jittered window after the previous one, with some slack for the scheduling.
+	for i := 1; i < 4; i++ {
+		delay := pings[i].Sub(pings[i-1])
+		assert.GreaterOrEqual(t, int64(delay), int64(interval-10*time.Millisecond))
+		assert.LessOrEqual(t, int64(delay), int64(interval+jitter+60*time.Millisecond))
+	}
+
+	assert.NotZero(t, atomic.LoadInt32(&backendPings))
+	// the pongs of the client are not forwarded to the backend.
+	assert.Zero(t, atomic.LoadInt32(&backendPongs))
+}
+
+func TestKeepaliveStopsOnClose(t *testing.T) {
+	clientConn, _, cleanupClient := newConnPair(t)
+	defer cleanupClient()
+	backendConn, _, cleanupBackend := newConnPair(t)
+	defer cleanupBackend()
+
+	p := &ReverseProxy{PingInterval: time.Hour}
+	c := newConnection(httptest.NewRequest(http.MethodGet, "/ws", nil), "", clientConn, backendConn)
+
+	done := make(chan struct{})
+	go func() {
+		p.keepalive(c)
+		close(done)
+	}()
+
+	c.cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "keepalive not stopped")
+	}
+}
@@ -0,0 +1,133 @@
+package websocketproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/websocket"
+)
+
+// legacyHandshakeHeaders the headers kept, in order, in a legacy handshake request.
+var legacyHandshakeHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-WebSocket-Key",
+	"Sec-WebSocket-Version",
+	"Origin",
+	"Sec-WebSocket-Protocol",
+}
+
+// newLegacyDialer creates a copy of the dialer that rewrites the handshake request
+// to a minimal set of headers written in a fixed order.
+// The dialer establishes the TLS connection itself, so the rewrite happens on the plain text handshake,
+// this is why the returned URL must be used to dial.
+func newLegacyDialer(base *websocket.Dialer, target *url.URL) (*websocket.Dialer, *url.URL) {
+	d := *base
+	// the proxy CONNECT request would be rewritten too.
+	d.Proxy = nil
+
+	netDial := d.NetDialContext
+	if netDial == nil && d.NetDial != nil {
+		netDial = func(_ context.Context, network, addr string) (net.Conn, error) {
+			return d.NetDial(network, addr)
+		}
+	}
+	if netDial == nil {
+		netDial = (&net.Dialer{}).DialContext
+	}
+
+	dialURL := *target
+	secure := target.Scheme == "wss"
+	if secure {
+		dialURL.Scheme = "ws"
+		if dialURL.Port() == "" {
+			dialURL.Host = net.JoinHostPort(dialURL.Hostname(), "443")
+		}
+	}
+
+	tlsConfig := d.TLSClientConfig
+	d.NetDial = nil
+	d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := netDial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if secure {
+			cfg := &tls.Config{}
+			if tlsConfig != nil {
+				cfg = tlsConfig.Clone()
+			}
+			if cfg.ServerName == "" {
+				cfg.ServerName = target.Hostname()
+			}
+
+			tlsConn := tls.Client(conn, cfg)
+			if err = tlsConn.HandshakeContext(ctx); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+
+		return &legacyHandshakeConn{Conn: conn, host: target.Host, dialHost: dialURL.Host}, nil
+	}
+
+	return &d, &dialURL
+}
+
+// legacyHandshakeConn rewrites the handshake request written by the dialer before sending it.
+type legacyHandshakeConn struct {
+	net.Conn
+	// host replaces the Host derived from the dial URL.
+	host     string
+	dialHost string
+	buf      bytes.Buffer
+	done     bool
+}
+
+func (c *legacyHandshakeConn) Write(b []byte) (int, error) {
+	if c.done {
+		return c.Conn.Write(b)
+	}
+
+	c.buf.Write(b)
+	if !bytes.Contains(c.buf.Bytes(), []byte("\r\n\r\n")) {
+		return len(b), nil
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(&c.buf))
+	if err != nil {
+		return 0, err
+	}
+	c.done = true
+
+	host := req.Host
+	if host == c.dialHost {
+		host = c.host
+	}
+
+	if _, err = c.Conn.Write(formatLegacyHandshake(req, host)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func formatLegacyHandshake(req *http.Request, host string) []byte {
+	var b bytes.Buffer
+	_, _ = fmt.Fprintf(&b, "GET %s HTTP/1.1\r\n", req.URL.RequestURI())
+	_, _ = fmt.Fprintf(&b, "Host: %s\r\n", host)
+	for _, h := range legacyHandshakeHeaders {
+		if v := req.Header.Get(h); v != "" {
+			_, _ = fmt.Fprintf(&b, "%s: %s\r\n", h, v)
+		}
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
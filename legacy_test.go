@@ -0,0 +1,137 @@
+package websocketproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyBackend only accepts the minimal handshake header set.
+func legacyBackend() http.Handler {
+	allowed := map[string]bool{}
+	for _, h := range legacyHandshakeHeaders {
+		allowed[http.CanonicalHeaderKey(h)] = true
+	}
+
+	upgrader := gorillawebsocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for k := range req.Header {
+			if !allowed[k] {
+				http.Error(rw, "unsupported header "+k, http.StatusBadRequest)
+				return
+			}
+		}
+
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		_ = conn.WriteMessage(msgType, msg)
+	})
+}
+
+func TestLegacyBackendMode(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		legacy         bool
+		tls            bool
+		expectedStatus int
+	}{
+		{
+			desc:           "default handshake",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc:           "legacy handshake",
+			legacy:         true,
+			expectedStatus: http.StatusSwitchingProtocols,
+		},
+		{
+			desc:           "legacy handshake over TLS",
+			legacy:         true,
+			tls:            true,
+			expectedStatus: http.StatusSwitchingProtocols,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var backend *httptest.Server
+			if test.tls {
+				backend = httptest.NewTLSServer(legacyBackend())
+			} else {
+				backend = httptest.NewServer(legacyBackend())
+			}
+			defer backend.Close()
+
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.LegacyBackendMode = test.legacy
+				p.Dialer = &gorillawebsocket.Dialer{
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				}
+			})
+			defer proxy.Close()
+
+			headers := http.Header{}
+			headers.Set("Origin", "http://example.com")
+			headers.Set("X-Custom", "value")
+			headers.Set("Cookie", "session=1")
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), headers)
+			require.NotNil(t, resp)
+			assert.Equal(t, test.expectedStatus, resp.StatusCode)
+			if test.expectedStatus != http.StatusSwitchingProtocols {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			err = conn.WriteMessage(gorillawebsocket.TextMessage, []byte("OK"))
+			require.NoError(t, err)
+
+			_, msg, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, "OK", string(msg))
+		})
+	}
+}
+
+func TestFormatLegacyHandshake(t *testing.T) {
+	raw := "GET /ws?a=b HTTP/1.1\r\n" +
+		"Host: backend:80\r\n" +
+		"User-Agent: Go-http-client/1.1\r\n" +
+		"Origin: http://example.com\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"X-Custom: value\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: websocket\r\n\r\n"
+
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	require.NoError(t, err)
+
+	expected := "GET /ws?a=b HTTP/1.1\r\n" +
+		"Host: backend\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Origin: http://example.com\r\n\r\n"
+
+	assert.Equal(t, expected, string(formatLegacyHandshake(req, "backend")))
+}
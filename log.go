@@ -0,0 +1,74 @@
+package websocketproxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// LogLevel selects the events logged through the Printf logger.
+type LogLevel int
+
+// Log levels.
+const (
+	// LogInfo logs the errors, the warnings and the informational events, e.g. the stats summaries.
+	LogInfo LogLevel = iota
+	// LogSilent logs nothing.
+	LogSilent
+	// LogError logs the errors only, e.g. the dial and upgrade failures.
+	LogError
+	// LogWarn logs the errors and the warnings.
+	LogWarn
+	// LogDebug logs all the events, including the normal closes.
+	LogDebug
+)
+
+// enabled reports whether the events of the level are logged.
+func (l LogLevel) enabled(level slog.Level) bool {
+	switch l {
+	case LogSilent:
+		return false
+	case LogError:
+		return level >= slog.LevelError
+	case LogWarn:
+		return level >= slog.LevelWarn
+	case LogDebug:
+		return true
+	default:
+		return level >= slog.LevelInfo
+	}
+}
+
+// logEvent emits a log record to the StructuredLogger when set.
+// Otherwise, the events enabled by the LogLevel are rendered as a single line through the Printf logger.
+func (p *ReverseProxy) logEvent(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+	if p.StructuredLogger != nil {
+		p.StructuredLogger.LogAttrs(ctx, level, msg, attrs...)
+		return
+	}
+
+	if !p.LogLevel.enabled(level) {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, attr := range attrs {
+		b.WriteString(" ")
+		b.WriteString(attr.String())
+	}
+	p.logf("%s", b.String())
+}
+
+func remoteAddrAttr(req *http.Request) slog.Attr {
+	return slog.String("remote_addr", req.RemoteAddr)
+}
+
+func targetAttr(req *http.Request) slog.Attr {
+	return slog.String("target", req.URL.String())
+}
+
+func errorAttr(err error) slog.Attr {
+	return slog.String("error", err.Error())
+}
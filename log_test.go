@@ -0,0 +1,267 @@
+package websocketproxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *recordingHandler) WithGroup(string) slog.Handler { return h }
+
+// waitFor returns the attributes of the first record with the given message.
+func (h *recordingHandler) waitFor(t *testing.T, msg string) map[string]slog.Value {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		h.mu.Lock()
+		for _, r := range h.records {
+			if r.Message != msg {
+				continue
+			}
+			attrs := make(map[string]slog.Value)
+			r.Attrs(func(a slog.Attr) bool {
+				attrs[a.Key] = a.Value
+				return true
+			})
+			h.mu.Unlock()
+			return attrs
+		}
+		h.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.FailNow(t, "record not found", msg)
+	return nil
+}
+
+type printfRecorder struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *printfRecorder) Printf(format string, args ...interface{}) {
+	r.mu.Lock()
+	r.lines = append(r.lines, fmt.Sprintf(format, args...))
+	r.mu.Unlock()
+}
+
+func (r *printfRecorder) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.lines...)
+}
+
+func TestStructuredLoggerDialError(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	uri, err := url.ParseRequestURI(backend.URL)
+	require.NoError(t, err)
+	backend.Close()
+
+	handler := &recordingHandler{}
+	legacy := &printfRecorder{}
+
+	p := NewSingleHostReverseProxy(uri)
+	p.Logger = legacy
+	p.StructuredLogger = slog.New(handler)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	_, resp, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	attrs := handler.waitFor(t, "websocket: Error dialing")
+	assert.Contains(t, attrs, "remote_addr")
+	assert.Equal(t, "ws://"+uri.Host+"/ws", attrs["target"].String())
+	assert.Contains(t, attrs, "error")
+
+	assert.Empty(t, legacy.Lines())
+}
+
+func TestStructuredLoggerHandshakeRejected(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusForbidden)
+	}))
+	defer backend.Close()
+
+	uri, err := url.ParseRequestURI(backend.URL)
+	require.NoError(t, err)
+
+	handler := &recordingHandler{}
+
+	p := NewSingleHostReverseProxy(uri)
+	p.StructuredLogger = slog.New(handler)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	_, resp, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	attrs := handler.waitFor(t, "websocket: Error dialing")
+	assert.Equal(t, int64(http.StatusForbidden), attrs["status"].Int64())
+}
+
+func TestStructuredLoggerCloseEvent(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	uri, err := url.ParseRequestURI(backend.URL)
+	require.NoError(t, err)
+
+	handler := &recordingHandler{}
+
+	p := NewSingleHostReverseProxy(uri)
+	p.StructuredLogger = slog.New(handler)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+	require.NoError(t, err)
+
+	msg := gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, "bye")
+	err = conn.WriteMessage(gorillawebsocket.CloseMessage, msg)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	attrs := handler.waitFor(t, "websocket: Connection closed")
+	assert.Equal(t, int64(gorillawebsocket.CloseNormalClosure), attrs["close_code"].Int64())
+	assert.Contains(t, attrs, "target")
+}
+
+func TestLogLevel(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		level    LogLevel
+		expected []string
+	}{
+		{
+			desc:     "default",
+			expected: []string{"websocket: Error dialing"},
+		},
+		{
+			desc:  "silent",
+			level: LogSilent,
+		},
+		{
+			desc:     "error",
+			level:    LogError,
+			expected: []string{"websocket: Error dialing"},
+		},
+		{
+			desc:     "debug",
+			level:    LogDebug,
+			expected: []string{"websocket: Error dialing", "websocket: Connection closed"},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			backend := newEchoBackend(t)
+			defer backend.Close()
+
+			logger := &printfRecorder{}
+			var handled int32
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = logger
+				p.LogLevel = test.level
+				p.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+					atomic.AddInt32(&handled, 1)
+					rw.WriteHeader(http.StatusBadGateway)
+				}
+			})
+			defer proxy.Close()
+
+			// a normal close.
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.CloseMessage,
+				gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, "")))
+			_, _, err = conn.ReadMessage()
+			require.Error(t, err)
+			_ = conn.Close()
+
+			// a dial error.
+			backend.Close()
+			_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.Error(t, err)
+			require.NotNil(t, resp)
+			assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+			assert.Equal(t, int32(1), atomic.LoadInt32(&handled))
+
+			var logged []string
+			for _, expected := range test.expected {
+				deadline := time.Now().Add(2 * time.Second)
+				for !containsLine(logger.Lines(), expected) && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			for _, line := range logger.Lines() {
+				for _, msg := range []string{"websocket: Error dialing", "websocket: Connection closed"} {
+					if strings.HasPrefix(line, msg+" ") {
+						logged = append(logged, msg)
+					}
+				}
+			}
+			assert.ElementsMatch(t, test.expected, logged)
+			if test.level == LogSilent {
+				assert.Empty(t, logger.Lines())
+			}
+		})
+	}
+}
+
+// containsLine reports whether a line starts with the message.
+func containsLine(lines []string, msg string) bool {
+	for _, line := range lines {
+		if strings.HasPrefix(line, msg+" ") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package websocketproxy
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// Metadata is the metadata of a proxied request, in the context of the request passed to the Director and the hooks,
+// e.g. to correlate the calls of the hooks for a connection.
+type Metadata struct {
+	// ConnectionID is the id of the connection, see NewConnID.
+	ConnectionID string
+
+	// Target is the backend URL dialed for the request.
+	// It is nil until the URL is resolved, after Authorize and the Director.
+	Target *url.URL
+
+	// StartTime is the time the proxy received the request.
+	StartTime time.Time
+}
+
+// metadataKey is the context key of the metadata of a request.
+type metadataKey struct{}
+
+func withMetadata(ctx context.Context, meta *Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, meta)
+}
+
+// FromContext returns the metadata of the request of a context, e.g. within a hook of the proxy,
+// and reports whether the context is the one of a proxied request.
+func FromContext(ctx context.Context) (Metadata, bool) {
+	meta, ok := ctx.Value(metadataKey{}).(*Metadata)
+	if !ok {
+		return Metadata{}, false
+	}
+	return *meta, true
+}
+
+// ConnectionIDFromContext returns the id of the connection of a request context, e.g. within a hook of the proxy,
+// or an empty string if the context is not the one of a proxied request.
+func ConnectionIDFromContext(ctx context.Context) string {
+	meta, _ := FromContext(ctx)
+	return meta.ConnectionID
+}
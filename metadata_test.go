@@ -0,0 +1,79 @@
+package websocketproxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromContext(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	metas := make(chan Metadata, 4)
+	record := func(req *http.Request) {
+		meta, ok := FromContext(req.Context())
+		assert.True(t, ok)
+		metas <- meta
+	}
+
+	p, proxy := newRegistryProxy(t, backend)
+	p.Logger = &printfRecorder{}
+	director := p.Director
+	p.Director = func(req *http.Request) {
+		record(req)
+		director(req)
+	}
+	p.Authorize = func(req *http.Request) error {
+		record(req)
+		return nil
+	}
+	p.PeekFirstMessage = 1
+	p.OnFirstMessage = func(req *http.Request, _ []byte) {
+		record(req)
+	}
+	p.ConnectionClosedHook = func(req *http.Request, _ CloseInfo) {
+		record(req)
+	}
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("hello")))
+	_, _, err = conn.ReadMessage()
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	var calls []Metadata
+	for i := 0; i < 4; i++ {
+		select {
+		case meta := <-metas:
+			calls = append(calls, meta)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timeout waiting for the hooks")
+		}
+	}
+
+	// Authorize, then the Director, before the target is resolved.
+	assert.Nil(t, calls[0].Target)
+	assert.Nil(t, calls[1].Target)
+
+	for _, meta := range calls {
+		assert.NotEmpty(t, meta.ConnectionID)
+		assert.Equal(t, calls[0].ConnectionID, meta.ConnectionID)
+		assert.Equal(t, calls[0].StartTime, meta.StartTime)
+	}
+	for _, meta := range calls[2:] {
+		require.NotNil(t, meta.Target)
+		assert.Equal(t, "ws://"+backend.Listener.Addr().String()+"/ws", meta.Target.String())
+	}
+
+	_, ok := FromContext(context.Background())
+	assert.False(t, ok)
+}
@@ -0,0 +1,56 @@
+package websocketproxy
+
+// Metrics collects the metrics of the proxy, e.g. as Prometheus counters and gauges.
+// The methods are called concurrently.
+type Metrics interface {
+	// IncActive is called when a connection is established.
+	IncActive()
+	// DecActive is called when a connection terminates.
+	DecActive()
+	// AddMessages is called with the number of messages forwarded in the direction.
+	AddMessages(dir Direction, n int64)
+	// AddBytes is called with the number of message payload bytes forwarded in the direction.
+	AddBytes(dir Direction, n int64)
+	// IncDialError is called when dialing the backend fails.
+	IncDialError()
+	// IncUpgradeError is called when upgrading the client connection fails.
+	IncUpgradeError()
+}
+
+// CompressionMetrics is implemented by the Metrics collecting the compression effectiveness.
+type CompressionMetrics interface {
+	// AddCompression is called when a connection terminates, with the compression stats of the compressed connection to the peer.
+	AddCompression(peer Peer, stats CompressionStats)
+}
+
+// noopMetrics the metrics used when none are configured.
+type noopMetrics struct{}
+
+func (noopMetrics) IncActive()                   {}
+func (noopMetrics) DecActive()                   {}
+func (noopMetrics) AddMessages(Direction, int64) {}
+func (noopMetrics) AddBytes(Direction, int64)    {}
+func (noopMetrics) IncDialError()                {}
+func (noopMetrics) IncUpgradeError()             {}
+
+func (p *ReverseProxy) metrics() Metrics {
+	if p.Metrics == nil {
+		return noopMetrics{}
+	}
+	return p.Metrics
+}
+
+// addCompressionMetrics reports the compression stats of the terminated connection to the Metrics, if they implement CompressionMetrics.
+func (p *ReverseProxy) addCompressionMetrics(info CloseInfo) {
+	metrics, ok := p.Metrics.(CompressionMetrics)
+	if !ok {
+		return
+	}
+
+	if info.ClientCompression != nil {
+		metrics.AddCompression(PeerClient, *info.ClientCompression)
+	}
+	if info.BackendCompression != nil {
+		metrics.AddCompression(PeerBackend, *info.BackendCompression)
+	}
+}
@@ -0,0 +1,144 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingMetrics records the metrics.
+type recordingMetrics struct {
+	mu            sync.Mutex
+	active        int64
+	messages      map[Direction]int64
+	bytes         map[Direction]int64
+	dialErrors    int64
+	upgradeErrors int64
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{messages: map[Direction]int64{}, bytes: map[Direction]int64{}}
+}
+
+func (m *recordingMetrics) IncActive() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active++
+}
+
+func (m *recordingMetrics) DecActive() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active--
+}
+
+func (m *recordingMetrics) AddMessages(dir Direction, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages[dir] += n
+}
+
+func (m *recordingMetrics) AddBytes(dir Direction, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes[dir] += n
+}
+
+func (m *recordingMetrics) IncDialError() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dialErrors++
+}
+
+func (m *recordingMetrics) IncUpgradeError() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upgradeErrors++
+}
+
+func (m *recordingMetrics) waitActive(t *testing.T, expected int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		m.mu.Lock()
+		active := m.active
+		m.mu.Unlock()
+
+		if active == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			require.FailNow(t, "unexpected active connections", "expected %d, got %d", expected, active)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	metrics := newRecordingMetrics()
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Metrics = metrics
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+
+	metrics.waitActive(t, 1)
+
+	for _, msg := range []string{"one", "two"} {
+		require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte(msg)))
+		_, _, err = conn.ReadMessage()
+		require.NoError(t, err)
+	}
+
+	err = conn.WriteMessage(gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, ""))
+	require.NoError(t, err)
+	_, _, _ = conn.ReadMessage()
+	_ = conn.Close()
+
+	metrics.waitActive(t, 0)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	assert.Equal(t, int64(2), metrics.messages[ClientToBackend])
+	assert.Equal(t, int64(2), metrics.messages[BackendToClient])
+	assert.Equal(t, int64(6), metrics.bytes[ClientToBackend])
+	assert.Equal(t, int64(6), metrics.bytes[BackendToClient])
+	assert.Equal(t, int64(0), metrics.dialErrors)
+	assert.Equal(t, int64(0), metrics.upgradeErrors)
+}
+
+func TestMetricsDialError(t *testing.T) {
+	uri, err := url.Parse("http://127.0.0.1:1")
+	require.NoError(t, err)
+
+	metrics := newRecordingMetrics()
+	p := NewSingleHostReverseProxy(uri)
+	p.Logger = &printfRecorder{}
+	p.Metrics = metrics
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	assert.Equal(t, int64(1), metrics.dialErrors)
+	assert.Equal(t, int64(0), metrics.active)
+	assert.Empty(t, metrics.messages)
+}
@@ -0,0 +1,328 @@
+package websocketproxy
+
+import (
+	"errors"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNoTarget is reported when a picker has no backend to pick.
+var ErrNoTarget = errors.New("websocket: no backend available")
+
+// TargetLister is implemented by the pickers whose backends can serve any request, e.g. to load-balance them.
+// A resumption token only routes to one of the backends currently listed by the Picker:
+// the pickers routing the requests by their attributes don't list their backends, as a token would bypass their routing.
+type TargetLister interface {
+	// Targets returns the current backends.
+	Targets() []*url.URL
+}
+
+// defaultReplicas is the number of points of each backend on the ring of a consistent-hash picker.
+const defaultReplicas = 100
+
+// Picker picks the backend of a request.
+type Picker interface {
+	// Pick returns the backend of the request: its scheme and host replace the ones set by the Director.
+	Pick(req *http.Request) (*url.URL, error)
+}
+
+// ConsistentHashPicker picks the backends by consistent hashing of a key of the requests,
+// so the requests with the same key reach the same backend as long as the backends are stable.
+// Removing a backend only moves the keys of this backend.
+type ConsistentHashPicker struct {
+	key func(req *http.Request) string
+
+	mu      sync.RWMutex
+	targets map[string]*url.URL
+	hashes  []uint32
+	ring    map[uint32]string
+}
+
+// NewConsistentHashPicker creates a picker hashing the key extracted from the requests onto the backends.
+// An empty key, or a nil key function, falls back to the client IP.
+func NewConsistentHashPicker(targets []*url.URL, key func(req *http.Request) string) *ConsistentHashPicker {
+	p := &ConsistentHashPicker{
+		key:     key,
+		targets: make(map[string]*url.URL),
+		ring:    make(map[uint32]string),
+	}
+	for _, target := range targets {
+		p.Add(target)
+	}
+	return p
+}
+
+// Add adds a backend.
+func (p *ConsistentHashPicker) Add(target *url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name := target.String()
+	if _, ok := p.targets[name]; ok {
+		return
+	}
+
+	p.targets[name] = target
+	for i := 0; i < defaultReplicas; i++ {
+		h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + name))
+		if _, ok := p.ring[h]; ok {
+			continue
+		}
+		p.ring[h] = name
+		p.hashes = append(p.hashes, h)
+	}
+	sort.Slice(p.hashes, func(i, j int) bool { return p.hashes[i] < p.hashes[j] })
+}
+
+// Remove removes a backend.
+func (p *ConsistentHashPicker) Remove(target *url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name := target.String()
+	if _, ok := p.targets[name]; !ok {
+		return
+	}
+
+	delete(p.targets, name)
+	hashes := p.hashes[:0]
+	for _, h := range p.hashes {
+		if p.ring[h] == name {
+			delete(p.ring, h)
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	p.hashes = hashes
+}
+
+// Targets returns the backends.
+func (p *ConsistentHashPicker) Targets() []*url.URL {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	targets := make([]*url.URL, 0, len(p.targets))
+	for _, target := range p.targets {
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// Pick returns the backend of the key of the request.
+func (p *ConsistentHashPicker) Pick(req *http.Request) (*url.URL, error) {
+	var key string
+	if p.key != nil {
+		key = p.key(req)
+	}
+	if key == "" {
+		key = clientIP(req)
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.hashes) == 0 {
+		return nil, ErrNoTarget
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(p.hashes), func(i int) bool { return p.hashes[i] >= h })
+	if i == len(p.hashes) {
+		i = 0
+	}
+	return p.targets[p.ring[p.hashes[i]]], nil
+}
+
+// WeightedTarget is a backend of a WeightedRoundRobinPicker, with its weight.
+type WeightedTarget struct {
+	URL    *url.URL
+	Weight int
+}
+
+// WeightedRoundRobinPicker picks the backends in turn, in proportion to their weights,
+// e.g. for backends of different capacities.
+// It uses the smooth weighted round-robin of nginx, which interleaves the picks of the backends instead of picking them in bursts.
+type WeightedRoundRobinPicker struct {
+	mu      sync.Mutex
+	targets []WeightedTarget
+	current []int
+	total   int
+}
+
+// NewWeightedRoundRobinPicker creates a picker distributing the connections across the backends in proportion to their weights.
+// The backends with a weight below 1 are never picked.
+func NewWeightedRoundRobinPicker(targets []WeightedTarget) *WeightedRoundRobinPicker {
+	p := &WeightedRoundRobinPicker{}
+	for _, target := range targets {
+		if target.Weight < 1 {
+			continue
+		}
+		p.targets = append(p.targets, target)
+		p.total += target.Weight
+	}
+	p.current = make([]int, len(p.targets))
+	return p
+}
+
+// Pick returns the next backend.
+func (p *WeightedRoundRobinPicker) Pick(_ *http.Request) (*url.URL, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.targets) == 0 {
+		return nil, ErrNoTarget
+	}
+
+	best := 0
+	for i, target := range p.targets {
+		p.current[i] += target.Weight
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= p.total
+	return p.targets[best].URL, nil
+}
+
+// Targets returns the backends that can be picked.
+func (p *WeightedRoundRobinPicker) Targets() []*url.URL {
+	targets := make([]*url.URL, 0, len(p.targets))
+	for _, target := range p.targets {
+		targets = append(targets, target.URL)
+	}
+	return targets
+}
+
+// ErrUnknownOrigin is reported when the Origin of a request has no backend in an OriginPicker.
+// It rejects the handshake with a 403 status code.
+var ErrUnknownOrigin = errors.New("websocket: unknown origin")
+
+// OriginPicker picks the backends by the Origin header of the requests, e.g. for a backend per tenant.
+// The requests with an unknown or missing Origin are rejected with a 403 status code.
+type OriginPicker struct {
+	targets map[string]*url.URL
+}
+
+// NewOriginPicker creates a picker routing the requests to the backend of their Origin,
+// e.g. "https://tenant.example.com". The origins are compared case-insensitively.
+func NewOriginPicker(targets map[string]*url.URL) *OriginPicker {
+	p := &OriginPicker{targets: make(map[string]*url.URL, len(targets))}
+	for origin, target := range targets {
+		p.targets[normalizeOrigin(origin)] = target
+	}
+	return p
+}
+
+// Pick returns the backend of the Origin of the request.
+func (p *OriginPicker) Pick(req *http.Request) (*url.URL, error) {
+	target, ok := p.targets[normalizeOrigin(req.Header.Get("Origin"))]
+	if !ok || target == nil {
+		return nil, &StatusError{Status: http.StatusForbidden, Err: ErrUnknownOrigin}
+	}
+	return target, nil
+}
+
+func normalizeOrigin(origin string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+}
+
+// ErrNoRoute is reported when a request matches no route of a Router without a default target.
+// It rejects the handshake with a 404 status code.
+var ErrNoRoute = errors.New("websocket: no route")
+
+// Route routes the requests it matches to its target.
+type Route struct {
+	// Match reports whether the route matches the request, e.g. MatchPathPrefix or MatchHeader.
+	Match func(req *http.Request) bool
+
+	// Target is the backend of the matched requests.
+	Target *url.URL
+}
+
+// Router picks the backend of the first route matching the request,
+// else the default target, e.g. to migrate the routes one by one from a legacy backend.
+type Router struct {
+	// Routes are the routes, in their order of precedence.
+	Routes []Route
+
+	// DefaultTarget is the backend of the requests matching no route.
+	// If nil, they are rejected with a 404 status code.
+	DefaultTarget *url.URL
+}
+
+// Pick returns the backend of the first route matching the request, else the default target.
+func (r *Router) Pick(req *http.Request) (*url.URL, error) {
+	for _, route := range r.Routes {
+		if route.Match(req) {
+			return route.Target, nil
+		}
+	}
+
+	if r.DefaultTarget == nil {
+		return nil, &StatusError{Status: http.StatusNotFound, Err: ErrNoRoute}
+	}
+	return r.DefaultTarget, nil
+}
+
+// MatchPathPrefix matches the requests whose path is the prefix, or starts with it followed by a slash.
+func MatchPathPrefix(prefix string) func(req *http.Request) bool {
+	return func(req *http.Request) bool {
+		return hasPathPrefix(req.URL.Path, prefix)
+	}
+}
+
+// MatchHeader matches the requests with the value for the header.
+func MatchHeader(name, value string) func(req *http.Request) bool {
+	return func(req *http.Request) bool {
+		return req.Header.Get(name) == value
+	}
+}
+
+// HostRouter picks the backends by the Host of the requests, like the server names of a virtual hosting,
+// else the default target.
+type HostRouter struct {
+	// Hosts are the backends of the hosts, e.g. "chat.example.com".
+	// The hosts are compared case-insensitively, without their port.
+	// They must not change once the router picks the backends.
+	Hosts map[string]*url.URL
+
+	// DefaultTarget is the backend of the requests with an unknown Host.
+	// If nil, they are rejected with a 404 status code.
+	DefaultTarget *url.URL
+
+	hostsOnce sync.Once
+	hosts     map[string]*url.URL
+}
+
+// Pick returns the backend of the Host of the request, else the default target.
+func (r *HostRouter) Pick(req *http.Request) (*url.URL, error) {
+	r.hostsOnce.Do(func() {
+		r.hosts = make(map[string]*url.URL, len(r.Hosts))
+		for host, target := range r.Hosts {
+			r.hosts[normalizeHost(host)] = target
+		}
+	})
+
+	if target, ok := r.hosts[normalizeHost(req.Host)]; ok && target != nil {
+		return target, nil
+	}
+
+	if r.DefaultTarget == nil {
+		return nil, &StatusError{Status: http.StatusNotFound, Err: ErrNoRoute}
+	}
+	return r.DefaultTarget, nil
+}
+
+// normalizeHost returns the lowercase host name, without its port and its trailing dot.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,449 @@
+package websocketproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sessionKey(req *http.Request) string {
+	return req.Header.Get("X-Session-Id")
+}
+
+func newSessionRequest(session string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Session-Id", session)
+	return req
+}
+
+func parseTargets(t *testing.T, rawURLs ...string) []*url.URL {
+	t.Helper()
+
+	var targets []*url.URL
+	for _, rawURL := range rawURLs {
+		target, err := url.Parse(rawURL)
+		require.NoError(t, err)
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+func TestConsistentHashPicker(t *testing.T) {
+	targets := parseTargets(t, "ws://a", "ws://b", "ws://c")
+	picker := NewConsistentHashPicker(targets, sessionKey)
+
+	picked := map[string]string{}
+	used := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		session := fmt.Sprintf("session-%d", i)
+
+		target, err := picker.Pick(newSessionRequest(session))
+		require.NoError(t, err)
+		picked[session] = target.String()
+		used[target.String()] = true
+
+		// the same key always maps to the same backend.
+		for j := 0; j < 3; j++ {
+			again, err := picker.Pick(newSessionRequest(session))
+			require.NoError(t, err)
+			assert.Equal(t, target, again)
+		}
+	}
+	assert.Len(t, used, 3)
+
+	// removing a backend only moves its keys.
+	picker.Remove(targets[1])
+	for session, previous := range picked {
+		target, err := picker.Pick(newSessionRequest(session))
+		require.NoError(t, err)
+
+		if previous == "ws://b" {
+			assert.NotEqual(t, "ws://b", target.String())
+			continue
+		}
+		assert.Equal(t, previous, target.String(), session)
+	}
+
+	picker.Add(targets[1])
+	for session, previous := range picked {
+		target, err := picker.Pick(newSessionRequest(session))
+		require.NoError(t, err)
+		assert.Equal(t, previous, target.String(), session)
+	}
+}
+
+func TestConsistentHashPickerNoTarget(t *testing.T) {
+	picker := NewConsistentHashPicker(nil, sessionKey)
+
+	_, err := picker.Pick(newSessionRequest("session"))
+	assert.Equal(t, ErrNoTarget, err)
+}
+
+func TestConsistentHashPickerNilKey(t *testing.T) {
+	picker := NewConsistentHashPicker(parseTargets(t, "ws://a", "ws://b", "ws://c"), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	target, err := picker.Pick(req)
+	require.NoError(t, err)
+
+	// the client IP is the key.
+	other := httptest.NewRequest(http.MethodGet, "/", nil)
+	other.RemoteAddr = "10.0.0.1:5678"
+	again, err := picker.Pick(other)
+	require.NoError(t, err)
+	assert.Equal(t, target, again)
+}
+
+func TestStickySessions(t *testing.T) {
+	backendA := newNamedEchoBackend(t, "a")
+	defer backendA.Close()
+	backendB := newNamedEchoBackend(t, "b")
+	defer backendB.Close()
+
+	uri, err := url.Parse(backendA.URL)
+	require.NoError(t, err)
+
+	p := NewSingleHostReverseProxy(uri)
+	p.Picker = NewConsistentHashPicker(parseTargets(t, backendA.URL, backendB.URL), sessionKey)
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	names := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		header := http.Header{}
+		header.Set("X-Session-Id", fmt.Sprintf("session-%d", i))
+
+		var first string
+		for j := 0; j < 3; j++ {
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), header)
+			require.NoError(t, err)
+
+			_, name, err := conn.ReadMessage()
+			require.NoError(t, err)
+			_ = conn.Close()
+
+			if j == 0 {
+				first = string(name)
+			}
+			assert.Equal(t, first, string(name))
+		}
+		names[first] = true
+	}
+
+	assert.Len(t, names, 2)
+}
+
+func TestWeightedRoundRobinPicker(t *testing.T) {
+	targets := parseTargets(t, "http://a", "http://b", "http://c", "http://disabled")
+	picker := NewWeightedRoundRobinPicker([]WeightedTarget{
+		{URL: targets[0], Weight: 5},
+		{URL: targets[1], Weight: 3},
+		{URL: targets[2], Weight: 2},
+		{URL: targets[3]},
+	})
+
+	counts := map[string]int{}
+	previous, run, maxRun := "", 0, 0
+	for i := 0; i < 1000; i++ {
+		target, err := picker.Pick(httptest.NewRequest(http.MethodGet, "/", nil))
+		require.NoError(t, err)
+
+		host := target.Host
+		counts[host]++
+		if host == previous {
+			run++
+		} else {
+			previous, run = host, 1
+		}
+		if run > maxRun {
+			maxRun = run
+		}
+	}
+
+	assert.InDelta(t, 500, counts["a"], 10)
+	assert.InDelta(t, 300, counts["b"], 10)
+	assert.InDelta(t, 200, counts["c"], 10)
+	assert.Zero(t, counts["disabled"])
+	// the picks are interleaved.
+	assert.LessOrEqual(t, maxRun, 2)
+}
+
+func TestWeightedRoundRobinPickerNoTarget(t *testing.T) {
+	picker := NewWeightedRoundRobinPicker([]WeightedTarget{{URL: &url.URL{Host: "a"}}})
+
+	_, err := picker.Pick(httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, ErrNoTarget, err)
+}
+
+func TestOriginPicker(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			conn, err := upgrader.Upgrade(rw, req, nil)
+			if err != nil {
+				return
+			}
+			_ = conn.WriteMessage(gorillawebsocket.TextMessage, []byte(name))
+			_ = conn.Close()
+		}))
+	}
+
+	backendA := newBackend("a")
+	defer backendA.Close()
+	backendB := newBackend("b")
+	defer backendB.Close()
+
+	targets := parseTargets(t, backendA.URL, backendB.URL)
+
+	p := NewSingleHostReverseProxy(targets[0])
+	p.Logger = &printfRecorder{}
+	p.Picker = NewOriginPicker(map[string]*url.URL{
+		"https://a.example.com":  targets[0],
+		"https://B.example.com/": targets[1],
+	})
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	testCases := []struct {
+		desc     string
+		origin   string
+		expected string
+		status   int
+	}{
+		{
+			desc:     "known origin",
+			origin:   "https://a.example.com",
+			expected: "a",
+		},
+		{
+			desc:     "case-insensitive origin",
+			origin:   "https://b.EXAMPLE.com",
+			expected: "b",
+		},
+		{
+			desc:   "unknown origin",
+			origin: "https://c.example.com",
+			status: http.StatusForbidden,
+		},
+		{
+			desc:   "missing origin",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			header := http.Header{}
+			if test.origin != "" {
+				header.Set("Origin", test.origin)
+			}
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), header)
+			if test.status != 0 {
+				require.Error(t, err)
+				require.NotNil(t, resp)
+				assert.Equal(t, test.status, resp.StatusCode)
+				return
+			}
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			_, name, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(name))
+		})
+	}
+}
+
+func TestRouter(t *testing.T) {
+	backendA := newNamedEchoBackend(t, "a")
+	defer backendA.Close()
+	backendB := newNamedEchoBackend(t, "b")
+	defer backendB.Close()
+	legacy := newNamedEchoBackend(t, "legacy")
+	defer legacy.Close()
+
+	targets := parseTargets(t, backendA.URL, backendB.URL, legacy.URL)
+
+	testCases := []struct {
+		desc          string
+		defaultTarget *url.URL
+		path          string
+		header        http.Header
+		expected      string
+		status        int
+	}{
+		{
+			desc:     "path route",
+			path:     "/a/ws",
+			expected: "a",
+		},
+		{
+			desc:     "header route",
+			path:     "/ws",
+			header:   http.Header{"X-Tenant": []string{"b"}},
+			expected: "b",
+		},
+		{
+			desc:          "default target",
+			defaultTarget: targets[2],
+			path:          "/ws",
+			expected:      "legacy",
+		},
+		{
+			desc:   "no route",
+			path:   "/ws",
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			p := NewSingleHostReverseProxy(targets[2])
+			p.Logger = &printfRecorder{}
+			p.Picker = &Router{
+				Routes: []Route{
+					{Match: MatchPathPrefix("/a"), Target: targets[0]},
+					{Match: MatchHeader("X-Tenant", "b"), Target: targets[1]},
+				},
+				DefaultTarget: test.defaultTarget,
+			}
+			proxy := httptest.NewServer(p)
+			defer proxy.Close()
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, test.path), test.header)
+			if test.status != 0 {
+				require.Error(t, err)
+				require.NotNil(t, resp)
+				assert.Equal(t, test.status, resp.StatusCode)
+				return
+			}
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			_, name, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(name))
+		})
+	}
+}
+
+func TestHostRouter(t *testing.T) {
+	backendA := newNamedEchoBackend(t, "a")
+	defer backendA.Close()
+	backendB := newNamedEchoBackend(t, "b")
+	defer backendB.Close()
+	fallback := newNamedEchoBackend(t, "fallback")
+	defer fallback.Close()
+
+	targets := parseTargets(t, backendA.URL, backendB.URL, fallback.URL)
+
+	testCases := []struct {
+		desc          string
+		defaultTarget *url.URL
+		host          string
+		expected      string
+		status        int
+	}{
+		{
+			desc:     "exact match",
+			host:     "a.example.com",
+			expected: "a",
+		},
+		{
+			desc:     "case-insensitive",
+			host:     "B.Example.COM",
+			expected: "b",
+		},
+		{
+			desc:     "port stripped",
+			host:     "a.example.com:8443",
+			expected: "a",
+		},
+		{
+			desc:          "fallback",
+			defaultTarget: targets[2],
+			host:          "unknown.example.com",
+			expected:      "fallback",
+		},
+		{
+			desc:   "unknown host",
+			host:   "unknown.example.com",
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			p := NewSingleHostReverseProxy(targets[2])
+			p.Logger = &printfRecorder{}
+			p.Picker = &HostRouter{
+				Hosts: map[string]*url.URL{
+					"a.example.com":     targets[0],
+					"b.example.com:443": targets[1],
+				},
+				DefaultTarget: test.defaultTarget,
+			}
+			proxy := httptest.NewServer(p)
+			defer proxy.Close()
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), http.Header{"Host": {test.host}})
+			if test.status != 0 {
+				require.Error(t, err)
+				require.NotNil(t, resp)
+				assert.Equal(t, test.status, resp.StatusCode)
+				return
+			}
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			_, name, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(name))
+		})
+	}
+}
+
+// statusPicker rejects every request with a status error.
+type statusPicker struct {
+	status int
+}
+
+func (p statusPicker) Pick(*http.Request) (*url.URL, error) {
+	return nil, &StatusError{Status: p.status, Err: errors.New("rejected")}
+}
+
+func TestPickerStatusError(t *testing.T) {
+	target, err := url.Parse("ws://backend")
+	require.NoError(t, err)
+
+	var handled int
+	p := NewSingleHostReverseProxy(target)
+	p.Logger = &printfRecorder{}
+	p.Picker = statusPicker{status: http.StatusTooManyRequests}
+	p.ErrorHandler = func(rw http.ResponseWriter, _ *http.Request, err error) {
+		var statusErr *StatusError
+		require.True(t, errors.As(err, &statusErr))
+		handled = statusErr.Status
+		rw.WriteHeader(statusErr.Status)
+	}
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, handled)
+}
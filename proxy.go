@@ -4,18 +4,60 @@ package websocketproxy
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"reflect"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const (
+	// closeWriteTimeout bounds the time spent writing a close frame.
+	closeWriteTimeout = time.Second
+
+	// closeHandshakeTimeout bounds the time waiting for a peer to answer a close frame.
+	closeHandshakeTimeout = time.Second
+
+	// maxCloseReasonLength is the maximum length of a close reason:
+	// a control frame payload is limited to 125 bytes, including the 2 bytes close code.
+	maxCloseReasonLength = 123
+
+	// defaultCopyBufferSize is the size of the buffer used by io.Copy.
+	defaultCopyBufferSize = 32 * 1024
+
+	// smallMessageSize is the size under which a message is buffered and written at once,
+	// instead of being streamed.
+	smallMessageSize = 1024
+)
+
+// smallBuffers the buffers of the small messages.
+var smallBuffers = sync.Pool{
+	New: func() interface{} {
+		return new([smallMessageSize]byte)
+	},
+}
+
+// errPanic is reported in place of a recovered panic, so its value is not leaked to peers.
+var errPanic = errors.New("websocket: internal error")
+
+// errNilConn is reported when a dialer returns a nil connection without an error.
+var errNilConn = errors.New("websocket: nil connection")
+
 type logger interface {
 	Printf(format string, args ...interface{})
 }
@@ -41,7 +83,8 @@ func NewSingleHostReverseProxy(target *url.URL) *ReverseProxy {
 		}
 
 		if _, ok := req.Header["User-Agent"]; !ok {
-			// explicitly disable User-Agent so it's not set to default value
+			// explicitly disable User-Agent so it's not set to default value,
+			// unless the proxy sets its DefaultUserAgent.
 			req.Header.Set("User-Agent", "")
 		}
 
@@ -56,9 +99,37 @@ func NewSingleHostReverseProxy(target *url.URL) *ReverseProxy {
 	return &ReverseProxy{Director: director}
 }
 
+// NewSingleHostReverseProxyContext is like NewSingleHostReverseProxy,
+// but canceling ctx closes every connection of the proxy with websocket.CloseGoingAway.
+func NewSingleHostReverseProxyContext(ctx context.Context, target *url.URL) *ReverseProxy {
+	p := NewSingleHostReverseProxy(target)
+	p.ctx = ctx
+	return p
+}
+
+// NewWithFallback returns a handler proxying the websocket upgrades to target, like NewSingleHostReverseProxy,
+// and serving the other requests with fallback.
+func NewWithFallback(target *url.URL, fallback http.Handler) http.Handler {
+	return NewSingleHostReverseProxy(target).WithFallback(fallback)
+}
+
+// WithFallback returns a handler proxying the websocket upgrades, and serving the other requests with fallback,
+// instead of answering them with http.StatusUpgradeRequired.
+func (p *ReverseProxy) WithFallback(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !isWebsocketRequest(req) {
+			fallback.ServeHTTP(rw, req)
+			return
+		}
+		p.ServeHTTP(rw, req)
+	})
+}
+
 // ReverseProxy is an HTTP Handler that takes an incoming request and
 // sends it to another server, proxying the response back to the
 // client.
+// The websockets bootstrapped over HTTP/2 with an extended CONNECT (RFC 8441) are proxied too,
+// the HTTP/2 server of net/http only enables them with GODEBUG=http2xconnect=1.
 type ReverseProxy struct {
 	// Director must be a function which modifies
 	// the request into a new request to be sent
@@ -68,186 +139,1944 @@ type ReverseProxy struct {
 	// after returning.
 	Director func(*http.Request)
 
+	// RewriteURL is an optional function returning the exact ws or wss URL dialed for a client request,
+	// e.g. a fixed backend path regardless of the path requested by the client.
+	// It takes precedence over the URL set by the Director, StripPrefix, CollapseSlashes and the config target.
+	// A non-nil error rejects the request through the error handler, with the status code of a *StatusError.
+	RewriteURL func(req *http.Request) (*url.URL, error)
+
+	// ConfigureDialHeaders is an optional function modifying the headers of the backend handshake,
+	// e.g. to add a service token of the backend.
+	// It is called right before each dial of the backend, including the redials of ReconnectBackend,
+	// after the Director, the header filters and the removal of the hop-by-hop and websocket dial headers,
+	// so the headers it sets are sent as is.
+	// It must not set the websocket dial headers, set by the dialer.
+	// The legacy backend mode only sends the Origin and Sec-WebSocket-Protocol headers.
+	ConfigureDialHeaders func(h http.Header)
+
 	// The dialer used to perform dial.
 	// If nil, websocket.DefaultDialer is used.
 	Dialer Dialer
 
+	// DialerFunc is an optional function returning the dialer of a request,
+	// e.g. to dial the backends with a client certificate per tenant.
+	// A nil dialer falls back to Dialer.
+	DialerFunc func(req *http.Request) Dialer
+
+	// NetDialContext is an optional function that opens the network connections to the backend,
+	// replacing the one of the dialer, e.g. to reach a backend on a Unix socket:
+	//
+	//	p.NetDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+	//		return (&net.Dialer{}).DialContext(ctx, "unix", "/run/app.sock")
+	//	}
+	//
+	// The backend is reached directly, the proxy of the dialer is ignored.
+	// It only applies to a *websocket.Dialer.
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// LocalAddr is the local address the backend connections originate from, e.g. a *net.TCPAddr.
+	// It is ignored when NetDialContext is set.
+	// It only applies to a *websocket.Dialer.
+	LocalAddr net.Addr
+
+	// SendProxyProtocol is the version, 1 or 2, of the PROXY protocol header written on the backend connections,
+	// with the addresses of the client and of the proxy listener, before the TLS and websocket handshakes.
+	// The backend is reached directly, the proxy of the dialer is ignored.
+	// If zero, no header is written.
+	// It only applies to a *websocket.Dialer.
+	SendProxyProtocol int
+
+	// EnableCompression negotiates permessage-deflate with the backend when the client offers it,
+	// and with the client when the backend accepts it.
+	// Each peer negotiates with the proxy, which decompresses and compresses the messages again:
+	// it trades CPU on the proxy for bandwidth.
+	// It only applies to a *websocket.Dialer.
+	EnableCompression bool
+
+	// ClientCompression negotiates permessage-deflate with the client when it offers it, regardless of the backend,
+	// e.g. to compress over the WAN to the clients while the LAN backend is left uncompressed.
+	ClientCompression bool
+
+	// BackendCompression offers permessage-deflate to the backend, regardless of the client.
+	// It only applies to a *websocket.Dialer.
+	BackendCompression bool
+
+	// CompressionLevel is the flate level of the messages compressed by the proxy,
+	// from flate.HuffmanOnly (-2) to flate.BestCompression (9).
+	// If zero, the default level of the websocket package (flate.BestSpeed) is used.
+	CompressionLevel int
+
+	// CompressionThreshold is the size in bytes under which a message is written uncompressed,
+	// as the compression of small messages costs more than it saves.
+	// If zero, all the messages are compressed.
+	CompressionThreshold int
+
+	// ReadBufferSize and WriteBufferSize are the sizes of the buffers preallocated
+	// for each side of a connection, applied to both the client and the backend connections.
+	// Larger buffers use more memory per connection but need fewer system calls for large messages.
+	// The backend sizes only apply to a *websocket.Dialer.
+	// If zero, the default sizes of the websocket package (4096) are used.
+	ReadBufferSize, WriteBufferSize int
+
+	// LegacyBackendMode sends a minimal handshake request to the backend,
+	// with only the websocket headers, Origin and Sec-WebSocket-Protocol, in a fixed order.
+	// It is intended for old backends that reject the other headers.
+	// It only applies to a *websocket.Dialer, and disables its Proxy setting.
+	LegacyBackendMode bool
+
+	// PassHostHeader forwards the Host of the client request to the backend,
+	// instead of the Host of the backend URL.
+	PassHostHeader bool
+
+	// ForceScheme is the scheme of the dialed backend URL, ws or wss, regardless of the scheme of the client request,
+	// e.g. wss to dial the backends over TLS while the TLS of the clients ends at the proxy.
+	// It applies after the Director and the config target, but not to the URL returned by RewriteURL.
+	// Another scheme rejects all the requests with a 500 Internal Server Error.
+	// If empty, the scheme set by the Director is kept.
+	ForceScheme string
+
+	// DefaultUserAgent is the User-Agent sent to the backend when the client sends none,
+	// e.g. an identifier of the proxy for the backends logging or checking it.
+	// If empty, no User-Agent is sent instead.
+	DefaultUserAgent string
+
+	// Via is the pseudonym of the proxy appended to the Via header of the backend request and of the client handshake response,
+	// e.g. "websocketproxy" for "Via: 1.1 websocketproxy", to trace the messages through a chain of proxies.
+	// If empty, the Via header is forwarded unchanged.
+	Via string
+
+	// CorrelationHeader is the name of a header carrying a correlation id from the client to the backend,
+	// e.g. X-Request-Id, to trace a connection across services.
+	// The id of the client request is forwarded, or a random UUID is generated when the client sends none.
+	// The id is reported in the CloseInfo of the ConnectionClosedHook, and in the ConnectionInfo of the active connections.
+	// If empty, no correlation id is handled.
+	CorrelationHeader string
+
+	// StripPrefix is a path prefix removed from the request path before the Director, like http.StripPrefix.
+	// The prefix matches whole path segments: "/ws" matches "/ws" and "/ws/chat", but not "/wsx".
+	// The requests not matching the prefix are answered with a 404 Not Found.
+	StripPrefix string
+
+	// CollapseSlashes collapses the duplicate slashes of the backend request path, once rewritten by the Director.
+	// The query is left unchanged.
+	CollapseSlashes bool
+
+	// HashedClientIPHeader is the name of a header set on the backend request
+	// to a salted hash of the client IP, so the backend can distinguish clients without knowing their address.
+	// If empty, no header is set.
+	HashedClientIPHeader string
+
+	// ClientIPHashSalt is the salt of the client IP hash.
+	ClientIPHashSalt []byte
+
+	// OmitForwardedFor removes the X-Forwarded-For header from the backend request.
+	OmitForwardedFor bool
+
+	// RequestHeaderAllowlist restricts the client request headers copied to the backend request to the listed ones.
+	// Sec-WebSocket-Protocol is always copied, for the subprotocol negotiation.
+	// If nil, all the headers are copied.
+	RequestHeaderAllowlist []string
+
+	// RequestHeaderBlocklist lists the client request headers not copied to the backend request.
+	// Both lists apply to the client headers only: the headers set by the Director and the proxy are kept,
+	// and the websocket handshake headers are always written by the dialer.
+	RequestHeaderBlocklist []string
+
+	// MaxHeaderBytes is the maximum size of the client request headers, the sum of the lengths of their names and values,
+	// e.g. to keep the backend handshakes under the limits of the backends.
+	// The larger requests are rejected with a 431 Request Header Fields Too Large, before the backend is dialed.
+	// If zero, there is no limit but the one of the server.
+	MaxHeaderBytes int
+
+	// HopHeaders are the headers removed from the backend handshake response.
+	// If nil, the default hop-by-hop headers are used.
+	// The websocket handshake headers are always removed, as the upgrade writes its own.
+	HopHeaders []string
+
+	// OnHeaderStripped is called with each value of the hop-by-hop headers removed from the backend handshake request,
+	// with the location "request", and from the backend handshake response, with the location "response".
+	// It is intended to debug the headers not reaching a peer.
+	OnHeaderStripped func(name, value, location string)
+
+	// ResponseHeaderAllowlist restricts the backend handshake response headers copied to the client response
+	// to the listed ones, once the hop-by-hop headers are removed.
+	// Sec-WebSocket-Protocol is always copied, for the subprotocol negotiation.
+	// If nil, all the end-to-end headers are copied.
+	ResponseHeaderAllowlist []string
+
+	// ResponseHeaderBlocklist lists the backend handshake response headers not copied to the client response.
+	// Both lists apply to the backend headers only: the headers already set on the response writer are kept.
+	ResponseHeaderBlocklist []string
+
 	WebsocketConnectionClosedHook func(req *http.Request, conn net.Conn)
 
+	// Tap is an optional function called with each data message, in both directions,
+	// once it is forwarded.
+	// The tap runs on the forwarding path: a slow tap delays the following messages of its direction.
+	// Enabling it buffers each message in memory, to hand its payload to the tap.
+	// The tap owns the payload.
+	Tap func(dir Direction, messageType int, data []byte)
+
+	// PeekFirstMessage is the number of bytes of the first data message of the client handed to OnFirstMessage,
+	// e.g. to log the kind of session from the header of a binary protocol.
+	// Only these bytes are read ahead: the message is then forwarded intact, without being buffered.
+	// If zero, OnFirstMessage is not called.
+	PeekFirstMessage int
+
+	// OnFirstMessage is called with up to PeekFirstMessage bytes of the first data message of the client,
+	// before the message is forwarded.
+	// It is called on the goroutine reading the client, so it must not block, and it must not retain peek.
+	OnFirstMessage func(req *http.Request, peek []byte)
+
+	// TransformClientToBackend is an optional function transforming each data message of the client,
+	// before it is forwarded to the backend: it returns the payload forwarded instead.
+	// The transform runs on the forwarding path, and owns the payload.
+	// An error closes the connection with websocket.CloseInternalServerErr.
+	// Enabling it buffers each message of the client in memory, the messages of the backend are still streamed.
+	TransformClientToBackend func(messageType int, data []byte) ([]byte, error)
+
+	// TransformBackendToClient is like TransformClientToBackend, for the messages of the backend to the client.
+	TransformBackendToClient func(messageType int, data []byte) ([]byte, error)
+
+	// CoalesceWindow is the duration during which the consecutive data messages of the client of the same type
+	// are buffered, then forwarded to the backend as one message, e.g. for a backend of an append-style protocol preferring fewer, larger frames.
+	// A message of another type, or a control message, first flushes the buffered ones: text and binary messages are never merged.
+	// Enabling it buffers the messages of the client in memory.
+	// If zero, the messages are forwarded as they are received.
+	CoalesceWindow time.Duration
+
+	// CoalesceMaxBytes is the maximum size of a coalesced message: once reached, the buffered messages are forwarded without waiting for the window.
+	// If zero, 64KB is used.
+	CoalesceMaxBytes int
+
+	// CoalesceSeparator is inserted between the coalesced messages, e.g. a newline for a line-delimited text protocol.
+	// If empty, the payloads are concatenated.
+	CoalesceSeparator []byte
+
+	// ForceMessageType is an optional mapping of a direction to the type of its data messages,
+	// websocket.TextMessage or websocket.BinaryMessage, e.g. to forward the text messages of a client
+	// as binary messages to the backend.
+	// Only the opcode changes: the payloads and the control messages are forwarded unchanged.
+	ForceMessageType map[Direction]int
+
+	// AllowedMessageTypes are the types of the data messages the clients can send, websocket.TextMessage or websocket.BinaryMessage,
+	// e.g. to reject the binary messages of a text protocol.
+	// A message of another type closes the connection with websocket.CloseUnsupportedData, the control messages are always allowed.
+	// The types are checked before ForceMessageType applies.
+	// If empty, all the types are allowed.
+	AllowedMessageTypes []int
+
+	// ConnectionClosedHook is an optional function called when a proxied connection terminates,
+	// with the close code, the peer that initiated the close, and the data forwarded in each direction.
+	ConnectionClosedHook func(req *http.Request, info CloseInfo)
+
+	// AccessLog is an optional function called once per terminated connection,
+	// with a summary of the session, e.g. to write an access log line.
+	AccessLog func(entry AccessLogEntry)
+
+	// Authorize is an optional function called before dialing the backend.
+	// A non-nil error rejects the request through the error handler, with AuthorizeStatus,
+	// and no backend connection is made.
+	// An *AuthFailureError reports that Authorize failed to decide, and is handled according to AuthFailurePolicy.
+	Authorize func(req *http.Request) error
+
+	// AuthorizeStatus is the status code of the requests rejected by Authorize.
+	// If zero, http.StatusForbidden is used.
+	AuthorizeStatus int
+
+	// AuthFailurePolicy selects the outcome of the requests for which Authorize returns an *AuthFailureError.
+	// If zero, FailClosed is used.
+	AuthFailurePolicy AuthFailurePolicy
+
+	// SubprotocolValidator is an optional function called once the backend accepted the handshake,
+	// with the subprotocols offered by the client and the one selected by the backend, empty if none.
+	// A non-nil error aborts the upgrade through the error handler, e.g. when the backend selected no subprotocol.
+	SubprotocolValidator func(offered []string, selected string) error
+
+	// AllowedSubprotocols are the subprotocols the clients can negotiate with the backend:
+	// the other subprotocols are removed from the offer of the client before the dial.
+	// A client offering none of them is rejected with a 400 Bad Request, a client offering no subprotocol is proxied.
+	// If empty, the offer of the client is forwarded unchanged.
+	AllowedSubprotocols []string
+
+	// StrictExtensions rejects the upgrade when the backend selects an extension the proxy didn't offer,
+	// which would corrupt the frames of the connection, with a *HandshakeError through the error handler.
+	// The extensions of the client are negotiated by the proxy itself, and are always among the offered ones.
+	StrictExtensions bool
+
+	// PostUpgradeCheck is an optional function called once the client connection is upgraded,
+	// before any message is relayed.
+	// A non-nil error rejects the connection with a close frame,
+	// as an HTTP status can no longer be written at that point.
+	PostUpgradeCheck func(req *http.Request, conn *websocket.Conn) error
+
+	// ConfigureClientConn is an optional function setting the options of the client connection once upgraded,
+	// e.g. its read limit, before any message is relayed.
+	ConfigureClientConn func(conn *websocket.Conn)
+
+	// ConfigureBackendConn is an optional function setting the options of each backend connection once dialed,
+	// including the redials of ReconnectBackend, before any message is relayed.
+	ConfigureBackendConn func(conn *websocket.Conn)
+
+	// RejectCloseCode is the close code sent to the client when a connection is rejected after the upgrade.
+	// If zero, websocket.CloseTryAgainLater is used.
+	RejectCloseCode int
+
+	// RejectCloseReason is the close reason sent to the client when a connection is rejected after the upgrade.
+	// If empty, the rejection error message is used.
+	RejectCloseReason string
+
+	// ClosePropagation selects the peers receiving a close frame when the proxy terminates a connection,
+	// on limits, on rejections after the upgrade, or on CloseConnectionWithReason.
+	ClosePropagation ClosePropagation
+
+	// RelayHandshakeStatus relays a backend handshake rejection, e.g. a 401 Unauthorized,
+	// through the response writer, with its status code, its end-to-end headers and its body.
+	// Otherwise, the raw backend response is written to the hijacked client connection.
+	RelayHandshakeStatus bool
+
+	// PreserveTrailers relays the trailers of a backend handshake rejection relayed by RelayHandshakeStatus,
+	// filtered like the headers, after its body. Otherwise, they are dropped.
+	// A 101 Switching Protocols response has no body, hence no trailers, so most handshakes have none.
+	// The trailers of a rejection are only read when its body fits in the 1024 bytes kept by the dialer.
+	PreserveTrailers bool
+
+	// OnDialError is an optional function called when dialing the backend fails,
+	// with the category of the error.
+	OnDialError func(req *http.Request, category DialErrorCategory, err error)
+
+	// RejectionHandler is an optional function handling the backend handshake rejections, e.g. a 401 Unauthorized,
+	// with the response of the backend, so it can relay some of its headers, like WWW-Authenticate or Retry-After.
+	// When set, it answers the client instead of the relay of the backend response, even with RelayHandshakeStatus.
+	// The error is a *ProxyError of kind ErrHandshakeRejected.
+	// The response body holds at most the first 1024 bytes of the body of the backend.
+	RejectionHandler func(rw http.ResponseWriter, req *http.Request, resp *http.Response, err error)
+
 	// ErrorHandler is an optional function that handles errors
 	// reaching the backend or errors from ModifyResponse.
 	//
-	// If nil, the default is to log the provided error and return
-	// a 502 Status Bad Gateway response.
+	// If nil, the default is to log the provided error and return a response
+	// with the status code of a *StatusError, e.g. 403, 404 or 503, or else a 502 Status Bad Gateway.
 	ErrorHandler func(rw http.ResponseWriter, req *http.Request, err error)
 	Logger       logger
+
+	// LogLevel selects the events logged through Logger, or through the standard logger if Logger is nil.
+	// It does not apply to the StructuredLogger, filtered by its handler.
+	// If zero, LogInfo is used.
+	LogLevel LogLevel
+
+	// Picker is an optional picker of the backends, e.g. a ConsistentHashPicker for sticky sessions,
+	// a WeightedRoundRobinPicker for backends of different capacities,
+	// an OriginPicker for a backend per Origin, or a Router for a backend per path or header.
+	// The picked backend replaces the scheme and the host set by the Director,
+	// unless the connection config sets a target.
+	// A picker error is reported with a 503 status code, unless it is a *StatusError setting another one.
+	Picker Picker
+
+	// ConfigResolver is an optional function resolving the configuration of a connection,
+	// e.g. per tenant, when the client connects.
+	// A nil config keeps the settings of the proxy.
+	// A non-nil error rejects the request through the error handler, with the status code of a *StatusError.
+	ConfigResolver func(req *http.Request) (*ConnConfig, error)
+
+	// TracerProvider provides the tracer of the spans of the proxied connections.
+	// A span covers a connection, from the request to the close, and is a child
+	// of the trace context of the request headers, if any.
+	// The trace context is injected in the headers of the backend request.
+	// If nil, no span is created.
+	TracerProvider trace.TracerProvider
+
+	// Propagator extracts and injects the trace context.
+	// If nil, the W3C trace context is used.
+	Propagator propagation.TextMapPropagator
+
+	// CircuitBreaker sheds the load of the backends failing to be dialed.
+	// If nil, the backends are always dialed.
+	CircuitBreaker *CircuitBreaker
+
+	breakersMu sync.Mutex
+	breakers   map[string]*breaker
+
+	// Metrics collects the metrics of the proxy.
+	// If it implements CompressionMetrics, it also collects the compression stats of the connections.
+	// If nil, no metrics are collected.
+	Metrics Metrics
+
+	// Resumption issues resumption tokens, routing the reconnections to the same backend.
+	// If nil, no token is issued.
+	Resumption *Resumption
+
+	// RateLimit limits, per connection, the messages forwarded from the client to the backend.
+	RateLimit *RateLimit
+
+	// GlobalRateLimit limits the messages forwarded from the clients to the backends,
+	// shared across all the connections of the proxy.
+	GlobalRateLimit *RateLimit
+
+	// OnThrottle is called when a message of the client is delayed by RateLimit or GlobalRateLimit,
+	// with the delay, before the message is forwarded.
+	// It is called on the goroutine reading the client, so it must not block.
+	OnThrottle func(req *http.Request, delay time.Duration)
+
+	globalLimiterOnce sync.Once
+	globalLimiter     *rateLimiter
+
+	// MaxMessagesPerConnection is the maximum number of messages, in both directions, carried by a connection.
+	// When a message exceeds the limit, it is not forwarded,
+	// and the connection is closed with websocket.ClosePolicyViolation.
+	// If zero, there is no limit.
+	MaxMessagesPerConnection int64
+
+	// MaxConnectionLifetime is the maximum duration of a connection, regardless of its activity,
+	// e.g. to spread the clients across the backends during deploys.
+	// Once exceeded, the connection is closed with MaxConnectionLifetimeCloseCode.
+	// If zero, there is no limit.
+	MaxConnectionLifetime time.Duration
+
+	// MaxConnectionLifetimeCloseCode is the close code of the connections exceeding MaxConnectionLifetime.
+	// If zero, websocket.CloseGoingAway is used.
+	MaxConnectionLifetimeCloseCode int
+
+	// FirstMessageTimeout is the maximum delay between the upgrade and the first message of the client,
+	// e.g. to shed the clients that connect and never send the authentication message of the protocol.
+	// Once exceeded, the connection is closed with FirstMessageTimeoutCloseCode.
+	// If zero, there is no limit.
+	FirstMessageTimeout time.Duration
+
+	// FirstMessageTimeoutCloseCode is the close code of the connections exceeding FirstMessageTimeout.
+	// If zero, websocket.ClosePolicyViolation is used.
+	FirstMessageTimeoutCloseCode int
+
+	// PingInterval is the interval of the pings sent by the proxy to both peers of the connections,
+	// e.g. to keep them alive through the load balancers closing the idle connections.
+	// The pongs answering them are not forwarded.
+	// If zero, the proxy sends no ping, but the ones of the peers are forwarded.
+	PingInterval time.Duration
+
+	// PingJitter is the maximum random delay added to each PingInterval,
+	// which spreads the pings of the connections opened at once.
+	// If zero, a tenth of PingInterval is used. If negative, there is no jitter.
+	PingJitter time.Duration
+
+	// WriteTimeout is the maximum duration of the write of a message to a peer,
+	// e.g. to shed the clients that stop reading, which would otherwise stall the messages of their backend.
+	// A streamed message is bounded part by part: the time spent reading it from the other peer is not counted.
+	// Once exceeded, the connection is closed with websocket.ClosePolicyViolation.
+	// If zero, there is no limit.
+	WriteTimeout time.Duration
+
+	// ReconnectBackend, if set, redials the backend when its connection drops while the client is connected.
+	ReconnectBackend *ReconnectBackend
+
+	// MaxUpgradesInFlight is the maximum number of requests being upgraded at once,
+	// from their admission to the end of the upgrade, including the dial of the backend.
+	// The excess requests are rejected with a 503 Service Unavailable.
+	// It doesn't limit the established connections.
+	// If zero, there is no limit.
+	MaxUpgradesInFlight int
+
+	upgradesOnce sync.Once
+	upgrades     chan struct{}
+
+	// MaxConnections is the maximum number of connections proxied at once, from their admission to their termination.
+	// The excess requests are rejected with a 503 Service Unavailable, unless ConnectionQueue queues them.
+	// If zero, there is no limit.
+	MaxConnections int
+
+	// ConnectionQueue, if set, queues the requests exceeding MaxConnections instead of rejecting them.
+	ConnectionQueue *ConnectionQueue
+
+	connectionSlotsOnce sync.Once
+	connectionSlots     *connectionSlots
+
+	// AllowedClientCIDRs restricts the clients to the IP ranges in CIDR notation, e.g. "10.0.0.0/8".
+	// The other requests are rejected with a 403 Forbidden, before the backend is dialed.
+	// The ranges are parsed once, by Validate or else by the first request, and must not change afterwards.
+	// Validate reports an invalid range; otherwise, all the requests are rejected with a 403 Forbidden.
+	// If empty, all the clients are allowed.
+	AllowedClientCIDRs []string
+
+	// TrustForwardedFor checks AllowedClientCIDRs against the last address of the X-Forwarded-For header,
+	// set by a trusted proxy in front of this one, instead of the remote address.
+	TrustForwardedFor bool
+
+	clientNetsOnce sync.Once
+	clientNets     []*net.IPNet
+	clientNetsErr  error
+
+	// CopyBufferSize is the size of the buffers used to copy the messages streamed between the peers,
+	// the ones larger than 1KB. Buffers are pooled and reused across messages.
+	// If zero, 32KB buffers are used.
+	CopyBufferSize int
+
+	copyBuffers sync.Pool
+
+	// NewConnID generates the ids of the connections, e.g. ULIDs matching the format of a tracing system.
+	// The id of a connection is in the context of the request passed to the hooks, see FromContext,
+	// and in the ConnectionInfo of the active connections.
+	// The ids must be unique among the active connections.
+	// If nil, random UUIDs are used.
+	NewConnID func() string
+
+	connsMu sync.Mutex
+	conns   map[string]*connection
+
+	// StatsLogInterval is the interval at which a summary of the active connections,
+	// the forwarded bytes and the dial failures since the previous summary is logged.
+	// If zero, no summary is logged.
+	StatsLogInterval time.Duration
+
+	shuttingDown bool
+	draining     bool
+
+	// Clock is the source of time of the timeouts of the proxy.
+	// If nil, the real time is used.
+	Clock Clock
+
+	// ctx is the parent context of the connections, set by NewSingleHostReverseProxyContext.
+	ctx context.Context
+
+	stats          proxyStats
+	backgroundOnce sync.Once
+	shutdownOnce   sync.Once
+	doneMu         sync.Mutex
+	done           chan struct{}
+
+	// StructuredLogger is an optional structured logger.
+	// When set, it takes precedence over Logger and events are emitted
+	// with attributes such as remote_addr, target, status and close_code.
+	StructuredLogger *slog.Logger
+}
+
+// withParentContext returns the request with a context also canceled with the parent context of the proxy,
+// and the function releasing the resources of this context.
+func (p *ReverseProxy) withParentContext(req *http.Request) (*http.Request, func()) {
+	if p.ctx == nil {
+		return req, func() {}
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	stop := context.AfterFunc(p.ctx, cancel)
+
+	return req.WithContext(ctx), func() {
+		stop()
+		cancel()
+	}
 }
 
 func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	dialer := p.Dialer
-	if dialer == nil {
-		dialer = websocket.DefaultDialer
+	p.startBackground()
+
+	req, stop := p.withParentContext(req)
+	defer stop()
+
+	req, span := p.startSpan(req)
+	defer span.end()
+
+	meta := &Metadata{ConnectionID: p.newConnID(), StartTime: time.Now()}
+	req = req.WithContext(withMetadata(req.Context(), meta))
+
+	if err := p.checkClientIP(req); err != nil {
+		level := slog.LevelInfo
+		if !errors.Is(err, ErrClientNotAllowed) {
+			level = slog.LevelError
+		}
+		p.logEvent(req.Context(), level, "websocket: Client not allowed",
+			remoteAddrAttr(req), errorAttr(err))
+		span.fail(err)
+		p.getErrorHandler()(rw, req, err)
+		return
 	}
 
-	outReq := new(http.Request)
-	*outReq = *req
+	if !isWebsocketRequest(req) {
+		// avoid a pointless backend connection.
+		rw.Header().Set(Upgrade, "websocket")
+		rw.Header().Set(Connection, "Upgrade")
+		http.Error(rw, http.StatusText(http.StatusUpgradeRequired), http.StatusUpgradeRequired)
+		return
+	}
 
-	outReq.Header = make(http.Header)
-	copyHeader(outReq.Header, req.Header)
+	if err := checkClientHandshake(req); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	p.Director(outReq)
+	if err := checkHeaderSize(req, p.MaxHeaderBytes); err != nil {
+		p.logEvent(req.Context(), slog.LevelInfo, "websocket: Request headers too large",
+			remoteAddrAttr(req), errorAttr(err))
+		span.fail(err)
+		p.getErrorHandler()(rw, req, err)
+		return
+	}
 
-	removeHeaders(outReq.Header, WebsocketDialHeaders)
+	if err := checkSubprotocols(req, p.AllowedSubprotocols); err != nil {
+		p.logEvent(req.Context(), slog.LevelInfo, "websocket: Subprotocols not allowed",
+			remoteAddrAttr(req), slog.Any("subprotocols", websocket.Subprotocols(req)), errorAttr(err))
+		span.fail(err)
+		p.getErrorHandler()(rw, req, err)
+		return
+	}
+
+	if p.StripPrefix != "" && !hasPathPrefix(req.URL.Path, p.StripPrefix) {
+		http.NotFound(rw, req)
+		return
+	}
+
+	if err := p.admit(); err != nil {
+		p.getErrorHandler()(rw, req, &StatusError{Status: http.StatusServiceUnavailable, Err: err})
+		return
+	}
 
-	targetConn, resp, err := dialer.DialContext(outReq.Context(), outReq.URL.String(), outReq.Header)
+	releaseConnection, err := p.acquireConnection(req.Context())
 	if err != nil {
-		p.handleDialError(rw, req, outReq, resp, err)
+		p.logEvent(req.Context(), slog.LevelWarn, "websocket: Connection refused",
+			remoteAddrAttr(req), errorAttr(err))
+		span.fail(err)
+		p.getErrorHandler()(rw, req, &StatusError{Status: http.StatusServiceUnavailable, Err: err})
 		return
 	}
+	defer releaseConnection()
 
-	// Only the targetConn choose to CheckOrigin or not
-	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
-		return true
-	}}
+	releaseUpgrade, ok := p.acquireUpgrade()
+	if !ok {
+		span.fail(ErrTooManyUpgrades)
+		p.getErrorHandler()(rw, req, &StatusError{Status: http.StatusServiceUnavailable, Err: ErrTooManyUpgrades})
+		return
+	}
+	defer releaseUpgrade()
 
-	removeConnectionHeaders(resp.Header)
-	removeHeaders(resp.Header, hopHeaders)
-	copyHeader(resp.Header, rw.Header())
+	if p.Authorize != nil {
+		if err := p.authorize(req); err != nil {
+			span.fail(err)
+			p.getErrorHandler()(rw, req, err)
+			return
+		}
+	}
 
-	underlyingConn, err := upgrader.Upgrade(rw, req, resp.Header)
+	cfg, err := p.connConfig(req)
 	if err != nil {
-		p.logf("websocket: Error while upgrading connection : %v", err)
+		p.logEvent(req.Context(), slog.LevelError, "websocket: Error while resolving the connection config",
+			remoteAddrAttr(req), errorAttr(err))
+		span.fail(err)
+		p.getErrorHandler()(rw, req, err)
 		return
 	}
 
-	defer func() {
-		_ = underlyingConn.Close()
-		_ = targetConn.Close()
-		if p.WebsocketConnectionClosedHook != nil {
-			p.WebsocketConnectionClosedHook(req, underlyingConn.UnderlyingConn())
+	target, err := p.pickTarget(req, cfg)
+	if err != nil {
+		p.logEvent(req.Context(), slog.LevelError, "websocket: Error while picking the backend",
+			remoteAddrAttr(req), errorAttr(err))
+		span.fail(err)
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) {
+			err = &StatusError{Status: http.StatusServiceUnavailable, Err: err}
 		}
-	}()
+		p.getErrorHandler()(rw, req, err)
+		return
+	}
 
-	errClient := make(chan error, 1)
-	errBackend := make(chan error, 1)
+	if err := checkForceScheme(p.ForceScheme); err != nil {
+		p.logEvent(req.Context(), slog.LevelError, "websocket: Invalid backend scheme",
+			remoteAddrAttr(req), errorAttr(err))
+		span.fail(err)
+		p.getErrorHandler()(rw, req, &StatusError{Status: http.StatusInternalServerError, Err: err})
+		return
+	}
 
-	go replicateWebsocketConn(underlyingConn, targetConn, errClient)
-	go replicateWebsocketConn(targetConn, underlyingConn, errBackend)
+	outReq := p.newBackendRequest(req, target)
+	if p.RewriteURL != nil {
+		dialURL, err := p.RewriteURL(req)
+		if err != nil {
+			span.fail(err)
+			p.logEvent(req.Context(), slog.LevelError, "websocket: Error rewriting the backend URL",
+				remoteAddrAttr(req), errorAttr(err))
+			p.getErrorHandler()(rw, req, err)
+			return
+		}
+		outReq.URL = dialURL
+	}
+	span.inject(outReq)
 
-	var message string
-	select {
-	case err = <-errClient:
-		message = "websocket: Error when copying from backend to client: %v"
-	case err = <-errBackend:
-		message = "websocket: Error when copying from client to backend: %v"
+	resolved := *outReq.URL
+	meta.Target = &resolved
 
+	if p.CircuitBreaker != nil && !p.allowDial(outReq.URL) {
+		span.fail(ErrCircuitOpen)
+		p.getErrorHandler()(rw, req, &StatusError{Status: http.StatusServiceUnavailable, Err: ErrCircuitOpen})
+		return
 	}
-	if e, ok := err.(*websocket.CloseError); !ok || e.Code == websocket.CloseAbnormalClosure {
-		p.logf(message, err)
+
+	// the bytes of the compressed connections are counted to report the compression effectiveness.
+	var backendWire *wireCounter
+	if cfg.backendCompression(req) {
+		backendWire = &wireCounter{}
 	}
-}
 
-func (p *ReverseProxy) handleDialError(rw http.ResponseWriter, req, outReq *http.Request, resp *http.Response, err error) {
-	if resp == nil {
-		p.logf("websocket: Error dialing %q: %v", req.Host, err)
-		p.getErrorHandler()(rw, outReq, err)
+	dialStart := time.Now()
+	targetConn, resp, err := p.dial(req, outReq, cfg, backendWire)
+	span.event("dial", dialStart)
+	if p.CircuitBreaker != nil {
+		p.recordDialResult(req, outReq.URL, resp, err)
+	}
+	if err != nil {
+		span.fail(err)
+		p.handleDialError(rw, req, outReq, resp, err)
 		return
 	}
 
-	p.logf("websocket: Error dialing %q: %v with resp: %d %s", req.Host, err, resp.StatusCode, resp.Status)
-	hijacker, ok := rw.(http.Hijacker)
-	if !ok {
-		p.logf("websocket: %s can not be hijack", reflect.TypeOf(rw))
-		p.getErrorHandler()(rw, outReq, err)
+	err = validateBackendHandshake(resp, nil)
+	if err == nil && p.StrictExtensions {
+		err = checkBackendExtensions(resp, outReq)
+	}
+	if err != nil {
+		span.fail(err)
+		_ = targetConn.Close()
+		p.stats.incDialFailures()
+		p.metrics().IncDialError()
+		p.handleHandshakeError(rw, req, outReq, err)
 		return
 	}
 
-	conn, _, errHijack := hijacker.Hijack()
-	if errHijack != nil {
-		p.logf("websocket: Failed to hijack responseWriter")
-		p.getErrorHandler()(rw, outReq, errHijack)
-		return
+	if p.SubprotocolValidator != nil {
+		offered := websocket.Subprotocols(req)
+		selected := resp.Header.Get(SecWebsocketProtocol)
+		if err = p.callSubprotocolValidator(req, offered, selected); err != nil {
+			span.fail(err)
+			_ = targetConn.Close()
+			p.logEvent(req.Context(), slog.LevelError, "websocket: Subprotocol rejected",
+				remoteAddrAttr(req), targetAttr(outReq), slog.String("subprotocol", selected), errorAttr(err))
+			p.getErrorHandler()(rw, outReq, &ProxyError{Kind: ErrHandshakeRejected, Err: err})
+			return
+		}
 	}
-	defer func() { _ = conn.Close() }()
 
-	errWrite := resp.Write(conn)
-	if errWrite != nil {
-		p.logf("websocket: Failed to forward response")
-		p.getErrorHandler()(rw, outReq, errWrite)
+	// a reconnected backend must select the same extensions, removed from the response headers below.
+	var backendExtensions string
+	if p.ReconnectBackend != nil {
+		backendExtensions = extensionSet(resp.Header)
+	}
+
+	if backendWire != nil && (!hasExtension(resp.Header, permessageDeflate) || !backendWire.handshakeDone(targetConn)) {
+		backendWire = nil
+	}
+
+	var clientWire *wireCounter
+	if cfg.clientCompression(resp) && hasExtension(req.Header, permessageDeflate) {
+		clientWire = &wireCounter{}
+	}
+
+	upgrader := p.newUpgrader(cfg.clientCompression(resp))
+	upgrader.Error = func(rw http.ResponseWriter, _ *http.Request, status int, reason error) {
+		p.getErrorHandler()(rw, outReq, &StatusError{Status: status, Err: &ProxyError{Kind: ErrUpgradeFailed, Err: reason}})
+	}
+
+	// The backend response headers, including Set-Cookie, become the upgrade response headers,
+	// merged with the headers already set on rw.
+	stripped := p.headerStripped(req.Context(), "response")
+	removeConnectionHeaders(resp.Header, stripped)
+	removeHeaders(resp.Header, p.hopHeaders(), stripped)
+	removeHeaders(resp.Header, WebsocketDialHeaders, stripped)
+	filterHeaders(resp.Header, p.ResponseHeaderAllowlist, p.ResponseHeaderBlocklist)
+	copyHeader(resp.Header, rw.Header())
+
+	if p.Via != "" {
+		appendVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, p.Via)
+	}
+
+	if p.Resumption != nil {
+		p.issueResumption(resp.Header, outReq.URL)
+	}
+
+	upgradeStart := time.Now()
+	underlyingConn, err := upgrade(upgrader, rw, req, resp.Header, clientWire)
+	span.event("upgrade", upgradeStart)
+	releaseUpgrade()
+	if err != nil {
+		// the upgrader reported the failure to the error handler, unless the client connection was hijacked.
+		_ = targetConn.Close()
+		span.fail(err)
+		p.metrics().IncUpgradeError()
+		p.logEvent(req.Context(), slog.LevelError, "websocket: Error while upgrading connection",
+			remoteAddrAttr(req), targetAttr(outReq), errorAttr(err))
 		return
 	}
-}
 
-func (p *ReverseProxy) getErrorHandler() func(http.ResponseWriter, *http.Request, error) {
-	if p.ErrorHandler != nil {
-		return p.ErrorHandler
+	if clientWire != nil && !clientWire.handshakeDone(underlyingConn) {
+		clientWire = nil
 	}
-	return p.defaultErrorHandler
-}
 
-func (p *ReverseProxy) defaultErrorHandler(rw http.ResponseWriter, req *http.Request, err error) {
-	p.logf("http: proxy error: %v", err)
-	rw.WriteHeader(http.StatusBadGateway)
-}
+	p.setCompressionLevel(req, underlyingConn)
+	p.setCompressionLevel(req, targetConn)
+	p.configureConn(req, "ConfigureClientConn", p.ConfigureClientConn, underlyingConn)
+	p.configureConn(req, "ConfigureBackendConn", p.ConfigureBackendConn, targetConn)
 
-func (p *ReverseProxy) logf(format string, args ...interface{}) {
-	if p.Logger == nil {
-		log.Printf(format, args...)
+	conn := newConnection(req, outReq.URL.String(), underlyingConn, targetConn)
+	conn.limiters = p.rateLimiters(cfg.RateLimit)
+	conn.maxMessages = cfg.MaxMessagesPerConnection
+	conn.propagation = p.ClosePropagation
+	conn.clientWire = clientWire
+	conn.backendWire = backendWire
+	if p.CorrelationHeader != "" {
+		conn.correlationID = outReq.Header.Get(p.CorrelationHeader)
+	}
+	if p.ReconnectBackend != nil {
+		conn.link = newBackendLink(targetConn, p.ReconnectBackend.maxBufferedMessages(), backendExtensions)
 	}
-	p.Logger.Printf(format, args...)
-}
 
-func replicateWebsocketConn(dst, src *websocket.Conn, errc chan error) {
-	forward := func(messageType int, reader io.Reader) error {
-		writer, err := dst.NextWriter(messageType)
-		if err != nil {
-			return err
+	if !p.registerConnection(conn) {
+		conn.cancel()
+		p.rejectUpgraded(underlyingConn, targetConn, websocket.CloseGoingAway, ErrShuttingDown.Error())
+		_ = underlyingConn.Close()
+		_ = targetConn.Close()
+		return
+	}
+
+	closeInfo := CloseInfo{Code: websocket.CloseAbnormalClosure, Initiator: PeerProxy}
+	p.metrics().IncActive()
+	defer func() {
+		p.metrics().DecActive()
+		conn.cancel()
+		p.unregisterConnection(conn)
+		_ = underlyingConn.Close()
+		_ = targetConn.Close()
+		if conn.link != nil {
+			conn.link.close()
 		}
-		_, err = io.Copy(writer, reader)
-		if err != nil {
-			return err
+		closeInfo = conn.withForwarded(closeInfo)
+		closeInfo.CorrelationID = conn.correlationID
+		p.addCompressionMetrics(closeInfo)
+		if p.WebsocketConnectionClosedHook != nil {
+			p.callClosedHook(req, underlyingConn.UnderlyingConn())
+		}
+		if p.ConnectionClosedHook != nil {
+			p.callConnectionClosedHook(req, closeInfo)
+		}
+		if p.AccessLog != nil {
+			p.callAccessLog(conn, closeInfo)
+		}
+		span.closed(closeInfo)
+	}()
+
+	if p.PostUpgradeCheck != nil {
+		if err = p.callPostUpgradeCheck(req, underlyingConn); err != nil {
+			reason := p.RejectCloseReason
+			if reason == "" {
+				reason = err.Error()
+			}
+			p.logEvent(req.Context(), slog.LevelInfo, "websocket: Connection rejected after upgrade",
+				remoteAddrAttr(req), targetAttr(outReq), errorAttr(err))
+			closeInfo = p.rejectUpgraded(underlyingConn, targetConn, p.RejectCloseCode, reason)
+			return
 		}
-		return writer.Close()
 	}
 
-	src.SetPingHandler(func(data string) error {
-		return forward(websocket.PingMessage, bytes.NewReader([]byte(data)))
-	})
+	if p.MaxConnectionLifetime > 0 {
+		stopLifetime := p.clock().AfterFunc(p.MaxConnectionLifetime, func() {
+			conn.close(p.lifetimeCloseCode(), "connection lifetime exceeded")
+		})
+		defer stopLifetime()
+	}
 
-	src.SetPongHandler(func(data string) error {
-		return forward(websocket.PongMessage, bytes.NewReader([]byte(data)))
-	})
+	if p.FirstMessageTimeout > 0 {
+		conn.stopFirstMessageTimer = p.clock().AfterFunc(p.FirstMessageTimeout, func() {
+			conn.close(p.firstMessageCloseCode(), "first message timeout")
+		})
+		defer conn.stopFirstMessageTimer()
+	}
 
+	if p.PingInterval > 0 {
+		go p.keepalive(conn)
+	}
+
+	errClient := make(chan error, 1)
+	errBackend := make(chan error, 1)
+
+	if conn.link != nil {
+		go p.replicateReconnecting(conn, func() (*websocket.Conn, error) {
+			return p.redial(conn, req, outReq, cfg)
+		}, errClient)
+	} else {
+		go p.replicateWebsocketConn(conn, BackendToClient, underlyingConn, targetConn, errClient)
+	}
+	go p.replicateWebsocketConn(conn, ClientToBackend, targetConn, underlyingConn, errBackend)
+
+	var message string
+	var pending chan error
+	select {
+	case err = <-errClient:
+		message = "websocket: Error when copying from backend to client"
+		pending = errBackend
+		closeInfo = newCloseInfo(PeerBackend, err)
+	case err = <-errBackend:
+		message = "websocket: Error when copying from client to backend"
+		pending = errClient
+		closeInfo = newCloseInfo(PeerClient, err)
+	case <-req.Context().Done():
+		conn.close(websocket.CloseGoingAway, "context canceled")
+		closeInfo = conn.closeInfo
+		p.logEvent(req.Context(), slog.LevelDebug, "websocket: Connection closed on context cancellation",
+			remoteAddrAttr(req), targetAttr(outReq))
+		return
+	case <-conn.closing:
+		closeInfo = conn.closeInfo
+		p.logEvent(req.Context(), slog.LevelDebug, "websocket: Connection closed by the proxy",
+			remoteAddrAttr(req), targetAttr(outReq))
+		return
+	}
+
+	attrs := []slog.Attr{remoteAddrAttr(req), targetAttr(outReq)}
+	e, ok := err.(*websocket.CloseError)
+	if ok {
+		attrs = append(attrs, slog.Int("close_code", e.Code))
+		if e.Code != websocket.CloseAbnormalClosure {
+			waitCloseHandshake(pending)
+		}
+	}
+	if !ok || e.Code == websocket.CloseAbnormalClosure {
+		p.logEvent(req.Context(), slog.LevelError, message, append(attrs, errorAttr(err))...)
+		return
+	}
+	p.logEvent(req.Context(), slog.LevelDebug, "websocket: Connection closed", attrs...)
+}
+
+// pickTarget returns the backend of the connection: the one of the config, else the one of the picker, if any.
+func (p *ReverseProxy) pickTarget(req *http.Request, cfg *ConnConfig) (*url.URL, error) {
+	if cfg.Target != nil || p.Picker == nil {
+		return cfg.Target, nil
+	}
+	return p.Picker.Pick(req)
+}
+
+// newBackendRequest returns the handshake request to the backend.
+// A non-nil target replaces the scheme and the host set by the Director.
+func (p *ReverseProxy) newBackendRequest(req *http.Request, target *url.URL) *http.Request {
+	outReq := new(http.Request)
+	*outReq = *req
+
+	outReq.Header = make(http.Header)
+	copyHeader(outReq.Header, req.Header)
+	// the backend handshake is an HTTP/1.1 upgrade, even for an extended CONNECT.
+	delete(outReq.Header, pseudoProtocol)
+
+	filterHeaders(outReq.Header, p.RequestHeaderAllowlist, p.RequestHeaderBlocklist)
+
+	if len(p.AllowedSubprotocols) > 0 {
+		if offered := filterSubprotocols(websocket.Subprotocols(req), p.AllowedSubprotocols); len(offered) > 0 {
+			outReq.Header.Set(SecWebsocketProtocol, strings.Join(offered, ", "))
+		} else {
+			outReq.Header.Del(SecWebsocketProtocol)
+		}
+	}
+
+	if p.StripPrefix != "" {
+		outReq.URL = stripPrefix(outReq.URL, p.StripPrefix)
+	}
+
+	p.Director(outReq)
+
+	if target != nil {
+		applyTarget(outReq, target)
+	}
+
+	if p.ForceScheme != "" {
+		u := *outReq.URL
+		u.Scheme = p.ForceScheme
+		outReq.URL = &u
+	}
+
+	removeHeaders(outReq.Header, WebsocketDialHeaders, p.headerStripped(req.Context(), "request"))
+
+	if p.CollapseSlashes {
+		outReq.URL.Path = collapseSlashes(outReq.URL.Path)
+		outReq.URL.RawPath = collapseSlashes(outReq.URL.RawPath)
+	}
+
+	if p.DefaultUserAgent != "" && outReq.Header.Get("User-Agent") == "" {
+		outReq.Header.Set("User-Agent", p.DefaultUserAgent)
+	}
+
+	if p.CorrelationHeader != "" {
+		id := req.Header.Get(p.CorrelationHeader)
+		if id == "" {
+			id = newUUID()
+		}
+		outReq.Header.Set(p.CorrelationHeader, id)
+	}
+
+	if p.PassHostHeader {
+		// the dialer derives the Host from the URL, unless it is set in the headers.
+		outReq.Header.Set("Host", req.Host)
+	}
+
+	if p.Via != "" {
+		appendVia(outReq.Header, req.ProtoMajor, req.ProtoMinor, p.Via)
+	}
+
+	if p.OmitForwardedFor {
+		outReq.Header.Del(XForwardedFor)
+	}
+
+	if p.HashedClientIPHeader != "" {
+		outReq.Header.Set(p.HashedClientIPHeader, hashClientIP(clientIP(req), p.ClientIPHashSalt))
+	}
+
+	if p.Resumption != nil {
+		p.resume(req, outReq)
+	}
+
+	return outReq
+}
+
+// dial dials the backend of the request, counting the bytes of the connection with wire, if set.
+func (p *ReverseProxy) dial(req, outReq *http.Request, cfg *ConnConfig, wire *wireCounter) (*websocket.Conn, *http.Response, error) {
+	dialer, dialURL := p.newDialer(req, outReq, cfg.backendCompression(req), wire)
+
+	ctx, cancel := cfg.dialContext(outReq.Context())
+	defer cancel()
+
+	header := outReq.Header
+	if p.ConfigureDialHeaders != nil {
+		// the headers of the request are kept for the redials.
+		header = header.Clone()
+		p.ConfigureDialHeaders(header)
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, dialURL.String(), header)
+	if err == nil && conn == nil {
+		// a misbehaving dialer.
+		err = errNilConn
+	}
+	return conn, resp, err
+}
+
+// newDialer returns the dialer and the URL used to dial the backend, offering permessage-deflate if compression is set.
+// The bytes of the connections of a websocket.Dialer are counted by wire, if set.
+func (p *ReverseProxy) newDialer(req, outReq *http.Request, compression bool, wire *wireCounter) (Dialer, *url.URL) {
+	dialer := p.Dialer
+	if p.DialerFunc != nil {
+		if d := p.DialerFunc(req); d != nil {
+			dialer = d
+		}
+	}
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+
+	dialURL := outReq.URL
+
+	d, ok := dialer.(*websocket.Dialer)
+	if !ok {
+		return dialer, dialURL
+	}
+
+	if compression || p.ReadBufferSize > 0 || p.WriteBufferSize > 0 || p.NetDialContext != nil || p.LocalAddr != nil ||
+		p.SendProxyProtocol != 0 || wire != nil {
+		clone := *d
+		clone.EnableCompression = clone.EnableCompression || compression
+		if p.ReadBufferSize > 0 {
+			clone.ReadBufferSize = p.ReadBufferSize
+		}
+		if p.WriteBufferSize > 0 {
+			clone.WriteBufferSize = p.WriteBufferSize
+		}
+		p.applyNetDial(&clone)
+		if p.SendProxyProtocol != 0 {
+			applyProxyProtocol(&clone, req, p.SendProxyProtocol)
+		}
+		if wire != nil {
+			countWire(&clone, wire)
+		}
+		d = &clone
+	}
+
+	if p.LegacyBackendMode {
+		d, dialURL = newLegacyDialer(d, outReq.URL)
+	}
+	return d, dialURL
+}
+
+// headerStripped returns the function reporting the headers stripped at the location to OnHeaderStripped,
+// or nil if OnHeaderStripped is not set.
+func (p *ReverseProxy) headerStripped(ctx context.Context, location string) func(name, value string) {
+	if p.OnHeaderStripped == nil {
+		return nil
+	}
+
+	return func(name, value string) {
+		p.callHook(ctx, "OnHeaderStripped", func() {
+			p.OnHeaderStripped(name, value, location)
+		})
+	}
+}
+
+func (p *ReverseProxy) hopHeaders() []string {
+	if p.HopHeaders != nil {
+		return p.HopHeaders
+	}
+	return hopHeaders
+}
+
+// applyNetDial applies NetDialContext and LocalAddr to the dialer.
+func (p *ReverseProxy) applyNetDial(d *websocket.Dialer) {
+	switch {
+	case p.NetDialContext != nil:
+		d.NetDial = nil
+		d.NetDialContext = p.NetDialContext
+		d.Proxy = nil
+	case p.LocalAddr != nil:
+		// the proxy of the dialer, if any, is dialed from the local address too.
+		d.NetDial = nil
+		d.NetDialContext = (&net.Dialer{LocalAddr: p.LocalAddr}).DialContext
+	}
+}
+
+// newUpgrader returns the upgrader of the client connection, negotiating permessage-deflate if compression is set.
+func (p *ReverseProxy) newUpgrader(compression bool) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		// Only the targetConn choose to CheckOrigin or not
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		EnableCompression: compression,
+		ReadBufferSize:    p.ReadBufferSize,
+		WriteBufferSize:   p.WriteBufferSize,
+	}
+}
+
+func (p *ReverseProxy) handleDialError(rw http.ResponseWriter, req, outReq *http.Request, resp *http.Response, err error) {
+	ctx := req.Context()
+	p.stats.incDialFailures()
+	p.metrics().IncDialError()
+
+	if resp != nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		// the backend did upgrade, forwarding the response would break the client session.
+		p.handleHandshakeError(rw, req, outReq, validateBackendHandshake(resp, err))
+		return
+	}
+
+	p.notifyDialError(req, classifyDialError(err, resp), err)
+
+	if resp == nil {
+		p.logEvent(ctx, slog.LevelError, "websocket: Error dialing",
+			remoteAddrAttr(req), targetAttr(outReq), errorAttr(err))
+		p.getErrorHandler()(rw, outReq, &ProxyError{Kind: ErrDialFailed, Err: err})
+		return
+	}
+
+	p.logEvent(ctx, slog.LevelError, "websocket: Error dialing",
+		remoteAddrAttr(req), targetAttr(outReq), slog.Int("status", resp.StatusCode), errorAttr(err))
+
+	if p.RejectionHandler != nil {
+		p.RejectionHandler(rw, outReq, resp, &ProxyError{Kind: ErrHandshakeRejected, Err: err})
+		return
+	}
+
+	// an HTTP/2 stream can not be hijacked to write the response as is.
+	if p.RelayHandshakeStatus || isExtendedConnect(req) {
+		p.relayResponse(rw, req, resp)
+		return
+	}
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		p.logEvent(ctx, slog.LevelError, fmt.Sprintf("websocket: %s can not be hijack", reflect.TypeOf(rw)),
+			remoteAddrAttr(req))
+		p.getErrorHandler()(rw, outReq, &ProxyError{Kind: ErrHandshakeRejected, Err: err})
+		return
+	}
+
+	conn, _, errHijack := hijacker.Hijack()
+	if errHijack != nil {
+		p.logEvent(ctx, slog.LevelError, "websocket: Failed to hijack responseWriter",
+			remoteAddrAttr(req), errorAttr(errHijack))
+		p.getErrorHandler()(rw, outReq, errHijack)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	errWrite := resp.Write(conn)
+	if errWrite != nil {
+		p.logEvent(ctx, slog.LevelError, "websocket: Failed to forward response",
+			remoteAddrAttr(req), slog.Int("status", resp.StatusCode), errorAttr(errWrite))
+		p.getErrorHandler()(rw, outReq, errWrite)
+		return
+	}
+}
+
+func (p *ReverseProxy) callClosedHook(req *http.Request, conn net.Conn) {
+	p.callHook(req.Context(), "WebsocketConnectionClosedHook", func() {
+		p.WebsocketConnectionClosedHook(req, conn)
+	})
+}
+
+func (p *ReverseProxy) callConnectionClosedHook(req *http.Request, info CloseInfo) {
+	p.callHook(req.Context(), "ConnectionClosedHook", func() {
+		p.ConnectionClosedHook(req, info)
+	})
+}
+
+func (p *ReverseProxy) notifyDialError(req *http.Request, category DialErrorCategory, err error) {
+	if p.OnDialError == nil {
+		return
+	}
+
+	p.callHook(req.Context(), "OnDialError", func() {
+		p.OnDialError(req, category, err)
+	})
+}
+
+// configureConn calls the function configuring the connection, if any.
+func (p *ReverseProxy) configureConn(req *http.Request, name string, configure func(conn *websocket.Conn), conn *websocket.Conn) {
+	if configure == nil {
+		return
+	}
+	p.callHook(req.Context(), name, func() {
+		configure(conn)
+	})
+}
+
+// callHook calls a hook, recovering from a panic.
+func (p *ReverseProxy) callHook(ctx context.Context, name string, hook func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.logPanic(ctx, name, r)
+		}
+	}()
+
+	hook()
+}
+
+// callAuthorize calls Authorize, a panic denies the request.
+func (p *ReverseProxy) callAuthorize(req *http.Request) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.logPanic(req.Context(), "Authorize", r)
+			err = errPanic
+		}
+	}()
+
+	return p.Authorize(req)
+}
+
+// callSubprotocolValidator calls SubprotocolValidator, a panic rejects the subprotocol.
+func (p *ReverseProxy) callSubprotocolValidator(req *http.Request, offered []string, selected string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.logPanic(req.Context(), "SubprotocolValidator", r)
+			err = errPanic
+		}
+	}()
+
+	return p.SubprotocolValidator(offered, selected)
+}
+
+func (p *ReverseProxy) authorizeStatus() int {
+	if p.AuthorizeStatus == 0 {
+		return http.StatusForbidden
+	}
+	return p.AuthorizeStatus
+}
+
+func (p *ReverseProxy) firstMessageCloseCode() int {
+	if p.FirstMessageTimeoutCloseCode == 0 {
+		return websocket.ClosePolicyViolation
+	}
+	return p.FirstMessageTimeoutCloseCode
+}
+
+func (p *ReverseProxy) lifetimeCloseCode() int {
+	if p.MaxConnectionLifetimeCloseCode == 0 {
+		return websocket.CloseGoingAway
+	}
+	return p.MaxConnectionLifetimeCloseCode
+}
+
+func (p *ReverseProxy) callTap(ctx context.Context, dir Direction, messageType int, data []byte) {
+	p.callHook(ctx, "Tap", func() {
+		p.Tap(dir, messageType, data)
+	})
+}
+
+func (p *ReverseProxy) callPostUpgradeCheck(req *http.Request, conn *websocket.Conn) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.logPanic(req.Context(), "PostUpgradeCheck", r)
+			err = errPanic
+		}
+	}()
+
+	return p.PostUpgradeCheck(req, conn)
+}
+
+func (p *ReverseProxy) logPanic(ctx context.Context, where string, r interface{}) {
+	p.logEvent(ctx, slog.LevelError, "websocket: Recovered from panic",
+		slog.String("in", where), slog.Any("panic", r), slog.String("stack", string(debug.Stack())))
+}
+
+// rejectUpgraded rejects an already upgraded client connection with a close frame,
+// and notifies the backend that the proxy is going away, according to the close propagation.
+// If code is zero, websocket.CloseTryAgainLater is used.
+// It returns the close sent to the client.
+func (p *ReverseProxy) rejectUpgraded(clientConn, backendConn *websocket.Conn, code int, reason string) CloseInfo {
+	if code == 0 {
+		code = websocket.CloseTryAgainLater
+	}
+
+	p.ClosePropagation.sendClose(clientConn, backendConn,
+		formatCloseMessage(code, reason), formatCloseMessage(websocket.CloseGoingAway, ""))
+
+	return CloseInfo{Code: code, Text: reason, Initiator: PeerProxy}
+}
+
+// relayResponse relays the backend handshake rejection through the response writer:
+// its status code, its end-to-end headers and its body.
+func (p *ReverseProxy) relayResponse(rw http.ResponseWriter, req *http.Request, resp *http.Response) {
+	stripped := p.headerStripped(req.Context(), "response")
+	removeConnectionHeaders(resp.Header, stripped)
+	removeHeaders(resp.Header, p.hopHeaders(), stripped)
+	removeHeaders(resp.Header, WebsocketDialHeaders, stripped)
+	filterHeaders(resp.Header, p.ResponseHeaderAllowlist, p.ResponseHeaderBlocklist)
+	// the dialer may have truncated the body.
+	resp.Header.Del("Content-Length")
+	copyHeader(rw.Header(), resp.Header)
+
+	// the trailers are announced before the status, to be sent after the body.
+	trailers := p.relayedTrailers(resp)
+	for _, k := range trailers {
+		rw.Header().Add("Trailer", k)
+	}
+
+	rw.WriteHeader(resp.StatusCode)
+	if resp.Body == nil {
+		return
+	}
+
+	if _, err := io.Copy(rw, resp.Body); err != nil {
+		p.logEvent(req.Context(), slog.LevelError, "websocket: Failed to forward response",
+			remoteAddrAttr(req), slog.Int("status", resp.StatusCode), errorAttr(err))
+		return
+	}
+
+	for _, k := range trailers {
+		for _, v := range resp.Trailer[k] {
+			rw.Header().Add(k, v)
+		}
+	}
+}
+
+// relayedTrailers returns the names of the trailers of the response relayed to the client.
+func (p *ReverseProxy) relayedTrailers(resp *http.Response) []string {
+	if !p.PreserveTrailers || len(resp.Trailer) == 0 {
+		return nil
+	}
+
+	// the trailers are read with the body, by the dialer.
+	header := make(http.Header, len(resp.Trailer))
+	for k, vv := range resp.Trailer {
+		if len(vv) > 0 {
+			header[k] = vv
+		}
+	}
+	filterHeaders(header, p.ResponseHeaderAllowlist, p.ResponseHeaderBlocklist)
+
+	names := make([]string, 0, len(header))
+	for k := range header {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *ReverseProxy) handleHandshakeError(rw http.ResponseWriter, req, outReq *http.Request, err error) {
+	p.notifyDialError(req, DialErrorHandshake, err)
+
+	p.logEvent(req.Context(), slog.LevelError, "websocket: Malformed backend handshake",
+		remoteAddrAttr(req), targetAttr(outReq), errorAttr(err))
+	p.getErrorHandler()(rw, outReq, &ProxyError{Kind: ErrHandshakeRejected, Err: err})
+}
+
+func (p *ReverseProxy) getErrorHandler() func(http.ResponseWriter, *http.Request, error) {
+	if p.ErrorHandler != nil {
+		return p.ErrorHandler
+	}
+	return p.defaultErrorHandler
+}
+
+func (p *ReverseProxy) defaultErrorHandler(rw http.ResponseWriter, req *http.Request, err error) {
+	p.logEvent(req.Context(), slog.LevelError, "http: proxy error", targetAttr(req), errorAttr(err))
+	rw.WriteHeader(errorStatus(err))
+}
+
+func (p *ReverseProxy) logf(format string, args ...interface{}) {
+	if p.Logger == nil {
+		log.Printf(format, args...)
+		return
+	}
+	p.Logger.Printf(format, args...)
+}
+
+// waitCloseHandshake gives the peer of a forwarded close frame a bounded delay to answer it,
+// so its answer is forwarded back before the connections are torn down.
+func waitCloseHandshake(pending chan error) {
+	timer := time.NewTimer(closeHandshakeTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-pending:
+	case <-timer.C:
+	}
+}
+
+// rateLimiters returns the limiters applied to a new connection.
+func (p *ReverseProxy) rateLimiters(rateLimit *RateLimit) []*rateLimiter {
+	p.globalLimiterOnce.Do(func() {
+		p.globalLimiter = newRateLimiter(p.GlobalRateLimit)
+	})
+
+	var limiters []*rateLimiter
+	if p.globalLimiter != nil {
+		limiters = append(limiters, p.globalLimiter)
+	}
+	if limiter := newRateLimiter(rateLimit); limiter != nil {
+		limiters = append(limiters, limiter)
+	}
+	return limiters
+}
+
+// Direction the direction of a message.
+type Direction int
+
+// Directions of the messages.
+const (
+	ClientToBackend Direction = iota
+	BackendToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToBackend {
+		return "client_to_backend"
+	}
+	return "backend_to_client"
+}
+
+// reverse returns the opposite direction.
+func (d Direction) reverse() Direction {
+	if d == ClientToBackend {
+		return BackendToClient
+	}
+	return ClientToBackend
+}
+
+func (p *ReverseProxy) replicateWebsocketConn(c *connection, dir Direction, dst, src *websocket.Conn, errc chan error) {
+	ctx := c.ctx
+	defer func() {
+		if r := recover(); r != nil {
+			p.logPanic(ctx, "replicateWebsocketConn", r)
+			_ = src.Close()
+
+			// the error channel may already hold the error that led to the panic.
+			select {
+			case errc <- errPanic:
+			default:
+			}
+		}
+	}()
+
+	if dst == nil || src == nil {
+		errc <- errNilConn
+		return
+	}
+
+	forcedType := p.ForceMessageType[dir]
+	transform := p.transform(dir)
+	peek := dir == ClientToBackend && p.PeekFirstMessage > 0 && p.OnFirstMessage != nil
+
+	send := forwardFunc(func(messageType int, reader io.Reader) (int64, error) {
+		if dir == ClientToBackend && c.link != nil {
+			return c.link.forward(p, messageType, reader)
+		}
+		return p.writeMessage(dst, messageType, reader)
+	})
+	if dir == ClientToBackend && p.CoalesceWindow > 0 {
+		send = newCoalescer(p, c, send).forward
+	}
+
+	forward := func(messageType int, reader io.Reader) (int64, error) {
+		if dir == ClientToBackend && isDataMessage(messageType) && !p.allowedMessageType(messageType) {
+			return 0, &messageTypeError{messageType: messageType}
+		}
+		if forcedType != 0 && isDataMessage(messageType) {
+			messageType = forcedType
+		}
+		if messageType != websocket.CloseMessage && c.isCloseSent(dir) {
+			// the destination is closing, and ignores the messages sent after its close frame.
+			return 0, nil
+		}
+		if peek && isDataMessage(messageType) {
+			peek = false
+			var err error
+			if reader, err = p.peekFirstMessage(c, reader); err != nil {
+				return 0, err
+			}
+		}
+		if transform != nil && isDataMessage(messageType) {
+			data, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return 0, err
+			}
+			if data, err = transform(messageType, data); err != nil {
+				return 0, &transformError{dir: dir, err: err}
+			}
+			reader = bytes.NewReader(data)
+		}
+
+		n, err := send(messageType, reader)
+		if err == websocket.ErrCloseSent && c.isCloseSent(dir) {
+			// the close frame was forwarded during the write.
+			return n, nil
+		}
+		if isDataMessage(messageType) && (err == nil || n > 0) {
+			c.addForwarded(dir, n)
+		}
+		if err != nil && n > 0 {
+			return n, &partialMessageError{written: n, err: err}
+		}
+		return n, err
+	}
+
+	// answers the close frame like the default handler,
+	// unless the close frame of the other peer was already forwarded to src.
+	src.SetCloseHandler(func(code int, _ string) error {
+		if c.markCloseSent(dir.reverse()) {
+			msg := []byte{}
+			if code != websocket.CloseNoStatusReceived {
+				msg = websocket.FormatCloseMessage(code, "")
+			}
+			_ = src.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeWriteTimeout))
+		}
+		return nil
+	})
+
+	src.SetPingHandler(func(data string) error {
+		_, err := forward(websocket.PingMessage, bytes.NewReader([]byte(data)))
+		return err
+	})
+
+	src.SetPongHandler(func(data string) error {
+		if p.PingInterval > 0 && data == keepalivePayload {
+			// answers a ping of the proxy.
+			return nil
+		}
+		_, err := forward(websocket.PongMessage, bytes.NewReader([]byte(data)))
+		return err
+	})
+
+	var limiters []*rateLimiter
+	if dir == ClientToBackend {
+		limiters = c.limiters
+	}
+
+	var err error
+	if p.instrumented(c, limiters) {
+		err = p.relayInstrumented(c, dir, limiters, src, forward)
+	} else {
+		err = p.relay(c, dir, src, forward)
+	}
+
+	if err != nil {
+		errc <- err
+	}
+}
+
+// peekFirstMessage hands the first bytes of the message to OnFirstMessage,
+// and returns the reader of the whole message, the peeked bytes followed by the rest.
+func (p *ReverseProxy) peekFirstMessage(c *connection, reader io.Reader) (io.Reader, error) {
+	head := make([]byte, p.PeekFirstMessage)
+	n, err := io.ReadFull(reader, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	p.callHook(c.ctx, "OnFirstMessage", func() {
+		p.OnFirstMessage(c.req, head)
+	})
+	return io.MultiReader(bytes.NewReader(head), reader), nil
+}
+
+// allowedMessageType reports whether the client can send data messages of the type.
+func (p *ReverseProxy) allowedMessageType(messageType int) bool {
+	if len(p.AllowedMessageTypes) == 0 {
+		return true
+	}
+
+	for _, t := range p.AllowedMessageTypes {
+		if t == messageType {
+			return true
+		}
+	}
+	return false
+}
+
+// transform returns the transform of the messages of the direction, if any.
+func (p *ReverseProxy) transform(dir Direction) func(messageType int, data []byte) ([]byte, error) {
+	if dir == ClientToBackend {
+		return p.TransformClientToBackend
+	}
+	return p.TransformBackendToClient
+}
+
+// isDataMessage reports whether the message type is a data message type.
+func isDataMessage(messageType int) bool {
+	return messageType == websocket.TextMessage || messageType == websocket.BinaryMessage
+}
+
+// forwardFunc forwards a message to the destination peer.
+type forwardFunc func(messageType int, reader io.Reader) (int64, error)
+
+// instrumented reports whether the messages require per-message accounting.
+func (p *ReverseProxy) instrumented(c *connection, limiters []*rateLimiter) bool {
+	return len(limiters) > 0 || c.maxMessages > 0 || p.StatsLogInterval > 0 || p.Tap != nil || p.Metrics != nil
+}
+
+// relay forwards the messages without any accounting, until an error occurs.
+// A nil error means the proxy closed the connection.
+func (p *ReverseProxy) relay(c *connection, dir Direction, src *websocket.Conn, forward forwardFunc) error {
 	for {
 		msgType, reader, err := src.NextReader()
+		if err != nil {
+			return forwardClose(c, dir, forward, err)
+		}
+		if dir == ClientToBackend {
+			c.messageReceived()
+		}
 
+		if _, err = forward(msgType, reader); err != nil {
+			return p.forwardError(c, dir, err)
+		}
+	}
+}
+
+// relayInstrumented forwards the messages, applying the limits, the stats and the metrics, until an error occurs.
+// A nil error means the proxy closed the connection.
+func (p *ReverseProxy) relayInstrumented(c *connection, dir Direction, limiters []*rateLimiter, src *websocket.Conn, forward forwardFunc) error {
+	var throttled func(time.Duration)
+	if p.OnThrottle != nil && len(limiters) > 0 {
+		throttled = func(delay time.Duration) {
+			p.callHook(c.ctx, "OnThrottle", func() {
+				p.OnThrottle(c.req, delay)
+			})
+		}
+	}
+
+	for {
+		msgType, reader, err := src.NextReader()
 		if err != nil {
-			m := websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("%v", err))
-			if e, ok := err.(*websocket.CloseError); ok {
-				if e.Code != websocket.CloseNoStatusReceived {
-					m = nil
-					// Following codes are not valid on the wire so just close the
-					// underlying TCP connection without sending a close frame.
-					if e.Code != websocket.CloseAbnormalClosure &&
-						e.Code != websocket.CloseTLSHandshake {
-
-						m = websocket.FormatCloseMessage(e.Code, e.Text)
-					}
-				}
-			}
-			errc <- err
-			if m != nil {
-				// FIXME manage error?
-				_ = forward(websocket.CloseMessage, bytes.NewReader(m))
+			return forwardClose(c, dir, forward, err)
+		}
+		if dir == ClientToBackend {
+			c.messageReceived()
+		}
+
+		if c.maxMessages > 0 && c.incMessages() > c.maxMessages {
+			c.close(websocket.ClosePolicyViolation, "message limit reached")
+			return nil
+		}
+
+		if err = waitMessage(c.ctx, limiters, throttled); err != nil {
+			return err
+		}
+
+		var data []byte
+		if p.Tap != nil {
+			if data, err = ioutil.ReadAll(reader); err != nil {
+				return err
 			}
-			break
+			reader = bytes.NewReader(data)
 		}
-		err = forward(msgType, reader)
+
+		n, err := forward(msgType, reader)
+		p.stats.addBytes(n)
 		if err != nil {
-			errc <- err
-			break
+			return p.forwardError(c, dir, err)
+		}
+
+		if p.Metrics != nil {
+			p.Metrics.AddMessages(dir, 1)
+			p.Metrics.AddBytes(dir, n)
+		}
+
+		if p.Tap != nil {
+			p.callTap(c.ctx, dir, msgType, data)
+		}
+
+		if err = waitBytes(c.ctx, limiters, n, throttled); err != nil {
+			return err
+		}
+	}
+}
+
+// forwardError handles an error forwarding a message, and returns the error to report.
+// A partially forwarded message leaves a truncated frame on the destination,
+// so the proxy closes the connection instead, as it does when the buffer of a reconnection is full,
+// when a write times out, or when a transform fails.
+func (p *ReverseProxy) forwardError(c *connection, dir Direction, err error) error {
+	if isTimeout(err) {
+		// the destination doesn't read its messages fast enough.
+		p.logEvent(c.ctx, slog.LevelWarn, "websocket: Write timeout",
+			remoteAddrAttr(c.req), slog.String("direction", dir.String()), errorAttr(err))
+		c.close(websocket.ClosePolicyViolation, "write timeout")
+		return nil
+	}
+
+	var typeErr *messageTypeError
+	if errors.As(err, &typeErr) {
+		p.logEvent(c.ctx, slog.LevelInfo, "websocket: Message type not allowed",
+			remoteAddrAttr(c.req), slog.Int("message_type", typeErr.messageType))
+		c.close(websocket.CloseUnsupportedData, "message type not allowed")
+		return nil
+	}
+
+	var transformErr *transformError
+	if errors.As(err, &transformErr) {
+		p.logEvent(c.ctx, slog.LevelWarn, "websocket: Message transform failed",
+			remoteAddrAttr(c.req), slog.String("direction", dir.String()), errorAttr(transformErr.err))
+		c.close(websocket.CloseInternalServerErr, "message transform failed")
+		return nil
+	}
+
+	if errors.Is(err, errReconnectBufferFull) {
+		p.logEvent(c.ctx, slog.LevelWarn, "websocket: Reconnection buffer full",
+			remoteAddrAttr(c.req), slog.String("target", c.target))
+		c.close(websocket.CloseTryAgainLater, "backend unavailable")
+		return nil
+	}
+
+	var partialErr *partialMessageError
+	if !errors.As(err, &partialErr) {
+		return err
+	}
+
+	p.logEvent(c.ctx, slog.LevelWarn, "websocket: Message partially forwarded",
+		remoteAddrAttr(c.req), slog.String("direction", dir.String()),
+		slog.Int64("bytes", partialErr.written), errorAttr(partialErr.err))
+	c.close(websocket.CloseInternalServerErr, "message truncated")
+	return nil
+}
+
+// forwardClose forwards the close matching the read error to the destination peer, and returns the error.
+// The close frame is forwarded before reporting, so the teardown doesn't truncate it.
+// A dropped backend being reconnected is not reported to the client.
+// A single close frame is sent to each peer: none is forwarded to a peer which already received one.
+func forwardClose(c *connection, dir Direction, forward forwardFunc, err error) error {
+	if c.link != nil && dir == BackendToClient && isTransientBackendError(err) {
+		return err
+	}
+
+	m := websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("%v", err))
+	if e, ok := err.(*websocket.CloseError); ok {
+		if e.Code != websocket.CloseNoStatusReceived {
+			m = nil
+			// Following codes are not valid on the wire so just close the
+			// underlying TCP connection without sending a close frame.
+			if e.Code != websocket.CloseAbnormalClosure &&
+				e.Code != websocket.CloseTLSHandshake {
+
+				m = websocket.FormatCloseMessage(e.Code, e.Text)
+			}
+		}
+	}
+	// a connection closed by the proxy has already sent its close frames.
+	if m != nil && !c.closed() && c.markCloseSent(dir) {
+		// FIXME manage error?
+		_, _ = forward(websocket.CloseMessage, bytes.NewReader(m))
+	}
+	return err
+}
+
+// writeMessage writes the message read from src to dst, and returns the number of bytes written.
+// The writes are bounded by WriteTimeout, which doesn't count the time spent reading from src.
+// A small message is read at once and written in a single frame,
+// which saves the overhead of a streaming writer for chatty protocols.
+func (p *ReverseProxy) writeMessage(dst *websocket.Conn, messageType int, src io.Reader) (int64, error) {
+	buf := smallBuffers.Get().(*[smallMessageSize]byte)
+	defer smallBuffers.Put(buf)
+
+	n, err := io.ReadFull(src, buf[:])
+	switch err {
+	case nil:
+		head := buf[:n]
+		if p.CompressionThreshold > smallMessageSize {
+			// the message is read up to the threshold, to know whether it reaches it.
+			var complete bool
+			if head, complete, err = readHead(head, src, p.CompressionThreshold); err != nil {
+				return 0, err
+			}
+			if complete {
+				p.enableWriteCompression(dst, len(head))
+				return p.writeFrame(dst, messageType, head)
+			}
+		}
+		// the streamed message reaches the threshold.
+		p.enableWriteCompression(dst, p.CompressionThreshold)
+		return p.streamMessage(dst, messageType, head, src)
+	case io.EOF, io.ErrUnexpectedEOF:
+		// the whole message fits in the buffer.
+		p.enableWriteCompression(dst, n)
+		return p.writeFrame(dst, messageType, buf[:n])
+	default:
+		// nothing was written yet.
+		return 0, err
+	}
+}
+
+// writeFrame writes the message in a single frame.
+// The write is all or nothing: no byte is reported as written when it fails.
+func (p *ReverseProxy) writeFrame(dst *websocket.Conn, messageType int, data []byte) (int64, error) {
+	if err := p.setWriteDeadline(dst); err != nil {
+		return 0, err
+	}
+	if err := dst.WriteMessage(messageType, data); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// streamMessage writes the message, made of head followed by what is read from src, to dst through a streaming writer.
+func (p *ReverseProxy) streamMessage(dst *websocket.Conn, messageType int, head []byte, src io.Reader) (int64, error) {
+	writer, err := dst.NextWriter(messageType)
+	if err != nil {
+		return 0, err
+	}
+	if p.WriteTimeout > 0 {
+		writer = &deadlineWriter{WriteCloser: writer, p: p, conn: dst}
+	}
+
+	written, err := writer.Write(head)
+	if err != nil {
+		return int64(written), err
+	}
+
+	n, err := p.copyMessage(writer, src)
+	n += int64(written)
+	if err != nil {
+		return n, err
+	}
+	return n, writer.Close()
+}
+
+// setWriteDeadline bounds the next write to dst by WriteTimeout, if set.
+func (p *ReverseProxy) setWriteDeadline(dst *websocket.Conn) error {
+	if p.WriteTimeout <= 0 {
+		return nil
+	}
+	return dst.SetWriteDeadline(time.Now().Add(p.WriteTimeout))
+}
+
+// deadlineWriter renews the write deadline of the connection before each write of a streamed message,
+// so a slow sender doesn't exhaust the WriteTimeout of a healthy destination.
+type deadlineWriter struct {
+	io.WriteCloser
+	p    *ReverseProxy
+	conn *websocket.Conn
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	if err := w.p.setWriteDeadline(w.conn); err != nil {
+		return 0, err
+	}
+	return w.WriteCloser.Write(b)
+}
+
+func (w *deadlineWriter) Close() error {
+	if err := w.p.setWriteDeadline(w.conn); err != nil {
+		return err
+	}
+	return w.WriteCloser.Close()
+}
+
+// copyMessage copies a message using a pooled buffer, unless the reader writes itself without an intermediate buffer.
+// The io.ReaderFrom of the writer of a connection is hidden: it only saves a buffer when the message is not compressed,
+// while the compressing writer would make io.Copy allocate a buffer for each message.
+func (p *ReverseProxy) copyMessage(dst io.Writer, src io.Reader) (int64, error) {
+	buf := p.getCopyBuffer()
+	defer p.copyBuffers.Put(buf)
+
+	return io.CopyBuffer(writerOnly{dst}, src, *buf)
+}
+
+// writerOnly hides the optional interfaces of a writer, such as io.ReaderFrom.
+type writerOnly struct {
+	io.Writer
+}
+
+func (p *ReverseProxy) getCopyBuffer() *[]byte {
+	size := p.CopyBufferSize
+	if size <= 0 {
+		size = defaultCopyBufferSize
+	}
+
+	if buf, ok := p.copyBuffers.Get().(*[]byte); ok && len(*buf) == size {
+		return buf
+	}
+
+	buf := make([]byte, size)
+	return &buf
+}
+
+// formatCloseMessage formats a close message payload,
+// truncating the reason on a rune boundary so the frame fits in a control frame, and the reason stays valid UTF-8.
+func formatCloseMessage(code int, text string) []byte {
+	if len(text) > maxCloseReasonLength {
+		n := maxCloseReasonLength
+		for n > 0 && !utf8.RuneStart(text[n]) {
+			n--
+		}
+		text = text[:n]
+	}
+	return websocket.FormatCloseMessage(code, text)
+}
+
+// hasPathPrefix reports whether the path starts with the prefix, on a segment boundary.
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// stripPrefix returns a copy of the URL without the path prefix.
+// The remaining path always starts with a slash.
+func stripPrefix(u *url.URL, prefix string) *url.URL {
+	stripped := *u
+	stripped.Path = trimPathPrefix(u.Path, prefix)
+
+	stripped.RawPath = ""
+	if u.RawPath != "" && hasPathPrefix(u.RawPath, prefix) {
+		stripped.RawPath = trimPathPrefix(u.RawPath, prefix)
+	}
+	return &stripped
+}
+
+func trimPathPrefix(path, prefix string) string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(path, prefix), "/")
+}
+
+// collapseSlashes replaces the sequences of slashes of the path by a single slash.
+func collapseSlashes(path string) string {
+	if !strings.Contains(path, "//") {
+		return path
+	}
+
+	var b strings.Builder
+	b.Grow(len(path))
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && i > 0 && path[i-1] == '/' {
+			continue
 		}
+		b.WriteByte(path[i])
 	}
+	return b.String()
 }
 
 func singleJoiningSlash(a, b string) string {
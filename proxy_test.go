@@ -1,12 +1,31 @@
 package websocketproxy
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/websocket"
 )
@@ -47,3 +66,2888 @@ func TestWebSocketEcho(t *testing.T) {
 	err = conn.Close()
 	require.NoError(t, err)
 }
+
+func newEchoBackend(t testing.TB) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(echoHandler())
+}
+
+// echoHandler returns a websocket handler echoing the messages.
+func echoHandler() http.Handler {
+	upgrader := gorillawebsocket.Upgrader{}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = conn.WriteMessage(msgType, msg); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func newTestProxy(t testing.TB, backend *httptest.Server, configure func(p *ReverseProxy)) *httptest.Server {
+	t.Helper()
+
+	uri, err := url.ParseRequestURI(backend.URL)
+	require.NoError(t, err)
+
+	p := NewSingleHostReverseProxy(uri)
+	if configure != nil {
+		configure(p)
+	}
+	return httptest.NewServer(p)
+}
+
+func wsURL(srv *httptest.Server, path string) string {
+	return "ws://" + srv.Listener.Addr().String() + path
+}
+
+func TestPostUpgradeRejection(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	testCases := []struct {
+		desc         string
+		code         int
+		reason       string
+		expectedCode int
+		expectedText string
+	}{
+		{
+			desc:         "defaults",
+			expectedCode: gorillawebsocket.CloseTryAgainLater,
+			expectedText: "too many connections",
+		},
+		{
+			desc:         "configured",
+			code:         gorillawebsocket.ClosePolicyViolation,
+			reason:       "subprotocol limit reached",
+			expectedCode: gorillawebsocket.ClosePolicyViolation,
+			expectedText: "subprotocol limit reached",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.RejectCloseCode = test.code
+				p.RejectCloseReason = test.reason
+				p.PostUpgradeCheck = func(req *http.Request, conn *gorillawebsocket.Conn) error {
+					return errors.New("too many connections")
+				}
+			})
+			defer proxy.Close()
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+			assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+			_, _, err = conn.ReadMessage()
+			require.Error(t, err)
+
+			closeErr, ok := err.(*gorillawebsocket.CloseError)
+			require.True(t, ok, "expected a close frame, got: %v", err)
+			assert.Equal(t, test.expectedCode, closeErr.Code)
+			assert.Equal(t, test.expectedText, closeErr.Text)
+		})
+	}
+}
+
+// newConnPair returns both ends of a websocket connection.
+func newConnPair(t testing.TB) (server, client *gorillawebsocket.Conn, cleanup func()) {
+	t.Helper()
+
+	return newCompressedConnPair(t, false)
+}
+
+// newCompressedConnPair returns the server and client sides of a connection,
+// negotiating permessage-deflate if compression is set.
+func newCompressedConnPair(t testing.TB, compression bool) (server, client *gorillawebsocket.Conn, cleanup func()) {
+	t.Helper()
+
+	conns := make(chan *gorillawebsocket.Conn, 1)
+	upgrader := gorillawebsocket.Upgrader{EnableCompression: compression}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}))
+
+	dialer := gorillawebsocket.Dialer{EnableCompression: compression}
+	client, _, err := dialer.Dial(wsURL(srv, "/"), nil)
+	require.NoError(t, err)
+
+	server = <-conns
+	return server, client, func() {
+		_ = client.Close()
+		_ = server.Close()
+		srv.Close()
+	}
+}
+
+func TestConfigureConns(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	testCases := []struct {
+		desc      string
+		configure func(p *ReverseProxy, conn func(*gorillawebsocket.Conn))
+		check     func(t *testing.T, err error)
+	}{
+		{
+			desc: "client connection",
+			configure: func(p *ReverseProxy, conn func(*gorillawebsocket.Conn)) {
+				p.ConfigureClientConn = conn
+			},
+			check: func(t *testing.T, err error) {
+				t.Helper()
+				// the proxy rejects the message of the client.
+				assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseMessageTooBig), "client: %v", err)
+			},
+		},
+		{
+			desc: "backend connection",
+			configure: func(p *ReverseProxy, conn func(*gorillawebsocket.Conn)) {
+				p.ConfigureBackendConn = conn
+			},
+			check: func(t *testing.T, err error) {
+				t.Helper()
+				// the proxy rejects the echo of the backend.
+				var closeErr *gorillawebsocket.CloseError
+				require.True(t, errors.As(err, &closeErr), "client: %v", err)
+				assert.Equal(t, gorillawebsocket.ErrReadLimit.Error(), closeErr.Text)
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var configured int32
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				test.configure(p, func(conn *gorillawebsocket.Conn) {
+					atomic.AddInt32(&configured, 1)
+					conn.SetReadLimit(10)
+				})
+			})
+			defer proxy.Close()
+
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte(strings.Repeat("a", 20))))
+
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+			_, _, err = conn.ReadMessage()
+			test.check(t, err)
+			assert.Equal(t, int32(1), atomic.LoadInt32(&configured))
+		})
+	}
+}
+
+func TestRecoverClosedHookPanic(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	handler := &recordingHandler{}
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.StructuredLogger = slog.New(handler)
+		p.WebsocketConnectionClosedHook = func(req *http.Request, conn net.Conn) {
+			panic("boom")
+		}
+	})
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+		require.NoError(t, err)
+
+		err = conn.WriteMessage(gorillawebsocket.TextMessage, []byte("OK"))
+		require.NoError(t, err)
+
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "OK", string(msg))
+
+		err = conn.WriteMessage(gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, ""))
+		require.NoError(t, err)
+
+		_, _, err = conn.ReadMessage()
+		assert.Error(t, err)
+		_ = conn.Close()
+
+		attrs := handler.waitFor(t, "websocket: Recovered from panic")
+		assert.Equal(t, "WebsocketConnectionClosedHook", attrs["in"].String())
+	}
+}
+
+func TestRecoverPostUpgradeCheckPanic(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.StructuredLogger = slog.New(&recordingHandler{})
+		p.PostUpgradeCheck = func(req *http.Request, conn *gorillawebsocket.Conn) error {
+			panic("boom")
+		}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*gorillawebsocket.CloseError)
+	require.True(t, ok, "expected a close frame, got: %v", err)
+	assert.Equal(t, gorillawebsocket.CloseTryAgainLater, closeErr.Code)
+	assert.Equal(t, errPanic.Error(), closeErr.Text)
+}
+
+func TestRecoverReplicatePanic(t *testing.T) {
+	server, client, cleanup := newConnPair(t)
+	defer cleanup()
+
+	handler := &recordingHandler{}
+	p := &ReverseProxy{
+		StructuredLogger: slog.New(handler),
+		// a panicking transform makes the forwarding panic.
+		TransformClientToBackend: func(int, []byte) ([]byte, error) { panic("boom") },
+	}
+
+	conn := newConnection(httptest.NewRequest(http.MethodGet, "/", nil), "", server, nil)
+
+	errc := make(chan error, 1)
+	go p.replicateWebsocketConn(conn, ClientToBackend, server, server, errc)
+
+	err := client.WriteMessage(gorillawebsocket.TextMessage, []byte("OK"))
+	require.NoError(t, err)
+
+	select {
+	case err = <-errc:
+		assert.Equal(t, errPanic, err)
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "replication did not unwind")
+	}
+
+	_, _, err = client.ReadMessage()
+	assert.Error(t, err)
+
+	attrs := handler.waitFor(t, "websocket: Recovered from panic")
+	assert.Equal(t, "replicateWebsocketConn", attrs["in"].String())
+}
+
+// plainWriter hides any io.ReaderFrom implementation.
+type plainWriter struct {
+	io.Writer
+}
+
+// plainReader hides any io.WriterTo implementation.
+type plainReader struct {
+	io.Reader
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+// readerFromWriter records the sizes of its writes, and fails its io.ReaderFrom.
+type readerFromWriter struct {
+	sizes []int
+}
+
+func (w *readerFromWriter) Write(b []byte) (int, error) {
+	w.sizes = append(w.sizes, len(b))
+	return len(b), nil
+}
+
+func (w *readerFromWriter) ReadFrom(io.Reader) (int64, error) {
+	return 0, errors.New("ReadFrom used")
+}
+
+func TestCopyMessage(t *testing.T) {
+	p := &ReverseProxy{CopyBufferSize: 16}
+
+	var dst strings.Builder
+	n, err := p.copyMessage(plainWriter{&dst}, plainReader{strings.NewReader("a message longer than the buffer")})
+	require.NoError(t, err)
+	assert.Equal(t, int64(32), n)
+	assert.Equal(t, "a message longer than the buffer", dst.String())
+
+	_, err = p.copyMessage(failingWriter{}, plainReader{strings.NewReader("message")})
+	assert.EqualError(t, err, "write failed")
+
+	// the writes of a writer with an io.ReaderFrom, like the writer of a connection, are bounded by the buffer.
+	writer := &readerFromWriter{}
+	_, err = p.copyMessage(writer, plainReader{strings.NewReader("a message longer than the buffer")})
+	require.NoError(t, err)
+	assert.Equal(t, []int{16, 16}, writer.sizes)
+
+	buf := p.getCopyBuffer()
+	assert.Len(t, *buf, 16)
+}
+
+func BenchmarkCopyMessage(b *testing.B) {
+	msg := bytes.Repeat([]byte("a message "), 6*1024)
+
+	benchmarks := []struct {
+		desc        string
+		compression bool
+		copy        func(p *ReverseProxy, dst io.Writer, src io.Reader) (int64, error)
+	}{
+		{
+			desc: "io.Copy",
+			copy: func(_ *ReverseProxy, dst io.Writer, src io.Reader) (int64, error) { return io.Copy(dst, src) },
+		},
+		{
+			desc: "pooled",
+			copy: (*ReverseProxy).copyMessage,
+		},
+		{
+			desc:        "io.Copy compressed",
+			compression: true,
+			copy:        func(_ *ReverseProxy, dst io.Writer, src io.Reader) (int64, error) { return io.Copy(dst, src) },
+		},
+		{
+			desc:        "pooled compressed",
+			compression: true,
+			copy:        (*ReverseProxy).copyMessage,
+		},
+	}
+
+	for _, bench := range benchmarks {
+		bench := bench
+		b.Run(bench.desc, func(b *testing.B) {
+			// the messages are copied from a connection to another.
+			src, sender, cleanupSrc := newConnPair(b)
+			defer cleanupSrc()
+			dst, receiver, cleanupDst := newCompressedConnPair(b, bench.compression)
+			defer cleanupDst()
+			dst.EnableWriteCompression(bench.compression)
+
+			go func() {
+				for {
+					if err := sender.WriteMessage(gorillawebsocket.BinaryMessage, msg); err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				for {
+					_, reader, err := receiver.NextReader()
+					if err != nil {
+						return
+					}
+					_, _ = io.Copy(ioutil.Discard, reader)
+				}
+			}()
+
+			p := &ReverseProxy{}
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				_, reader, err := src.NextReader()
+				if err != nil {
+					b.Fatal(err)
+				}
+				writer, err := dst.NextWriter(gorillawebsocket.BinaryMessage)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = bench.copy(p, writer, reader); err != nil {
+					b.Fatal(err)
+				}
+				if err = writer.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	p := &ReverseProxy{ReadBufferSize: 256, WriteBufferSize: 512}
+
+	upgrader := p.newUpgrader(false)
+	assert.Equal(t, 256, upgrader.ReadBufferSize)
+	assert.Equal(t, 512, upgrader.WriteBufferSize)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	dialer, _ := p.newDialer(req, req, false, nil)
+	d, ok := dialer.(*gorillawebsocket.Dialer)
+	require.True(t, ok)
+	assert.Equal(t, 256, d.ReadBufferSize)
+	assert.Equal(t, 512, d.WriteBufferSize)
+
+	assert.Zero(t, gorillawebsocket.DefaultDialer.ReadBufferSize)
+	assert.Zero(t, gorillawebsocket.DefaultDialer.WriteBufferSize)
+}
+
+func TestSmallBufferSizes(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.ReadBufferSize = 64
+		p.WriteBufferSize = 64
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	msg := strings.Repeat("a", 10000)
+	err = conn.WriteMessage(gorillawebsocket.TextMessage, []byte(msg))
+	require.NoError(t, err)
+
+	_, received, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, msg, string(received))
+}
+
+func TestHandshakeSetCookie(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := make(http.Header)
+		header.Add("Set-Cookie", "session=backend-1; Path=/")
+		header.Add("Set-Cookie", "sticky=node-a")
+
+		conn, err := upgrader.Upgrade(rw, req, header)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	uri, err := url.ParseRequestURI(backend.URL)
+	require.NoError(t, err)
+
+	p := NewSingleHostReverseProxy(uri)
+	p.Logger = &printfRecorder{}
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Add("Set-Cookie", "frontend=1")
+		p.ServeHTTP(rw, req)
+	}))
+	defer proxy.Close()
+
+	dialer := gorillawebsocket.Dialer{Jar: newCookieJar(t)}
+	conn, resp, err := dialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	assert.ElementsMatch(t, []string{"session=backend-1; Path=/", "sticky=node-a", "frontend=1"}, resp.Header["Set-Cookie"])
+
+	u, err := url.Parse("http://" + proxy.Listener.Addr().String() + "/ws")
+	require.NoError(t, err)
+	assert.Len(t, dialer.Jar.Cookies(u), 3)
+}
+
+func newCookieJar(t *testing.T) http.CookieJar {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	return jar
+}
+
+func TestHopHeaders(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := make(http.Header)
+		header.Set("Proxy-Authenticate", "Basic")
+		header.Set("X-Upstream-Node", "node-a")
+
+		conn, err := upgrader.Upgrade(rw, req, header)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		desc       string
+		hopHeaders []string
+		expected   map[string]string
+	}{
+		{
+			desc: "default",
+			expected: map[string]string{
+				"Proxy-Authenticate": "",
+				"X-Upstream-Node":    "node-a",
+			},
+		},
+		{
+			desc:       "custom",
+			hopHeaders: []string{"X-Upstream-Node"},
+			expected: map[string]string{
+				"Proxy-Authenticate": "Basic",
+				"X-Upstream-Node":    "",
+			},
+		},
+		{
+			desc:       "empty",
+			hopHeaders: []string{},
+			expected: map[string]string{
+				"Proxy-Authenticate": "Basic",
+				"X-Upstream-Node":    "node-a",
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.HopHeaders = test.hopHeaders
+			})
+			defer proxy.Close()
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			for name, value := range test.expected {
+				assert.Equal(t, value, resp.Header.Get(name), name)
+			}
+			assert.Len(t, resp.Header["Sec-Websocket-Accept"], 1)
+		})
+	}
+}
+
+func TestOnHeaderStripped(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := make(http.Header)
+		header.Set("Proxy-Authenticate", "Basic")
+		header.Set("X-Upstream-Node", "node-a")
+
+		conn, err := upgrader.Upgrade(rw, req, header)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	var mu sync.Mutex
+	stripped := make(map[string][]string)
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.OnHeaderStripped = func(name, value, location string) {
+			mu.Lock()
+			defer mu.Unlock()
+			stripped[location] = append(stripped[location], name+": "+value)
+		}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Contains(t, stripped["request"], "Upgrade: websocket")
+	assert.Contains(t, stripped["request"], "Sec-Websocket-Version: 13")
+	assert.Contains(t, stripped["response"], "Proxy-Authenticate: Basic")
+	assert.Contains(t, stripped["response"], "Upgrade: websocket")
+	assert.NotContains(t, stripped["response"], "X-Upstream-Node: node-a")
+}
+
+func TestResponseHeaderFilters(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{Subprotocols: []string{"chat"}}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := make(http.Header)
+		header.Set("Proxy-Authenticate", "Basic")
+		header.Set("X-Upstream-Node", "node-a")
+		header.Set("X-Debug", "debug")
+
+		conn, err := upgrader.Upgrade(rw, req, header)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		desc      string
+		allowlist []string
+		blocklist []string
+		expected  map[string]string
+	}{
+		{
+			desc: "no filter",
+			expected: map[string]string{
+				"X-Upstream-Node": "node-a",
+				"X-Debug":         "debug",
+			},
+		},
+		{
+			desc:      "allowlist",
+			allowlist: []string{"x-debug", "Proxy-Authenticate"},
+			expected: map[string]string{
+				"X-Upstream-Node": "",
+				"X-Debug":         "debug",
+			},
+		},
+		{
+			desc:      "blocklist",
+			blocklist: []string{"x-upstream-node"},
+			expected: map[string]string{
+				"X-Upstream-Node": "",
+				"X-Debug":         "debug",
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.ResponseHeaderAllowlist = test.allowlist
+				p.ResponseHeaderBlocklist = test.blocklist
+			})
+			defer proxy.Close()
+
+			dialer := gorillawebsocket.Dialer{Subprotocols: []string{"chat"}}
+			conn, resp, err := dialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			for name, value := range test.expected {
+				assert.Equal(t, value, resp.Header.Get(name), name)
+			}
+
+			// the hop-by-hop headers stay removed.
+			assert.Empty(t, resp.Header.Get("Proxy-Authenticate"))
+			assert.Equal(t, "chat", conn.Subprotocol())
+			assert.Len(t, resp.Header["Sec-Websocket-Accept"], 1)
+		})
+	}
+}
+
+func TestPassHostHeader(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := make(http.Header)
+		header.Set("X-Received-Host", req.Host)
+
+		conn, err := upgrader.Upgrade(rw, req, header)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		desc     string
+		passHost bool
+		legacy   bool
+		expected string
+	}{
+		{
+			desc:     "backend host",
+			expected: backend.Listener.Addr().String(),
+		},
+		{
+			desc:     "client host",
+			passHost: true,
+			expected: "example.com",
+		},
+		{
+			desc:     "backend host with the legacy mode",
+			legacy:   true,
+			expected: backend.Listener.Addr().String(),
+		},
+		{
+			desc:     "client host with the legacy mode",
+			passHost: true,
+			legacy:   true,
+			expected: "example.com",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.PassHostHeader = test.passHost
+				p.LegacyBackendMode = test.legacy
+			})
+			defer proxy.Close()
+
+			headers := http.Header{}
+			headers.Set("Host", "example.com")
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), headers)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			assert.Equal(t, test.expected, resp.Header.Get("X-Received-Host"))
+		})
+	}
+}
+
+func TestDefaultUserAgent(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := make(http.Header)
+		header.Set("X-Received-User-Agent", req.UserAgent())
+
+		conn, err := upgrader.Upgrade(rw, req, header)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		desc             string
+		defaultUserAgent string
+		userAgent        string
+		expected         string
+	}{
+		{
+			desc: "suppressed",
+		},
+		{
+			desc:             "default",
+			defaultUserAgent: "websocketproxy",
+			expected:         "websocketproxy",
+		},
+		{
+			desc:             "client provided",
+			defaultUserAgent: "websocketproxy",
+			userAgent:        "client/1.0",
+			expected:         "client/1.0",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.DefaultUserAgent = test.defaultUserAgent
+			})
+			defer proxy.Close()
+
+			// an empty User-Agent is not sent by the client.
+			headers := http.Header{"User-Agent": []string{test.userAgent}}
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), headers)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			assert.Equal(t, test.expected, resp.Header.Get("X-Received-User-Agent"))
+		})
+	}
+}
+
+func TestVia(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := make(http.Header)
+		header.Set("X-Received-Via", req.Header.Get(Via))
+		header.Set(Via, "1.1 backend-lb")
+
+		conn, err := upgrader.Upgrade(rw, req, header)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		desc            string
+		via             string
+		expectedRequest string
+	}{
+		{
+			desc:            "added",
+			expectedRequest: "1.1 websocketproxy",
+		},
+		{
+			desc:            "appended",
+			via:             "1.1 edge",
+			expectedRequest: "1.1 edge, 1.1 websocketproxy",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.Via = "websocketproxy"
+			})
+			defer proxy.Close()
+
+			headers := http.Header{}
+			if test.via != "" {
+				headers.Set(Via, test.via)
+			}
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), headers)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			assert.Equal(t, test.expectedRequest, resp.Header.Get("X-Received-Via"))
+			assert.Equal(t, "1.1 backend-lb, 1.1 websocketproxy", resp.Header.Get(Via))
+		})
+	}
+}
+
+func TestCorrelationHeader(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := make(http.Header)
+		header.Set("X-Received-Request-Id", req.Header.Get("X-Request-Id"))
+
+		conn, err := upgrader.Upgrade(rw, req, header)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		desc      string
+		requestID string
+	}{
+		{
+			desc:      "pass-through",
+			requestID: "abc-123",
+		},
+		{
+			desc: "generated",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			infos := make(chan CloseInfo, 1)
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.CorrelationHeader = "X-Request-Id"
+				p.ConnectionClosedHook = func(req *http.Request, info CloseInfo) {
+					infos <- info
+				}
+			})
+			defer proxy.Close()
+
+			headers := http.Header{}
+			if test.requestID != "" {
+				headers.Set("X-Request-Id", test.requestID)
+			}
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), headers)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			received := resp.Header.Get("X-Received-Request-Id")
+			if test.requestID != "" {
+				assert.Equal(t, test.requestID, received)
+			} else {
+				assert.Len(t, received, 36)
+			}
+
+			select {
+			case info := <-infos:
+				assert.Equal(t, received, info.CorrelationID)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for the closed hook")
+			}
+		})
+	}
+}
+
+func TestForceScheme(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{}
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := make(http.Header)
+		header.Set("X-Received-TLS", strconv.FormatBool(req.TLS != nil))
+
+		conn, err := upgrader.Upgrade(rw, req, header)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	})
+
+	testCases := []struct {
+		desc           string
+		tls            bool
+		targetScheme   string
+		forceScheme    string
+		expectedStatus int
+		expectedTLS    string
+	}{
+		{
+			desc:           "force wss over an http target",
+			tls:            true,
+			targetScheme:   "http",
+			forceScheme:    "wss",
+			expectedStatus: http.StatusSwitchingProtocols,
+			expectedTLS:    "true",
+		},
+		{
+			desc:           "force ws over an https target",
+			targetScheme:   "https",
+			forceScheme:    "ws",
+			expectedStatus: http.StatusSwitchingProtocols,
+			expectedTLS:    "false",
+		},
+		{
+			desc:           "invalid scheme",
+			targetScheme:   "http",
+			forceScheme:    "https",
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var backend *httptest.Server
+			if test.tls {
+				backend = httptest.NewTLSServer(handler)
+			} else {
+				backend = httptest.NewServer(handler)
+			}
+			defer backend.Close()
+
+			p := NewSingleHostReverseProxy(&url.URL{Scheme: test.targetScheme, Host: backend.Listener.Addr().String()})
+			p.Logger = &printfRecorder{}
+			p.ForceScheme = test.forceScheme
+			p.Dialer = &gorillawebsocket.Dialer{TLSClientConfig: backend.Client().Transport.(*http.Transport).TLSClientConfig}
+			proxy := httptest.NewServer(p)
+			defer proxy.Close()
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			if err == nil {
+				defer func() { _ = conn.Close() }()
+			}
+			require.NotNil(t, resp)
+			assert.Equal(t, test.expectedStatus, resp.StatusCode)
+			assert.Equal(t, test.expectedTLS, resp.Header.Get("X-Received-TLS"))
+		})
+	}
+}
+
+func TestNonWebSocketRequest(t *testing.T) {
+	var dialed bool
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		dialed = true
+	}))
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, nil)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + "/ws")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+	assert.False(t, dialed)
+}
+
+func TestCloseHandshakePropagation(t *testing.T) {
+	t.Run("client initiated", func(t *testing.T) {
+		upgrader := gorillawebsocket.Upgrader{}
+		backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			conn, err := upgrader.Upgrade(rw, req, nil)
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+
+			conn.SetCloseHandler(func(code int, text string) error {
+				// a slow answer to the close frame.
+				time.Sleep(100 * time.Millisecond)
+				msg := gorillawebsocket.FormatCloseMessage(code, "")
+				return conn.WriteControl(gorillawebsocket.CloseMessage, msg, time.Now().Add(time.Second))
+			})
+			_, _, _ = conn.ReadMessage()
+		}))
+		defer backend.Close()
+
+		proxy := newTestProxy(t, backend, nil)
+		defer proxy.Close()
+
+		conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		err = conn.WriteMessage(gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, "bye"))
+		require.NoError(t, err)
+
+		// the backend answer to the close frame.
+		_, _, err = conn.ReadMessage()
+		closeErr, ok := err.(*gorillawebsocket.CloseError)
+		require.True(t, ok, "expected a close frame, got: %v", err)
+		assert.Equal(t, gorillawebsocket.CloseNormalClosure, closeErr.Code)
+	})
+
+	t.Run("backend initiated", func(t *testing.T) {
+		received := make(chan error, 1)
+		upgrader := gorillawebsocket.Upgrader{}
+		backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			conn, err := upgrader.Upgrade(rw, req, nil)
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+
+			_ = conn.WriteMessage(gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, "bye"))
+
+			// the client answer to the close frame.
+			_, _, err = conn.ReadMessage()
+			received <- err
+		}))
+		defer backend.Close()
+
+		proxy := newTestProxy(t, backend, nil)
+		defer proxy.Close()
+
+		conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, _, err = conn.ReadMessage()
+		closeErr, ok := err.(*gorillawebsocket.CloseError)
+		require.True(t, ok, "expected a close frame, got: %v", err)
+		assert.Equal(t, gorillawebsocket.CloseNormalClosure, closeErr.Code)
+		assert.Equal(t, "bye", closeErr.Text)
+
+		err = <-received
+		closeErr, ok = err.(*gorillawebsocket.CloseError)
+		require.True(t, ok, "expected a close frame, got: %v", err)
+		assert.Equal(t, gorillawebsocket.CloseNormalClosure, closeErr.Code)
+	})
+}
+
+func TestSimultaneousCloses(t *testing.T) {
+	backendCloses := &frameRecorder{}
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		// messages still in flight toward the client when it closes.
+		for i := 0; i < 100; i++ {
+			_ = conn.WriteMessage(gorillawebsocket.TextMessage, []byte("data"))
+		}
+		_ = conn.WriteMessage(gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseGoingAway, "backend"))
+
+		for {
+			if _, _, err = conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	backend.Listener = &frameListener{Listener: backend.Listener, recorder: backendCloses}
+	backend.Start()
+	defer backend.Close()
+
+	logger := &printfRecorder{}
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = logger
+	})
+	defer proxy.Close()
+
+	clientCloses := &frameRecorder{}
+	dialer := gorillawebsocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &frameConn{Conn: conn, recorder: clientCloses}, nil
+		},
+	}
+
+	conn, _, err := dialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	err = conn.WriteMessage(gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, "client"))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	_, ok := err.(*gorillawebsocket.CloseError)
+	require.True(t, ok, "expected a close frame, got: %v", err)
+
+	// the proxy tears down the connections once the close handshakes are done.
+	_, _ = conn.UnderlyingConn().Read(make([]byte, 1))
+	deadline := time.Now().Add(2 * time.Second)
+	for !backendCloses.done() {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "backend connection not torn down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, 1, clientCloses.count(gorillawebsocket.CloseMessage))
+	assert.Equal(t, 1, backendCloses.count(gorillawebsocket.CloseMessage))
+	assert.Empty(t, logger.Lines())
+}
+
+// frameRecorder records the frames read from a connection.
+type frameRecorder struct {
+	mu     sync.Mutex
+	data   []byte
+	closed bool
+}
+
+// recordedFrame is a frame read from a connection.
+type recordedFrame struct {
+	opcode     int
+	compressed bool
+	length     int
+}
+
+func (r *frameRecorder) record(p []byte, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.data = append(r.data, p...)
+	if err != nil {
+		r.closed = true
+	}
+}
+
+// done reports whether the connection was read until its end.
+func (r *frameRecorder) done() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.closed
+}
+
+// frames parses the frames following the handshake.
+func (r *frameRecorder) frames() []recordedFrame {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := r.data
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		data = data[i+4:]
+	}
+
+	var frames []recordedFrame
+	for len(data) >= 2 {
+		length := int(data[1] & 0x7f)
+		header := 2
+		switch length {
+		case 126:
+			length = int(binary.BigEndian.Uint16(data[2:]))
+			header += 2
+		case 127:
+			length = int(binary.BigEndian.Uint64(data[2:]))
+			header += 8
+		}
+		if data[1]&0x80 != 0 {
+			// the mask key.
+			header += 4
+		}
+
+		frames = append(frames, recordedFrame{
+			opcode:     int(data[0] & 0x0f),
+			compressed: data[0]&0x40 != 0,
+			length:     length,
+		})
+		if header+length > len(data) {
+			break
+		}
+		data = data[header+length:]
+	}
+	return frames
+}
+
+// count returns the number of frames of the opcode.
+func (r *frameRecorder) count(opcode int) int {
+	var n int
+	for _, f := range r.frames() {
+		if f.opcode == opcode {
+			n++
+		}
+	}
+	return n
+}
+
+// frameConn records its reads into a frameRecorder.
+type frameConn struct {
+	net.Conn
+	recorder *frameRecorder
+}
+
+func (c *frameConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.recorder.record(p[:n], err)
+	return n, err
+}
+
+// frameListener records the reads of its single accepted connection.
+type frameListener struct {
+	net.Listener
+	recorder *frameRecorder
+}
+
+func (l *frameListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &frameConn{Conn: conn, recorder: l.recorder}, nil
+}
+
+// newHeadersBackend returns a backend that reports the headers of the handshake requests.
+func newHeadersBackend(t *testing.T) (*httptest.Server, <-chan http.Header) {
+	t.Helper()
+
+	headers := make(chan http.Header, 10)
+	upgrader := gorillawebsocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		headers <- req.Header
+
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+
+	return backend, headers
+}
+
+func TestHashedClientIPHeader(t *testing.T) {
+	backend, headers := newHeadersBackend(t)
+	defer backend.Close()
+
+	testCases := []struct {
+		desc             string
+		omitForwardedFor bool
+		expectedXFF      string
+	}{
+		{
+			desc:        "keep X-Forwarded-For",
+			expectedXFF: "10.0.0.1",
+		},
+		{
+			desc:             "omit X-Forwarded-For",
+			omitForwardedFor: true,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.HashedClientIPHeader = "X-Client-Hash"
+				p.ClientIPHashSalt = []byte("salt")
+				p.OmitForwardedFor = test.omitForwardedFor
+			})
+			defer proxy.Close()
+
+			var hashes []string
+			for i := 0; i < 2; i++ {
+				reqHeaders := http.Header{}
+				reqHeaders.Set("X-Forwarded-For", "10.0.0.1")
+
+				conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), reqHeaders)
+				require.NoError(t, err)
+				_ = conn.Close()
+
+				received := <-headers
+				assert.Equal(t, test.expectedXFF, received.Get("X-Forwarded-For"))
+				hashes = append(hashes, received.Get("X-Client-Hash"))
+			}
+
+			// stable across connections from the same IP.
+			assert.Equal(t, hashClientIP("127.0.0.1", []byte("salt")), hashes[0])
+			assert.Equal(t, hashes[0], hashes[1])
+			assert.NotContains(t, hashes[0], "127.0.0.1")
+		})
+	}
+
+	assert.NotEqual(t, hashClientIP("127.0.0.1", []byte("salt")), hashClientIP("127.0.0.1", []byte("other")))
+}
+
+func TestRequestHeaderFilters(t *testing.T) {
+	backend, headers := newHeadersBackend(t)
+	defer backend.Close()
+
+	testCases := []struct {
+		desc      string
+		allowlist []string
+		blocklist []string
+		expected  map[string]string
+		absent    []string
+	}{
+		{
+			desc: "no filter",
+			expected: map[string]string{
+				"X-Public":               "public",
+				"X-Internal":             "internal",
+				"Sec-Websocket-Protocol": "chat",
+			},
+		},
+		{
+			desc:      "allowlist",
+			allowlist: []string{"x-public", "Upgrade"},
+			expected: map[string]string{
+				"X-Public":               "public",
+				"X-Internal":             "",
+				"X-Director":             "director",
+				"Sec-Websocket-Protocol": "chat",
+			},
+		},
+		{
+			desc:      "blocklist",
+			blocklist: []string{"x-internal", "Sec-Websocket-Key"},
+			expected: map[string]string{
+				"X-Public":               "public",
+				"X-Internal":             "",
+				"X-Director":             "director",
+				"Sec-Websocket-Protocol": "chat",
+			},
+		},
+		{
+			desc:      "both",
+			allowlist: []string{"X-Public", "X-Internal"},
+			blocklist: []string{"X-Internal"},
+			expected: map[string]string{
+				"X-Public":   "public",
+				"X-Internal": "",
+			},
+		},
+		{
+			desc:      "blocklist with an empty first value",
+			blocklist: []string{"X-Secret"},
+			expected: map[string]string{
+				"X-Public": "public",
+			},
+			absent: []string{"X-Secret"},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.RequestHeaderAllowlist = test.allowlist
+				p.RequestHeaderBlocklist = test.blocklist
+
+				director := p.Director
+				p.Director = func(req *http.Request) {
+					director(req)
+					req.Header.Set("X-Director", "director")
+				}
+			})
+			defer proxy.Close()
+
+			reqHeaders := http.Header{}
+			reqHeaders.Set("X-Public", "public")
+			reqHeaders.Set("X-Internal", "internal")
+			reqHeaders.Set("Sec-Websocket-Protocol", "chat")
+			reqHeaders["X-Secret"] = []string{"", "secret"}
+
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), reqHeaders)
+			require.NoError(t, err)
+			_ = conn.Close()
+
+			received := <-headers
+			for name, value := range test.expected {
+				assert.Equal(t, value, received.Get(name), name)
+			}
+			for _, name := range test.absent {
+				assert.Empty(t, received.Values(name), name)
+			}
+
+			// the dialer writes the websocket handshake headers.
+			assert.Equal(t, "websocket", received.Get("Upgrade"))
+			assert.Len(t, received["Sec-Websocket-Key"], 1)
+			assert.Equal(t, "13", received.Get("Sec-Websocket-Version"))
+		})
+	}
+}
+
+func TestConnectionClosedHook(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		backend  func(conn *gorillawebsocket.Conn)
+		client   func(conn *gorillawebsocket.Conn)
+		expected CloseInfo
+	}{
+		{
+			desc: "normal closure by the client",
+			backend: func(conn *gorillawebsocket.Conn) {
+				_, _, _ = conn.ReadMessage()
+			},
+			client: func(conn *gorillawebsocket.Conn) {
+				_ = conn.WriteMessage(gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, "logout"))
+				_, _, _ = conn.ReadMessage()
+			},
+			expected: CloseInfo{Code: gorillawebsocket.CloseNormalClosure, Text: "logout", Initiator: PeerClient},
+		},
+		{
+			desc: "going away by the backend",
+			backend: func(conn *gorillawebsocket.Conn) {
+				_ = conn.WriteMessage(gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseGoingAway, "restart"))
+				_, _, _ = conn.ReadMessage()
+			},
+			client: func(conn *gorillawebsocket.Conn) {
+				_, _, _ = conn.ReadMessage()
+			},
+			expected: CloseInfo{Code: gorillawebsocket.CloseGoingAway, Text: "restart", Initiator: PeerBackend},
+		},
+		{
+			desc: "abnormal closure of the backend",
+			backend: func(conn *gorillawebsocket.Conn) {
+				_ = conn.UnderlyingConn().Close()
+			},
+			client: func(conn *gorillawebsocket.Conn) {
+				_, _, _ = conn.ReadMessage()
+			},
+			expected: CloseInfo{Code: gorillawebsocket.CloseAbnormalClosure, Text: "unexpected EOF", Initiator: PeerBackend},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			upgrader := gorillawebsocket.Upgrader{}
+			backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				conn, err := upgrader.Upgrade(rw, req, nil)
+				if err != nil {
+					return
+				}
+				defer func() { _ = conn.Close() }()
+
+				test.backend(conn)
+			}))
+			defer backend.Close()
+
+			infos := make(chan CloseInfo, 1)
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.ConnectionClosedHook = func(req *http.Request, info CloseInfo) {
+					infos <- info
+				}
+			})
+			defer proxy.Close()
+
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			test.client(conn)
+
+			select {
+			case info := <-infos:
+				assert.Equal(t, test.expected, info)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for the closed hook")
+			}
+		})
+	}
+}
+
+func TestConnectionClosedHookForwarded(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	infos := make(chan CloseInfo, 1)
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.ConnectionClosedHook = func(req *http.Request, info CloseInfo) {
+			infos <- info
+		}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// a streamed message, and small ones.
+	for _, msg := range [][]byte{bytes.Repeat([]byte("a"), 100000), []byte("hello"), []byte("world")} {
+		require.NoError(t, conn.WriteMessage(gorillawebsocket.BinaryMessage, msg))
+		_, echo, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, msg, echo)
+	}
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.PingMessage, []byte("ping")))
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, "")))
+	_, _, _ = conn.ReadMessage()
+
+	select {
+	case info := <-infos:
+		// the control messages are not counted.
+		assert.Equal(t, [2]int64{100010, 100010}, info.Bytes)
+		assert.Equal(t, [2]int64{3, 3}, info.Messages)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the closed hook")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	backend, headers := newHeadersBackend(t)
+	defer backend.Close()
+
+	testCases := []struct {
+		desc           string
+		token          string
+		status         int
+		expectedStatus int
+	}{
+		{
+			desc:           "allowed",
+			token:          "secret",
+			expectedStatus: http.StatusSwitchingProtocols,
+		},
+		{
+			desc:           "denied",
+			token:          "invalid",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			desc:           "denied with configured status",
+			token:          "invalid",
+			status:         http.StatusUnauthorized,
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.AuthorizeStatus = test.status
+				p.Authorize = func(req *http.Request) error {
+					if req.URL.Query().Get("token") != "secret" {
+						return errors.New("invalid token")
+					}
+					return nil
+				}
+			})
+			defer proxy.Close()
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws?token="+test.token), nil)
+			require.NotNil(t, resp)
+			assert.Equal(t, test.expectedStatus, resp.StatusCode)
+
+			if test.expectedStatus == http.StatusSwitchingProtocols {
+				require.NoError(t, err)
+				_ = conn.Close()
+				<-headers
+				return
+			}
+
+			require.Error(t, err)
+			assert.Len(t, headers, 0, "the backend must not be dialed")
+		})
+	}
+}
+
+func TestAuthFailurePolicy(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	testCases := []struct {
+		desc           string
+		policy         AuthFailurePolicy
+		err            error
+		expectedStatus int
+	}{
+		{
+			desc:           "deny",
+			policy:         FailOpen,
+			err:            errors.New("invalid token"),
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			desc:           "fail closed on error",
+			policy:         FailClosed,
+			err:            &AuthFailureError{Err: errors.New("auth service unavailable")},
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+		{
+			desc:           "fail open on error",
+			policy:         FailOpen,
+			err:            fmt.Errorf("checking token: %w", &AuthFailureError{Err: errors.New("auth service unavailable")}),
+			expectedStatus: http.StatusSwitchingProtocols,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.AuthFailurePolicy = test.policy
+				p.Authorize = func(req *http.Request) error {
+					return test.err
+				}
+			})
+			defer proxy.Close()
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NotNil(t, resp)
+			assert.Equal(t, test.expectedStatus, resp.StatusCode)
+			if err == nil {
+				_ = conn.Close()
+			}
+		})
+	}
+}
+
+// instrumentProxy enables all the per-message accounting, without actually limiting.
+func instrumentProxy(p *ReverseProxy) {
+	p.RateLimit = &RateLimit{MessagesPerSecond: 1e9, BytesPerSecond: 1e12}
+	p.MaxMessagesPerConnection = math.MaxInt64
+	p.StatsLogInterval = time.Hour
+}
+
+func TestSubprotocolValidator(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var header http.Header
+		if selected := req.URL.Query().Get("select"); selected != "" {
+			header = http.Header{"Sec-Websocket-Protocol": {selected}}
+		}
+
+		conn, err := upgrader.Upgrade(rw, req, header)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		desc           string
+		selected       string
+		expectedStatus int
+	}{
+		{
+			desc:           "valid selection",
+			selected:       "chat.v2",
+			expectedStatus: http.StatusSwitchingProtocols,
+		},
+		{
+			desc:           "no selection",
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			desc:           "invalid selection",
+			selected:       "chat.v3",
+			expectedStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var offered []string
+			errs := make(chan error, 1)
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.SubprotocolValidator = func(o []string, selected string) error {
+					offered = o
+					for _, protocol := range o {
+						if protocol == selected {
+							return nil
+						}
+					}
+					return fmt.Errorf("unexpected subprotocol %q", selected)
+				}
+				p.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+					errs <- err
+					rw.WriteHeader(errorStatus(err))
+				}
+			})
+			defer proxy.Close()
+
+			dialer := gorillawebsocket.Dialer{Subprotocols: []string{"chat.v1", "chat.v2"}}
+			conn, resp, err := dialer.Dial(wsURL(proxy, "/ws?select="+test.selected), nil)
+			if err == nil {
+				_ = conn.Close()
+			}
+			require.NotNil(t, resp)
+			assert.Equal(t, test.expectedStatus, resp.StatusCode)
+			assert.Equal(t, []string{"chat.v1", "chat.v2"}, offered)
+
+			if test.expectedStatus == http.StatusSwitchingProtocols {
+				require.NoError(t, err)
+				assert.Equal(t, test.selected, conn.Subprotocol())
+				return
+			}
+			assert.ErrorIs(t, <-errs, ErrHandshakeRejected)
+		})
+	}
+}
+
+func TestRelayModes(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	testCases := []struct {
+		desc      string
+		configure func(p *ReverseProxy)
+	}{
+		{
+			desc: "fast path",
+		},
+		{
+			desc:      "instrumented",
+			configure: instrumentProxy,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, backend, test.configure)
+			defer proxy.Close()
+
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			messages := []struct {
+				msgType int
+				data    []byte
+			}{
+				{msgType: gorillawebsocket.TextMessage, data: []byte("OK")},
+				{msgType: gorillawebsocket.BinaryMessage, data: bytes.Repeat([]byte{0, 1, 2}, 50000)},
+				{msgType: gorillawebsocket.TextMessage, data: []byte{}},
+			}
+
+			for _, m := range messages {
+				require.NoError(t, conn.WriteMessage(m.msgType, m.data))
+
+				msgType, data, err := conn.ReadMessage()
+				require.NoError(t, err)
+				assert.Equal(t, m.msgType, msgType)
+				assert.Equal(t, m.data, data)
+			}
+
+			err = conn.WriteMessage(gorillawebsocket.CloseMessage, gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, "bye"))
+			require.NoError(t, err)
+
+			_, _, err = conn.ReadMessage()
+			assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseNormalClosure), "got: %v", err)
+		})
+	}
+}
+
+func BenchmarkRelay(b *testing.B) {
+	backend := newEchoBackend(b)
+	defer backend.Close()
+
+	msg := bytes.Repeat([]byte("a"), 512)
+
+	benchmarks := []struct {
+		desc      string
+		configure func(p *ReverseProxy)
+	}{
+		{desc: "fast path"},
+		{desc: "instrumented", configure: instrumentProxy},
+	}
+
+	for _, bench := range benchmarks {
+		bench := bench
+		b.Run(bench.desc, func(b *testing.B) {
+			proxy := newTestProxy(b, backend, bench.configure)
+			defer proxy.Close()
+
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(b, err)
+			defer func() { _ = conn.Close() }()
+
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err = conn.WriteMessage(gorillawebsocket.BinaryMessage, msg); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err = conn.ReadMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnixSocketBackend(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	backend := httptest.NewUnstartedServer(echoHandler())
+	_ = backend.Listener.Close()
+	backend.Listener = listener
+	backend.Start()
+	defer backend.Close()
+
+	uri, err := url.Parse("http://app.internal")
+	require.NoError(t, err)
+
+	p := NewSingleHostReverseProxy(uri)
+	p.NetDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	}
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	err = conn.WriteMessage(gorillawebsocket.TextMessage, []byte("OK"))
+	require.NoError(t, err)
+
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "OK", string(msg))
+}
+
+// namedDialer records its dials, and dials with the default dialer.
+type namedDialer struct {
+	name  string
+	dials chan string
+}
+
+func (d *namedDialer) DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (*gorillawebsocket.Conn, *http.Response, error) {
+	d.dials <- d.name
+	return gorillawebsocket.DefaultDialer.DialContext(ctx, urlStr, requestHeader)
+}
+
+func TestDialerFunc(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	dials := make(chan string, 1)
+	dialers := map[string]Dialer{
+		"a": &namedDialer{name: "a", dials: dials},
+		"b": &namedDialer{name: "b", dials: dials},
+	}
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Dialer = &namedDialer{name: "default", dials: dials}
+		p.DialerFunc = func(req *http.Request) Dialer {
+			return dialers[req.Header.Get("X-Tenant")]
+		}
+	})
+	defer proxy.Close()
+
+	for _, tenant := range []string{"a", "b", "unknown"} {
+		header := http.Header{}
+		header.Set("X-Tenant", tenant)
+
+		conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), header)
+		require.NoError(t, err)
+		_ = conn.Close()
+
+		expected := tenant
+		if tenant == "unknown" {
+			expected = "default"
+		}
+		assert.Equal(t, expected, <-dials)
+	}
+}
+
+// nilDialer returns a nil connection without an error.
+type nilDialer struct{}
+
+func (nilDialer) DialContext(context.Context, string, http.Header) (*gorillawebsocket.Conn, *http.Response, error) {
+	return nil, nil, nil
+}
+
+func TestNilDialedConnection(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.Dialer = nilDialer{}
+	})
+	defer proxy.Close()
+
+	_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+// trackingDialer records the connections it dials with the default dialer.
+type trackingDialer struct {
+	conns chan *gorillawebsocket.Conn
+}
+
+func (d *trackingDialer) DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (*gorillawebsocket.Conn, *http.Response, error) {
+	conn, resp, err := gorillawebsocket.DefaultDialer.DialContext(ctx, urlStr, requestHeader)
+	if conn != nil {
+		d.conns <- conn
+	}
+	return conn, resp, err
+}
+
+func TestUpgradeFailureClosesBackend(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	uri, err := url.ParseRequestURI(backend.URL)
+	require.NoError(t, err)
+
+	errs := make(chan error, 1)
+	dialer := &trackingDialer{conns: make(chan *gorillawebsocket.Conn, 1)}
+	p := NewSingleHostReverseProxy(uri)
+	p.Logger = &printfRecorder{}
+	p.Dialer = dialer
+	p.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		errs <- err
+		p.defaultErrorHandler(rw, req, err)
+	}
+
+	// the upgrader rejects the unsupported version, once the backend is dialed.
+	req := httptest.NewRequest(http.MethodGet, "http://proxy/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.ErrorIs(t, <-errs, ErrUpgradeFailed)
+
+	// a closed connection rejects its deadlines.
+	conn := <-dialer.conns
+	err = conn.UnderlyingConn().SetReadDeadline(time.Now())
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestLocalAddr(t *testing.T) {
+	backend, requests := newRemoteAddrBackend(t)
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.LocalAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	host, _, err := net.SplitHostPort(<-requests)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.2", host)
+}
+
+// newRemoteAddrBackend returns a backend reporting the remote address of the handshake requests.
+func newRemoteAddrBackend(t *testing.T) (*httptest.Server, <-chan string) {
+	t.Helper()
+
+	addrs := make(chan string, 1)
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		addrs <- req.RemoteAddr
+
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+
+	return backend, addrs
+}
+
+func TestTap(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	var mu sync.Mutex
+	tapped := map[Direction][]string{}
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Tap = func(dir Direction, messageType int, data []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			tapped[dir] = append(tapped[dir], string(data))
+		}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	expected := []string{"one", "two", "three"}
+	for _, msg := range expected {
+		require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte(msg)))
+
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(data))
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		done := len(tapped[BackendToClient]) == len(expected)
+		mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, expected, tapped[ClientToBackend])
+	assert.Equal(t, expected, tapped[BackendToClient])
+}
+
+func TestAllowedMessageTypes(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.AllowedMessageTypes = []int{gorillawebsocket.TextMessage}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("text")))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "text", string(msg))
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.PingMessage, []byte("ping")))
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.BinaryMessage, []byte("binary")))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseUnsupportedData), "client: %v", err)
+}
+
+func TestTransform(t *testing.T) {
+	received := make(chan string, 3)
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- string(msg)
+
+			// answers with a lowercase message, streamed to the client.
+			if err = conn.WriteMessage(gorillawebsocket.TextMessage, []byte(strings.Repeat("pong ", 1000))); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	var transformed int32
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.TransformClientToBackend = func(messageType int, data []byte) ([]byte, error) {
+			atomic.AddInt32(&transformed, 1)
+			if string(data) == "invalid" {
+				return nil, errors.New("invalid message")
+			}
+			return bytes.ToUpper(data), nil
+		}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	for _, msg := range []string{"ping", "hello"} {
+		require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte(msg)))
+		assert.Equal(t, strings.ToUpper(msg), <-received)
+
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat("pong ", 1000), string(data))
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&transformed))
+
+	// a failed transform closes the connection.
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("invalid")))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseInternalServerErr), "client: %v", err)
+}
+
+func TestPeekFirstMessage(t *testing.T) {
+	received := make(chan []byte, 2)
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}))
+	defer backend.Close()
+
+	peeks := make(chan string, 2)
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.PeekFirstMessage = 4
+		p.OnFirstMessage = func(req *http.Request, peek []byte) {
+			peeks <- string(peek)
+		}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// a streamed message, and a message shorter than the peek.
+	first := append([]byte("HEAD"), bytes.Repeat([]byte("a"), 100000)...)
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.BinaryMessage, first))
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.BinaryMessage, []byte("ab")))
+
+	assert.Equal(t, first, <-received)
+	assert.Equal(t, []byte("ab"), <-received)
+
+	assert.Equal(t, "HEAD", <-peeks)
+	assert.Empty(t, peeks)
+}
+
+func TestCollapseSlashes(t *testing.T) {
+	uris := make(chan string, 1)
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		uris <- req.RequestURI
+
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		desc        string
+		collapse    bool
+		expectedURI string
+	}{
+		{
+			desc:        "disabled",
+			expectedURI: "/base//foo//bar?redirect=http://a//b",
+		},
+		{
+			desc:        "enabled",
+			collapse:    true,
+			expectedURI: "/base/foo/bar?redirect=http://a//b",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			uri, err := url.ParseRequestURI(backend.URL + "/base/")
+			require.NoError(t, err)
+
+			p := NewSingleHostReverseProxy(uri)
+			p.CollapseSlashes = test.collapse
+			proxy := httptest.NewServer(p)
+			defer proxy.Close()
+
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "//foo//bar?redirect=http://a//b"), nil)
+			require.NoError(t, err)
+			_ = conn.Close()
+
+			assert.Equal(t, test.expectedURI, <-uris)
+		})
+	}
+}
+
+func TestCollapseSlashesPath(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{path: "", expected: ""},
+		{path: "/", expected: "/"},
+		{path: "//", expected: "/"},
+		{path: "/a/b", expected: "/a/b"},
+		{path: "//a///b//", expected: "/a/b/"},
+		{path: "/a%2F%2Fb", expected: "/a%2F%2Fb"},
+	}
+
+	for _, test := range testCases {
+		assert.Equal(t, test.expected, collapseSlashes(test.path), test.path)
+	}
+}
+
+func TestPartialMessageForwarding(t *testing.T) {
+	client, clientPeer, cleanupClient := newConnPair(t)
+	defer cleanupClient()
+	backend, backendPeer, cleanupBackend := newConnPair(t)
+	defer cleanupBackend()
+
+	handler := &recordingHandler{}
+	p := &ReverseProxy{StructuredLogger: slog.New(handler)}
+
+	conn := newConnection(httptest.NewRequest(http.MethodGet, "/", nil), "", client, backend)
+
+	// the backend goes away, the message can't be fully forwarded.
+	_ = backendPeer.UnderlyingConn().Close()
+
+	errc := make(chan error, 1)
+	go p.replicateWebsocketConn(conn, ClientToBackend, backend, client, errc)
+
+	// the write doesn't complete once the proxy stops reading.
+	go func() { _ = clientPeer.WriteMessage(gorillawebsocket.BinaryMessage, bytes.Repeat([]byte("a"), 10<<20)) }()
+
+	var err error
+	select {
+	case <-conn.closing:
+	case err = <-errc:
+		require.FailNow(t, "unexpected error", "%v", err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "connection not closed")
+	}
+
+	attrs := handler.waitFor(t, "websocket: Message partially forwarded")
+	assert.Equal(t, "client_to_backend", attrs["direction"].String())
+	assert.True(t, attrs["bytes"].Int64() > 0)
+
+	_, _, err = clientPeer.ReadMessage()
+	closeErr, ok := err.(*gorillawebsocket.CloseError)
+	require.True(t, ok, "expected a close frame, got: %v", err)
+	assert.Equal(t, gorillawebsocket.CloseInternalServerErr, closeErr.Code)
+	assert.Equal(t, "message truncated", closeErr.Text)
+}
+
+func TestWriteMessage(t *testing.T) {
+	server, client, cleanup := newConnPair(t)
+	defer cleanup()
+
+	p := &ReverseProxy{}
+
+	for _, size := range []int{0, 100, smallMessageSize - 1, smallMessageSize, smallMessageSize + 1, 5 * smallMessageSize} {
+		msg := bytes.Repeat([]byte("a"), size)
+
+		n, err := p.writeMessage(server, gorillawebsocket.BinaryMessage, plainReader{bytes.NewReader(msg)})
+		require.NoError(t, err)
+		assert.Equal(t, int64(size), n)
+
+		msgType, data, err := client.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, gorillawebsocket.BinaryMessage, msgType)
+		assert.Equal(t, msg, data, "size %d", size)
+	}
+}
+
+func BenchmarkWriteMessage(b *testing.B) {
+	server, client, cleanup := newConnPair(b)
+	defer cleanup()
+
+	go func() {
+		for {
+			if _, _, err := client.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	msg := bytes.Repeat([]byte("a"), 100)
+	p := &ReverseProxy{}
+
+	b.Run("streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := p.streamMessage(server, gorillawebsocket.BinaryMessage, nil, bytes.NewReader(msg)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("single frame", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := p.writeMessage(server, gorillawebsocket.BinaryMessage, bytes.NewReader(msg)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestContextCancellation(t *testing.T) {
+	received := make(chan error, 1)
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				received <- err
+				return
+			}
+			_ = conn.WriteMessage(msgType, msg)
+		}
+	}))
+	defer backend.Close()
+
+	uri, err := url.ParseRequestURI(backend.URL)
+	require.NoError(t, err)
+
+	p := NewSingleHostReverseProxy(uri)
+	cancels := make(chan context.CancelFunc, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels <- cancel
+		p.ServeHTTP(rw, req.WithContext(ctx))
+	}))
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("OK")))
+	_, _, err = conn.ReadMessage()
+	require.NoError(t, err)
+
+	cancel := <-cancels
+	cancel()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseGoingAway), "client: %v", err)
+
+	select {
+	case err = <-received:
+		assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseGoingAway), "backend: %v", err)
+	case <-time.After(time.Second):
+		require.FailNow(t, "backend not closed")
+	}
+}
+
+func TestParentContextCancellation(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	uri, err := url.ParseRequestURI(backend.URL)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := NewSingleHostReverseProxyContext(ctx, uri)
+	p.Logger = &printfRecorder{}
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	var conns []*gorillawebsocket.Conn
+	for i := 0; i < 3; i++ {
+		conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("OK")))
+		_, _, err = conn.ReadMessage()
+		require.NoError(t, err)
+
+		conns = append(conns, conn)
+	}
+
+	cancel()
+
+	for _, conn := range conns {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		_, _, err = conn.ReadMessage()
+		assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseGoingAway), "client: %v", err)
+	}
+}
+
+func TestNewWithFallback(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	uri, err := url.ParseRequestURI(backend.URL)
+	require.NoError(t, err)
+
+	fallback := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("fallback " + req.URL.Path))
+	})
+
+	proxy := httptest.NewServer(NewWithFallback(uri, fallback))
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("OK")))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "OK", string(msg))
+
+	resp, err := http.Get(proxy.URL + "/ws")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "fallback /ws", string(body))
+}
+
+func TestStripPrefix(t *testing.T) {
+	uris := make(chan string, 1)
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		uris <- req.RequestURI
+
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		desc           string
+		prefix         string
+		path           string
+		expectedStatus int
+		expectedURI    string
+	}{
+		{
+			desc:           "matching prefix",
+			prefix:         "/ws",
+			path:           "/ws/chat?room=1",
+			expectedStatus: http.StatusSwitchingProtocols,
+			expectedURI:    "/chat?room=1",
+		},
+		{
+			desc:           "matching prefix with a trailing slash",
+			prefix:         "/ws/",
+			path:           "/ws/chat",
+			expectedStatus: http.StatusSwitchingProtocols,
+			expectedURI:    "/chat",
+		},
+		{
+			desc:           "whole path",
+			prefix:         "/ws",
+			path:           "/ws",
+			expectedStatus: http.StatusSwitchingProtocols,
+			expectedURI:    "/",
+		},
+		{
+			desc:           "whole path with a trailing slash",
+			prefix:         "/ws",
+			path:           "/ws/",
+			expectedStatus: http.StatusSwitchingProtocols,
+			expectedURI:    "/",
+		},
+		{
+			desc:           "escaped path",
+			prefix:         "/ws",
+			path:           "/ws/a%2Fb",
+			expectedStatus: http.StatusSwitchingProtocols,
+			expectedURI:    "/a%2Fb",
+		},
+		{
+			desc:           "missing trailing slash",
+			prefix:         "/ws/",
+			path:           "/ws",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			desc:           "partial segment",
+			prefix:         "/ws",
+			path:           "/wsx/chat",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			desc:           "other path",
+			prefix:         "/ws",
+			path:           "/api",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.StripPrefix = test.prefix
+			})
+			defer proxy.Close()
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, test.path), nil)
+			require.NotNil(t, resp)
+			assert.Equal(t, test.expectedStatus, resp.StatusCode)
+
+			if test.expectedStatus != http.StatusSwitchingProtocols {
+				require.Error(t, err)
+				assert.Len(t, uris, 0)
+				return
+			}
+
+			require.NoError(t, err)
+			_ = conn.Close()
+			assert.Equal(t, test.expectedURI, <-uris)
+		})
+	}
+}
+
+func TestForceMessageType(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		forced          map[Direction]int
+		expectedBackend int
+		expectedClient  int
+	}{
+		{
+			desc:            "unchanged",
+			expectedBackend: gorillawebsocket.TextMessage,
+			expectedClient:  gorillawebsocket.TextMessage,
+		},
+		{
+			desc:            "client to backend",
+			forced:          map[Direction]int{ClientToBackend: gorillawebsocket.BinaryMessage},
+			expectedBackend: gorillawebsocket.BinaryMessage,
+			expectedClient:  gorillawebsocket.BinaryMessage,
+		},
+		{
+			desc:            "backend to client",
+			forced:          map[Direction]int{BackendToClient: gorillawebsocket.BinaryMessage},
+			expectedBackend: gorillawebsocket.TextMessage,
+			expectedClient:  gorillawebsocket.BinaryMessage,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			received := make(chan int, 1)
+			upgrader := gorillawebsocket.Upgrader{}
+			backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				conn, err := upgrader.Upgrade(rw, req, nil)
+				if err != nil {
+					return
+				}
+				defer func() { _ = conn.Close() }()
+
+				msgType, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				received <- msgType
+
+				// echoes the message with the type it was received with.
+				_ = conn.WriteMessage(msgType, msg)
+				_, _, _ = conn.ReadMessage()
+			}))
+			defer backend.Close()
+
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.ForceMessageType = test.forced
+			})
+			defer proxy.Close()
+
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			pong := make(chan string, 1)
+			conn.SetPongHandler(func(data string) error {
+				pong <- data
+				return nil
+			})
+
+			payload := `{"hello":"world"}`
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte(payload)))
+			assert.Equal(t, test.expectedBackend, <-received)
+
+			msgType, data, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedClient, msgType)
+			assert.Equal(t, payload, string(data))
+
+			// the control messages are untouched.
+			require.NoError(t, conn.WriteControl(gorillawebsocket.PingMessage, []byte("ping"), time.Now().Add(time.Second)))
+			go func() { _, _, _ = conn.ReadMessage() }()
+
+			select {
+			case data := <-pong:
+				assert.Equal(t, "ping", data)
+			case <-time.After(2 * time.Second):
+				require.FailNow(t, "pong not received")
+			}
+		})
+	}
+}
+
+func TestRewriteURL(t *testing.T) {
+	uris := make(chan string, 1)
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		uris <- req.RequestURI
+
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.RewriteURL = func(req *http.Request) (*url.URL, error) {
+			if req.URL.Query().Get("tenant") == "" {
+				return nil, &StatusError{Status: http.StatusBadRequest, Err: errors.New("missing tenant")}
+			}
+			return &url.URL{
+				Scheme:   "ws",
+				Host:     backendURL.Host,
+				Path:     "/internal/ws",
+				RawQuery: "tenant=" + req.URL.Query().Get("tenant"),
+			}, nil
+		}
+	})
+	defer proxy.Close()
+
+	// the dial URL doesn't depend on the client path.
+	for _, path := range []string{"/?tenant=acme", "/chat/room?tenant=acme"} {
+		conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, path), nil)
+		require.NoError(t, err)
+		_ = conn.Close()
+
+		assert.Equal(t, "/internal/ws?tenant=acme", <-uris)
+	}
+
+	_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/chat"), nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestConfigureDialHeaders(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		headers <- req.Header
+
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.RequestHeaderBlocklist = []string{"Authorization"}
+		p.ConfigureDialHeaders = func(h http.Header) {
+			h.Set("Authorization", "Bearer service-token")
+		}
+	})
+	defer proxy.Close()
+
+	clientHeaders := http.Header{}
+	clientHeaders.Set("Authorization", "Bearer client-token")
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), clientHeaders)
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	// the injected header is not subject to the filters.
+	assert.Equal(t, []string{"Bearer service-token"}, (<-headers)["Authorization"])
+}
+
+// breakableConn is a connection whose writes fail once it is broken, while its reads go on.
+type breakableConn struct {
+	net.Conn
+	broken int32
+}
+
+func (c *breakableConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.broken) == 1 {
+		return 0, &net.OpError{Op: "write", Net: "tcp", Err: errors.New("broken pipe")}
+	}
+	return c.Conn.Write(b)
+}
+
+func TestDroppedDestination(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	backendConn := make(chan *breakableConn, 1)
+	closed := make(chan CloseInfo, 1)
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.Dialer = &gorillawebsocket.Dialer{
+			NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				breakable := &breakableConn{Conn: conn}
+				backendConn <- breakable
+				return breakable, nil
+			},
+		}
+		p.ConnectionClosedHook = func(_ *http.Request, info CloseInfo) {
+			closed <- info
+		}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("hello")))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(msg))
+
+	// the backend is gone: the next message can not be written to it.
+	atomic.StoreInt32(&(<-backendConn).broken, 1)
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("lost")))
+
+	// the failed write is not a truncated message.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseAbnormalClosure), "client: %v", err)
+
+	select {
+	case info := <-closed:
+		assert.Equal(t, gorillawebsocket.CloseAbnormalClosure, info.Code)
+		assert.Equal(t, PeerClient, info.Initiator)
+		assert.Equal(t, [2]int64{5, 5}, info.Bytes)
+		assert.Equal(t, [2]int64{1, 1}, info.Messages)
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "connection not closed")
+	}
+}
+
+func TestFormatCloseMessage(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		text     string
+		expected string
+	}{
+		{
+			desc:     "short reason",
+			text:     "bye",
+			expected: "bye",
+		},
+		{
+			desc:     "long reason",
+			text:     strings.Repeat("a", 200),
+			expected: strings.Repeat("a", maxCloseReasonLength),
+		},
+		{
+			desc:     "long non-ASCII reason",
+			text:     strings.Repeat("é", 100),
+			expected: strings.Repeat("é", maxCloseReasonLength/2),
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			msg := formatCloseMessage(gorillawebsocket.CloseNormalClosure, test.text)
+
+			reason := msg[2:]
+			assert.True(t, utf8.Valid(reason))
+			assert.Equal(t, test.expected, string(reason))
+		})
+	}
+}
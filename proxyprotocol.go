@@ -0,0 +1,152 @@
+package websocketproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// proxyProtocolSignature is the signature of the PROXY protocol version 2 headers.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// netDialFunc opens a network connection.
+type netDialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyProtocolDial returns a function opening the network connections with next,
+// and writing on them the PROXY protocol header of the client request, before any other data.
+func proxyProtocolDial(req *http.Request, version int, next netDialFunc) netDialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		src, dst := requestAddrs(req)
+		header, err := proxyProtocolHeader(version, src, dst)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = conn.Write(header); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// applyProxyProtocol makes the dialer write the PROXY protocol header of the request on its connections.
+func applyProxyProtocol(d *websocket.Dialer, req *http.Request, version int) {
+	next := netDialOf(d)
+	d.NetDial = nil
+	d.NetDialContext = proxyProtocolDial(req, version, next)
+	// the header is meant for the backend.
+	d.Proxy = nil
+}
+
+// netDialOf returns the function opening the network connections of the dialer.
+func netDialOf(d *websocket.Dialer) netDialFunc {
+	switch {
+	case d.NetDialContext != nil:
+		return d.NetDialContext
+	case d.NetDial != nil:
+		netDial := d.NetDial
+		return func(_ context.Context, network, addr string) (net.Conn, error) {
+			return netDial(network, addr)
+		}
+	default:
+		return (&net.Dialer{}).DialContext
+	}
+}
+
+// requestAddrs returns the address of the client, and the local address the client connected to,
+// or nil if they are not TCP addresses.
+func requestAddrs(req *http.Request) (*net.TCPAddr, *net.TCPAddr) {
+	src, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil || src.IP == nil {
+		return nil, nil
+	}
+
+	dst, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if !ok {
+		return nil, nil
+	}
+	return src, dst
+}
+
+// proxyProtocolHeader returns the PROXY protocol header of the given version, 1 or 2,
+// of a connection from src to dst.
+// The header of unknown addresses leaves the backend use the addresses of the connection.
+func proxyProtocolHeader(version int, src, dst *net.TCPAddr) ([]byte, error) {
+	switch version {
+	case 1:
+		return proxyProtocolV1Header(src, dst), nil
+	case 2:
+		return proxyProtocolV2Header(src, dst), nil
+	default:
+		return nil, fmt.Errorf("websocket: unsupported PROXY protocol version %d", version)
+	}
+}
+
+func proxyProtocolV1Header(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP4"
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		family = "TCP6"
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	return []byte("PROXY " + family + " " + formatIP(srcIP) + " " + formatIP(dstIP) + " " +
+		strconv.Itoa(src.Port) + " " + strconv.Itoa(dst.Port) + "\r\n")
+}
+
+// formatIP formats the IP in the form of its length: an IPv4 address in 16 bytes is formatted as an IPv6 address.
+func formatIP(ip net.IP) string {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.String()
+}
+
+func proxyProtocolV2Header(src, dst *net.TCPAddr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolSignature)
+
+	if src == nil || dst == nil {
+		// LOCAL command, unspecified family.
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	// PROXY command.
+	buf.WriteByte(0x21)
+
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP != nil && dstIP != nil {
+		// TCP over IPv4.
+		buf.WriteByte(0x11)
+	} else {
+		// TCP over IPv6.
+		buf.WriteByte(0x21)
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	addrs := make([]byte, 0, 2*len(srcIP)+4)
+	addrs = append(addrs, srcIP...)
+	addrs = append(addrs, dstIP...)
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
@@ -0,0 +1,220 @@
+package websocketproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// proxyProtocolListener reads the PROXY protocol header of the accepted connections.
+type proxyProtocolListener struct {
+	net.Listener
+	headers chan []byte
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	header, err := readProxyProtocolHeader(reader)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	l.headers <- header
+
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn reads the data already buffered before the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func readProxyProtocolHeader(reader *bufio.Reader) ([]byte, error) {
+	prefix, err := reader.Peek(len(proxyProtocolSignature))
+	if err != nil {
+		return nil, err
+	}
+
+	if string(prefix) != string(proxyProtocolSignature) {
+		line, err := reader.ReadString('\n')
+		return []byte(line), err
+	}
+
+	header := make([]byte, len(proxyProtocolSignature)+4)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	addrs := make([]byte, binary.BigEndian.Uint16(header[len(header)-2:]))
+	if _, err = io.ReadFull(reader, addrs); err != nil {
+		return nil, err
+	}
+	return append(header, addrs...), nil
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		version int
+	}{
+		{desc: "version 1", version: 1},
+		{desc: "version 2", version: 2},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+
+			headers := make(chan []byte, 1)
+			backend := httptest.NewUnstartedServer(echoHandler())
+			backend.Listener = &proxyProtocolListener{Listener: listener, headers: headers}
+			backend.Start()
+			defer backend.Close()
+
+			proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+				p.SendProxyProtocol = test.version
+			})
+			defer proxy.Close()
+
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("OK")))
+			_, msg, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, "OK", string(msg))
+
+			src := conn.LocalAddr().(*net.TCPAddr)
+			dst := conn.RemoteAddr().(*net.TCPAddr)
+			assert.Equal(t, proxyProtocolHeaderOf(t, test.version, src, dst), <-headers)
+		})
+	}
+}
+
+func TestSendProxyProtocolInvalidVersion(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.SendProxyProtocol = 3
+	})
+	defer proxy.Close()
+
+	_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func proxyProtocolHeaderOf(t *testing.T, version int, src, dst *net.TCPAddr) []byte {
+	t.Helper()
+
+	header, err := proxyProtocolHeader(version, src, dst)
+	require.NoError(t, err)
+	return header
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	client4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	proxy4 := &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443}
+	client6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	proxy6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	testCases := []struct {
+		desc     string
+		version  int
+		src, dst *net.TCPAddr
+		expected string
+	}{
+		{
+			desc:     "v1 IPv4",
+			version:  1,
+			src:      client4,
+			dst:      proxy4,
+			expected: "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n",
+		},
+		{
+			desc:     "v1 IPv6",
+			version:  1,
+			src:      client6,
+			dst:      proxy6,
+			expected: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			desc:     "v1 mixed families",
+			version:  1,
+			src:      client4,
+			dst:      proxy6,
+			expected: "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			desc:     "v1 unknown",
+			version:  1,
+			expected: "PROXY UNKNOWN\r\n",
+		},
+		{
+			desc:    "v2 IPv4",
+			version: 2,
+			src:     client4,
+			dst:     proxy4,
+			expected: "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c" +
+				"\xc0\x00\x02\x01\xc6\x33\x64\x02\xdc\x04\x01\xbb",
+		},
+		{
+			desc:    "v2 IPv6",
+			version: 2,
+			src:     client6,
+			dst:     proxy6,
+			expected: "\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\xdc\x04\x01\xbb",
+		},
+		{
+			desc:     "v2 unknown",
+			version:  2,
+			expected: "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			header, err := proxyProtocolHeader(test.version, test.src, test.dst)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(header))
+
+			if test.version == 2 {
+				fixed, err := readProxyProtocolHeader(bufio.NewReader(strings.NewReader(string(header) + "GET")))
+				require.NoError(t, err)
+				assert.Equal(t, header, fixed)
+			}
+		})
+	}
+
+	_, err := proxyProtocolHeader(3, client4, proxy4)
+	assert.Error(t, err)
+}
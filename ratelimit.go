@@ -0,0 +1,161 @@
+package websocketproxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the messages forwarded from the client to the backend.
+// When the limit is exceeded, the client is not read until enough budget is available,
+// so messages are delayed but never dropped nor reordered.
+type RateLimit struct {
+	// MessagesPerSecond is the maximum number of messages per second.
+	// Zero means unlimited.
+	MessagesPerSecond float64
+
+	// BytesPerSecond is the maximum number of message payload bytes per second.
+	// Zero means unlimited.
+	BytesPerSecond float64
+
+	// MaxBurstMessages is the number of messages forwarded at once, above MessagesPerSecond,
+	// before the messages of a burst are paced at MessagesPerSecond.
+	// If zero, one second worth of messages is allowed.
+	MaxBurstMessages int
+}
+
+// rateLimiter applies a RateLimit.
+type rateLimiter struct {
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	if limit == nil {
+		return nil
+	}
+
+	return &rateLimiter{
+		messages: newTokenBucket(limit.MessagesPerSecond).withBurst(float64(limit.MaxBurstMessages)),
+		bytes:    newTokenBucket(limit.BytesPerSecond),
+	}
+}
+
+// waitMessage blocks until a message can be forwarded.
+func (l *rateLimiter) waitMessage(ctx context.Context, throttled func(time.Duration)) error {
+	return l.messages.waitThrottled(ctx, 1, throttled)
+}
+
+// waitBytes blocks until the budget consumed by a forwarded message is paid back.
+func (l *rateLimiter) waitBytes(ctx context.Context, n int64, throttled func(time.Duration)) error {
+	return l.bytes.waitThrottled(ctx, float64(n), throttled)
+}
+
+// waitMessage blocks until the limiters allow a message, throttled is called before each delay, if not nil.
+func waitMessage(ctx context.Context, limiters []*rateLimiter, throttled func(time.Duration)) error {
+	for _, limiter := range limiters {
+		if err := limiter.waitMessage(ctx, throttled); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitBytes blocks until the limiters are paid back the bytes of a message, throttled is called before each delay, if not nil.
+func waitBytes(ctx context.Context, limiters []*rateLimiter, n int64, throttled func(time.Duration)) error {
+	for _, limiter := range limiters {
+		if err := limiter.waitBytes(ctx, n, throttled); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tokenBucket a token bucket, the capacity of the bucket is one second worth of tokens, unless set by withBurst.
+// A nil tokenBucket never blocks.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// withBurst sets the capacity of the bucket, if positive, and returns the bucket.
+func (b *tokenBucket) withBurst(burst float64) *tokenBucket {
+	if b == nil || burst <= 0 {
+		return b
+	}
+
+	b.burst = burst
+	b.tokens = burst
+	return b
+}
+
+// wait takes n tokens from the bucket, blocking until they are available or the context is done.
+// The tokens can exceed the capacity of the bucket: the bucket goes into debt, and the wait lasts until the debt is paid.
+func (b *tokenBucket) wait(ctx context.Context, n float64) error {
+	return b.waitThrottled(ctx, n, nil)
+}
+
+// waitThrottled is like wait, but calls throttled with the delay before blocking, if not nil.
+func (b *tokenBucket) waitThrottled(ctx context.Context, n float64, throttled func(time.Duration)) error {
+	if b == nil {
+		return nil
+	}
+
+	delay := b.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+
+	if throttled != nil {
+		throttled(delay)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
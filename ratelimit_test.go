@@ -0,0 +1,186 @@
+package websocketproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCountingBackend returns a backend that reports the time each message is received.
+func newCountingBackend(t *testing.T) (*httptest.Server, <-chan time.Time) {
+	t.Helper()
+
+	received := make(chan time.Time, 1000)
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			received <- time.Now()
+		}
+	}))
+
+	return backend, received
+}
+
+func sendMessages(t *testing.T, conn *gorillawebsocket.Conn, count, size int) {
+	t.Helper()
+
+	msg := make([]byte, size)
+	for i := 0; i < count; i++ {
+		require.NoError(t, conn.WriteMessage(gorillawebsocket.BinaryMessage, msg))
+	}
+}
+
+func waitReceived(t *testing.T, received <-chan time.Time, count int) time.Time {
+	t.Helper()
+
+	var last time.Time
+	for i := 0; i < count; i++ {
+		select {
+		case last = <-received:
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "messages not received", "%d/%d", i, count)
+		}
+	}
+	return last
+}
+
+func TestRateLimitMessages(t *testing.T) {
+	backend, received := newCountingBackend(t)
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.RateLimit = &RateLimit{MessagesPerSecond: 100}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	start := time.Now()
+	sendMessages(t, conn, 150, 10)
+	last := waitReceived(t, received, 150)
+
+	// the first 100 messages are the burst, the 50 others are paced at 100 per second.
+	assert.True(t, last.Sub(start) >= 450*time.Millisecond, "elapsed: %s", last.Sub(start))
+}
+
+func TestRateLimitBytes(t *testing.T) {
+	backend, received := newCountingBackend(t)
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.RateLimit = &RateLimit{BytesPerSecond: 10000}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	start := time.Now()
+	sendMessages(t, conn, 16, 1000)
+	last := waitReceived(t, received, 16)
+
+	// the 10 first messages are paid by the burst, the 16th message is forwarded once the debt of the 15 first is paid.
+	assert.True(t, last.Sub(start) >= 450*time.Millisecond, "elapsed: %s", last.Sub(start))
+}
+
+func TestGlobalRateLimit(t *testing.T) {
+	backend, received := newCountingBackend(t)
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.GlobalRateLimit = &RateLimit{MessagesPerSecond: 100}
+	})
+	defer proxy.Close()
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendMessages(t, conn, 75, 10)
+		}()
+	}
+	wg.Wait()
+
+	last := waitReceived(t, received, 150)
+	assert.True(t, last.Sub(start) >= 450*time.Millisecond, "elapsed: %s", last.Sub(start))
+}
+
+func TestRateLimitMaxBurstMessages(t *testing.T) {
+	backend, received := newCountingBackend(t)
+	defer backend.Close()
+
+	var throttled int32
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.RateLimit = &RateLimit{MessagesPerSecond: 100, MaxBurstMessages: 10}
+		p.OnThrottle = func(*http.Request, time.Duration) {
+			atomic.AddInt32(&throttled, 1)
+		}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	start := time.Now()
+	sendMessages(t, conn, 60, 10)
+
+	// the first 10 messages are the burst.
+	burst := waitReceived(t, received, 10)
+	assert.True(t, burst.Sub(start) < 300*time.Millisecond, "burst elapsed: %s", burst.Sub(start))
+
+	// the 50 others are paced at 100 per second.
+	last := waitReceived(t, received, 50)
+	assert.True(t, last.Sub(start) >= 450*time.Millisecond, "elapsed: %s", last.Sub(start))
+	// the messages of the burst are not throttled.
+	n := atomic.LoadInt32(&throttled)
+	assert.True(t, n > 0 && n <= 50, "throttled: %d", n)
+}
+
+func TestTokenBucketWaitCanceled(t *testing.T) {
+	bucket := newTokenBucket(1)
+	require.NoError(t, bucket.wait(context.Background(), 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := bucket.wait(ctx, 10)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestNilTokenBucket(t *testing.T) {
+	assert.Nil(t, newTokenBucket(0))
+	assert.NoError(t, (*tokenBucket)(nil).wait(context.Background(), 100))
+}
@@ -0,0 +1,363 @@
+package websocketproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reconnection defaults.
+const (
+	defaultReconnectTimeout    = 10 * time.Second
+	defaultReconnectBuffer     = 100
+	defaultReconnectBackoff    = 100 * time.Millisecond
+	defaultReconnectMaxBackoff = 2 * time.Second
+)
+
+// errReconnectBufferFull is reported when a client message exceeds the buffer of a reconnection.
+var errReconnectBufferFull = errors.New("websocket: reconnection buffer full")
+
+// ReconnectBackend redials the backend of a connection when the backend connection drops
+// without a close frame, while the client is still connected.
+// During the reconnection, the messages from the client are buffered, then forwarded to the new backend connection.
+// If the backend can not be reached within Timeout, the client is closed with websocket.CloseTryAgainLater.
+// The dials go through the CircuitBreaker: an open breaker ends the reconnection, and the failed dials count toward tripping it.
+// The backend must tolerate a session resumed on a new connection: the messages in flight when the connection dropped are lost.
+// The handshake of a new connection is checked like the first one, and a backend selecting another subprotocol
+// or other extensions than the first connection fails the dial.
+// Enabling it buffers each message from the client in memory.
+type ReconnectBackend struct {
+	// MaxBufferedMessages is the maximum number of client messages buffered during a reconnection.
+	// Past it, the client is closed with websocket.CloseTryAgainLater.
+	// If zero, 100 messages are buffered.
+	MaxBufferedMessages int
+
+	// Timeout is the maximum duration of a reconnection.
+	// If zero, 10s is used.
+	Timeout time.Duration
+
+	// Backoff is the delay before the second dial of a reconnection,
+	// doubled after each failed dial up to MaxBackoff.
+	// If zero, 100ms is used.
+	Backoff time.Duration
+
+	// MaxBackoff is the maximum delay between two dials.
+	// If zero, 2s is used.
+	MaxBackoff time.Duration
+}
+
+func (r *ReconnectBackend) maxBufferedMessages() int {
+	if r.MaxBufferedMessages <= 0 {
+		return defaultReconnectBuffer
+	}
+	return r.MaxBufferedMessages
+}
+
+func (r *ReconnectBackend) timeout() time.Duration {
+	if r.Timeout <= 0 {
+		return defaultReconnectTimeout
+	}
+	return r.Timeout
+}
+
+func (r *ReconnectBackend) backoff() time.Duration {
+	if r.Backoff <= 0 {
+		return defaultReconnectBackoff
+	}
+	return r.Backoff
+}
+
+func (r *ReconnectBackend) maxBackoff() time.Duration {
+	if r.MaxBackoff <= 0 {
+		return defaultReconnectMaxBackoff
+	}
+	return r.MaxBackoff
+}
+
+// bufferedMessage a client message buffered during a reconnection.
+type bufferedMessage struct {
+	messageType int
+	data        []byte
+}
+
+// backendLink the backend connection of a reconnecting connection,
+// which buffers the client messages while the backend is reconnected.
+type backendLink struct {
+	// conn is the current *websocket.Conn, readable while a message is written.
+	conn atomic.Value
+
+	// extensions are the extensions selected by the first backend connection, see extensionSet.
+	extensions string
+
+	mu       sync.Mutex
+	down     bool
+	buffered []bufferedMessage
+	max      int
+}
+
+func newBackendLink(conn *websocket.Conn, max int, extensions string) *backendLink {
+	l := &backendLink{max: max, extensions: extensions}
+	l.conn.Store(conn)
+	return l
+}
+
+// current returns the current backend connection.
+func (l *backendLink) current() *websocket.Conn {
+	return l.conn.Load().(*websocket.Conn)
+}
+
+// close closes the current backend connection, and prevents a reconnection in progress from setting a new one,
+// once the context of the connection is canceled.
+func (l *backendLink) close() {
+	// unblocks a pending write.
+	_ = l.current().Close()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_ = l.current().Close()
+}
+
+// forward forwards a client message to the backend, or buffers it while the backend is down.
+// The control messages are dropped while the backend is down.
+func (l *backendLink) forward(p *ReverseProxy, messageType int, reader io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.down {
+		n, err := p.writeMessage(l.current(), messageType, bytes.NewReader(data))
+		if err == nil || isTimeout(err) {
+			return n, err
+		}
+		// the backend dropped, its reader starts the reconnection.
+		// The message is forwarded again to the new connection.
+		l.down = true
+	}
+
+	if !isDataMessage(messageType) {
+		return 0, nil
+	}
+	if len(l.buffered) >= l.max {
+		return 0, errReconnectBufferFull
+	}
+
+	l.buffered = append(l.buffered, bufferedMessage{messageType: messageType, data: data})
+	return int64(len(data)), nil
+}
+
+// setDown marks the backend as down, so the client messages are buffered.
+func (l *backendLink) setDown() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.down = true
+}
+
+// setUp forwards the buffered messages to the new backend connection, then makes it the current one,
+// unless the connection terminated.
+func (l *backendLink) setUp(ctx context.Context, p *ReverseProxy, conn *websocket.Conn) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for len(l.buffered) > 0 {
+		m := l.buffered[0]
+		if _, err := p.writeMessage(conn, m.messageType, bytes.NewReader(m.data)); err != nil {
+			return err
+		}
+		l.buffered = l.buffered[1:]
+	}
+
+	l.conn.Store(conn)
+	l.down = false
+	return nil
+}
+
+// isTransientBackendError reports whether the error reading from the backend is a drop of the connection,
+// rather than a close of the backend.
+func isTransientBackendError(err error) bool {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return closeErr.Code == websocket.CloseAbnormalClosure
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "read"
+}
+
+// replicateReconnecting replicates the backend to the client, and reconnects the backend when its connection drops.
+func (p *ReverseProxy) replicateReconnecting(c *connection, redial func() (*websocket.Conn, error), errc chan error) {
+	for {
+		backendConn := c.link.current()
+
+		errBackend := make(chan error, 1)
+		p.replicateWebsocketConn(c, BackendToClient, c.clientConn, backendConn, errBackend)
+
+		var err error
+		select {
+		case err = <-errBackend:
+		default:
+			// the proxy closed the connection.
+			return
+		}
+
+		if !isTransientBackendError(err) || c.closed() {
+			errc <- err
+			return
+		}
+
+		// closing the dropped connection unblocks a pending write from the client.
+		_ = backendConn.Close()
+		c.link.setDown()
+
+		p.logEvent(c.ctx, slog.LevelWarn, "websocket: Backend connection lost, reconnecting",
+			remoteAddrAttr(c.req), slog.String("target", c.target), errorAttr(err))
+
+		if err = p.reconnect(c, redial); err != nil {
+			if c.ctx.Err() != nil {
+				// the connection terminated during the reconnection.
+				return
+			}
+			p.logEvent(c.ctx, slog.LevelError, "websocket: Backend reconnection failed",
+				remoteAddrAttr(c.req), slog.String("target", c.target), errorAttr(err))
+			c.close(websocket.CloseTryAgainLater, "backend unavailable")
+			return
+		}
+
+		p.logEvent(c.ctx, slog.LevelInfo, "websocket: Backend reconnected",
+			remoteAddrAttr(c.req), slog.String("target", c.target))
+	}
+}
+
+// reconnect redials the backend with backoff until it succeeds, the reconnection times out, or the connection terminates.
+func (p *ReverseProxy) reconnect(c *connection, redial func() (*websocket.Conn, error)) error {
+	timeout, stopTimeout := p.clock().NewTimer(p.ReconnectBackend.timeout())
+	defer stopTimeout()
+
+	backoff := p.ReconnectBackend.backoff()
+	for {
+		backendConn, err := redial()
+		if err == nil {
+			if err = c.link.setUp(c.ctx, p, backendConn); err == nil {
+				return nil
+			}
+			_ = backendConn.Close()
+		}
+		if errors.Is(err, ErrCircuitOpen) {
+			// the backend is shed until the breaker cools down.
+			return err
+		}
+
+		wait, stopWait := p.clock().NewTimer(backoff)
+		select {
+		case <-wait:
+		case <-timeout:
+			stopWait()
+			return err
+		case <-c.ctx.Done():
+			stopWait()
+			return c.ctx.Err()
+		}
+
+		backoff *= 2
+		if max := p.ReconnectBackend.maxBackoff(); backoff > max {
+			backoff = max
+		}
+	}
+}
+
+// redial dials a new backend connection for the connection.
+// Its handshake is checked like the first one, and must agree on the session already agreed with the client.
+// The dials go through the circuit breaker of the backend, if any.
+func (p *ReverseProxy) redial(c *connection, req, outReq *http.Request, cfg *ConnConfig) (*websocket.Conn, error) {
+	if p.CircuitBreaker != nil && !p.allowDial(outReq.URL) {
+		return nil, ErrCircuitOpen
+	}
+
+	dialReq := outReq.WithContext(c.ctx)
+	backendConn, resp, err := p.dial(req, dialReq, cfg, c.backendWire)
+	if resp != nil && resp.Body != nil {
+		_ = resp.Body.Close()
+	}
+	if p.CircuitBreaker != nil {
+		p.recordDialResult(dialReq, outReq.URL, resp, err)
+	}
+	if err != nil {
+		p.stats.incDialFailures()
+		p.metrics().IncDialError()
+		return nil, err
+	}
+
+	if err = p.checkRedialHandshake(c, req, outReq, resp); err != nil {
+		_ = backendConn.Close()
+		p.stats.incDialFailures()
+		p.metrics().IncDialError()
+		return nil, err
+	}
+
+	if c.backendWire != nil {
+		c.backendWire.handshakeDone(backendConn)
+	}
+
+	p.setCompressionLevel(req, backendConn)
+	p.configureConn(req, "ConfigureBackendConn", p.ConfigureBackendConn, backendConn)
+	return backendConn, nil
+}
+
+// checkRedialHandshake checks the handshake response of a reconnected backend, like the one of the first backend connection.
+// The backend must select the subprotocol of the client connection, and the extensions of the first backend connection.
+func (p *ReverseProxy) checkRedialHandshake(c *connection, req, outReq *http.Request, resp *http.Response) error {
+	err := validateBackendHandshake(resp, nil)
+	if err == nil && p.StrictExtensions {
+		err = checkBackendExtensions(resp, outReq)
+	}
+	if err != nil {
+		return err
+	}
+
+	selected := resp.Header.Get(SecWebsocketProtocol)
+	if p.SubprotocolValidator != nil {
+		if err = p.callSubprotocolValidator(req, websocket.Subprotocols(req), selected); err != nil {
+			return err
+		}
+	}
+	if selected != c.clientConn.Subprotocol() {
+		return &HandshakeError{Reason: fmt.Sprintf("subprotocol %q instead of %q", selected, c.clientConn.Subprotocol())}
+	}
+
+	if extensions := extensionSet(resp.Header); extensions != c.link.extensions {
+		return &HandshakeError{Reason: fmt.Sprintf("extensions %q instead of %q", extensions, c.link.extensions)}
+	}
+	return nil
+}
+
+// extensionSet returns the sorted names of the extensions selected in the handshake response.
+func extensionSet(header http.Header) string {
+	names := extensionNames(header)
+	for i, name := range names {
+		names[i] = strings.ToLower(name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
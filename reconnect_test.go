@@ -0,0 +1,301 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// restartingBackend is an echo backend, dropping its connection on a "drop" message
+// and refusing the handshakes while it is down.
+type restartingBackend struct {
+	*httptest.Server
+
+	down     int32
+	refused  int32
+	accepted int32
+
+	mu       sync.Mutex
+	upgrader gorillawebsocket.Upgrader
+}
+
+func newRestartingBackend(t *testing.T) *restartingBackend {
+	t.Helper()
+
+	b := &restartingBackend{}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&b.down) == 1 {
+			atomic.AddInt32(&b.refused, 1)
+			http.Error(rw, "restarting", http.StatusServiceUnavailable)
+			return
+		}
+
+		b.mu.Lock()
+		upgrader := b.upgrader
+		b.mu.Unlock()
+
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&b.accepted, 1)
+		defer func() { _ = conn.Close() }()
+
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			switch string(msg) {
+			case "drop":
+				// drops the connection without a close frame.
+				_ = conn.UnderlyingConn().Close()
+				return
+			case "close":
+				_ = conn.WriteMessage(gorillawebsocket.CloseMessage,
+					gorillawebsocket.FormatCloseMessage(gorillawebsocket.CloseNormalClosure, "bye"))
+				return
+			}
+
+			if err = conn.WriteMessage(msgType, msg); err != nil {
+				return
+			}
+		}
+	}))
+
+	return b
+}
+
+// setUpgrader sets the upgrader of the next connections.
+func (b *restartingBackend) setUpgrader(upgrader gorillawebsocket.Upgrader) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.upgrader = upgrader
+}
+
+// restart drops the connection of the client, and waits for the proxy to redial the backend while it is down.
+func (b *restartingBackend) restart(t *testing.T, conn *gorillawebsocket.Conn) {
+	t.Helper()
+
+	atomic.StoreInt32(&b.down, 1)
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("drop")))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&b.refused) == 0 {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "backend not redialed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReconnectBackend(t *testing.T) {
+	backend := newRestartingBackend(t)
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend.Server, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.ReconnectBackend = &ReconnectBackend{Backoff: 20 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("1")))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(msg))
+
+	backend.restart(t, conn)
+
+	// buffered during the reconnection.
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("2")))
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.BinaryMessage, []byte("3")))
+
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreInt32(&backend.down, 0)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	msgType, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, gorillawebsocket.TextMessage, msgType)
+	assert.Equal(t, "2", string(msg))
+
+	msgType, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, gorillawebsocket.BinaryMessage, msgType)
+	assert.Equal(t, "3", string(msg))
+
+	// the session goes on with the new backend connection.
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("4")))
+	_, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "4", string(msg))
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&backend.accepted))
+}
+
+func TestReconnectBackendFailure(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		reconnect *ReconnectBackend
+		messages  int
+	}{
+		{
+			desc:      "timeout",
+			reconnect: &ReconnectBackend{Timeout: 200 * time.Millisecond, Backoff: 20 * time.Millisecond},
+		},
+		{
+			desc:      "buffer full",
+			reconnect: &ReconnectBackend{MaxBufferedMessages: 2, Backoff: 20 * time.Millisecond},
+			messages:  3,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			backend := newRestartingBackend(t)
+			defer backend.Close()
+
+			proxy := newTestProxy(t, backend.Server, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.ReconnectBackend = test.reconnect
+			})
+			defer proxy.Close()
+
+			conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			backend.restart(t, conn)
+
+			for i := 0; i < test.messages; i++ {
+				require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("buffered")))
+			}
+
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+			_, _, err = conn.ReadMessage()
+			assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseTryAgainLater), "client: %v", err)
+		})
+	}
+}
+
+func TestReconnectBackendClose(t *testing.T) {
+	backend := newRestartingBackend(t)
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend.Server, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.ReconnectBackend = &ReconnectBackend{}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// a close of the backend is not a drop.
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("close")))
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseNormalClosure), "client: %v", err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&backend.accepted))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&backend.refused))
+}
+
+func TestReconnectBackendMismatch(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		first     gorillawebsocket.Upgrader
+		restarted gorillawebsocket.Upgrader
+	}{
+		{
+			desc:      "subprotocol",
+			first:     gorillawebsocket.Upgrader{Subprotocols: []string{"v1"}},
+			restarted: gorillawebsocket.Upgrader{Subprotocols: []string{"v2"}},
+		},
+		{
+			desc:      "extensions",
+			first:     gorillawebsocket.Upgrader{Subprotocols: []string{"v1"}, EnableCompression: true},
+			restarted: gorillawebsocket.Upgrader{Subprotocols: []string{"v1"}},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			backend := newRestartingBackend(t)
+			defer backend.Close()
+			backend.setUpgrader(test.first)
+
+			proxy := newTestProxy(t, backend.Server, func(p *ReverseProxy) {
+				p.Logger = &printfRecorder{}
+				p.BackendCompression = true
+				p.ReconnectBackend = &ReconnectBackend{Timeout: 200 * time.Millisecond, Backoff: 20 * time.Millisecond}
+			})
+			defer proxy.Close()
+
+			dialer := gorillawebsocket.Dialer{Subprotocols: []string{"v1", "v2"}}
+			conn, _, err := dialer.Dial(wsURL(proxy, "/ws"), nil)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+			require.Equal(t, "v1", conn.Subprotocol())
+
+			backend.restart(t, conn)
+			backend.setUpgrader(test.restarted)
+			atomic.StoreInt32(&backend.down, 0)
+
+			// the restarted backend is reached, but it doesn't resume the session of the client.
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+			_, _, err = conn.ReadMessage()
+			assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseTryAgainLater), "client: %v", err)
+			assert.Greater(t, atomic.LoadInt32(&backend.accepted), int32(1))
+		})
+	}
+}
+
+func TestReconnectBackendCircuitOpen(t *testing.T) {
+	backend := newRestartingBackend(t)
+	defer backend.Close()
+
+	metrics := newRecordingMetrics()
+	var rp *ReverseProxy
+	proxy := newTestProxy(t, backend.Server, func(p *ReverseProxy) {
+		rp = p
+		p.Logger = &printfRecorder{}
+		p.Metrics = metrics
+		p.CircuitBreaker = &CircuitBreaker{Threshold: 1, Window: time.Minute, Cooldown: time.Minute}
+		p.ReconnectBackend = &ReconnectBackend{Timeout: 5 * time.Second, Backoff: 20 * time.Millisecond}
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	backend.restart(t, conn)
+
+	// the refused redial opens the breaker, which stops the reconnection before its timeout.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, gorillawebsocket.IsCloseError(err, gorillawebsocket.CloseTryAgainLater), "client: %v", err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&backend.refused))
+	assert.Equal(t, BreakerOpen, rp.BreakerState("ws://"+backend.Listener.Addr().String()))
+
+	metrics.mu.Lock()
+	assert.Equal(t, int64(1), metrics.dialErrors)
+	metrics.mu.Unlock()
+}
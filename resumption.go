@@ -0,0 +1,162 @@
+package websocketproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultResumptionHeader is the header carrying the resumption tokens, if none is configured.
+const DefaultResumptionHeader = "X-Websocket-Resumption-Token"
+
+// errResumptionKey is reported by Validate when the resumption tokens have no key.
+var errResumptionKey = errors.New("websocket: the resumption tokens require a Key")
+
+// errResumptionPicker is reported by Validate when the resumption tokens have no backends to route to.
+var errResumptionPicker = errors.New("websocket: the resumption tokens require a Picker implementing TargetLister")
+
+// Resumption issues tokens that route the reconnections of a client to the same backend.
+// The token is sent in the upgrade response, and the client sends it back in the reconnection request.
+// The tokens are signed, the clients can't forge them to reach another backend.
+// A token only routes to a backend currently listed by the Picker of the proxy, which must implement TargetLister:
+// a token to a removed backend, or without a Picker listing its backends, is ignored.
+type Resumption struct {
+	// Key signs the tokens, it is required: without it, the tokens are neither issued nor accepted.
+	// It must be a secret, e.g. 32 random bytes.
+	Key []byte
+
+	// Header is the header carrying the token, in the upgrade response and in the reconnection request.
+	// If empty, DefaultResumptionHeader is used.
+	Header string
+
+	// TTL is the validity of the tokens.
+	// If zero, the tokens don't expire.
+	TTL time.Duration
+
+	// ResumeHeader is an optional header set to "true" on the backend request of a resumed connection.
+	ResumeHeader string
+}
+
+func (r *Resumption) header() string {
+	if r.Header == "" {
+		return DefaultResumptionHeader
+	}
+	return r.Header
+}
+
+// issue returns a token routing to the target, or an empty token without a key.
+func (r *Resumption) issue(target *url.URL, now time.Time) string {
+	if len(r.Key) == 0 {
+		return ""
+	}
+
+	var expiry int64
+	if r.TTL > 0 {
+		expiry = now.Add(r.TTL).Unix()
+	}
+
+	payload := strconv.FormatInt(expiry, 10) + " " + target.Scheme + "://" + target.Host
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + r.sign(payload)
+}
+
+// target returns the scheme and the host of the backend of a valid token.
+// Without a key, no token is valid.
+func (r *Resumption) target(token string, now time.Time) (scheme, host string, ok bool) {
+	if len(r.Key) == 0 {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", false
+	}
+
+	payload := string(raw)
+	if !hmac.Equal([]byte(parts[1]), []byte(r.sign(payload))) {
+		return "", "", false
+	}
+
+	fields := strings.SplitN(payload, " ", 2)
+	if len(fields) != 2 {
+		return "", "", false
+	}
+
+	expiry, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || expiry != 0 && now.Unix() > expiry {
+		return "", "", false
+	}
+
+	target, err := url.Parse(fields[1])
+	if err != nil {
+		return "", "", false
+	}
+	return target.Scheme, target.Host, true
+}
+
+func (r *Resumption) sign(payload string) string {
+	mac := hmac.New(sha256.New, r.Key)
+	_, _ = mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueResumption sets the resumption token routing to the target in the upgrade response,
+// unless the token would not be accepted.
+func (p *ReverseProxy) issueResumption(header http.Header, target *url.URL) {
+	name := p.Resumption.header()
+	header.Del(name)
+
+	if !p.isListedTarget(target.Scheme, target.Host) {
+		return
+	}
+	if token := p.Resumption.issue(target, time.Now()); token != "" {
+		header.Set(name, token)
+	}
+}
+
+// resume routes the backend request to the backend of the resumption token of the request, if any,
+// as long as the Picker still lists it.
+// The token is never forwarded to the backend.
+func (p *ReverseProxy) resume(req, outReq *http.Request) {
+	header := p.Resumption.header()
+	outReq.Header.Del(header)
+
+	scheme, host, ok := p.Resumption.target(req.Header.Get(header), time.Now())
+	if !ok || !p.isListedTarget(scheme, host) {
+		return
+	}
+
+	u := *outReq.URL
+	u.Scheme = scheme
+	u.Host = host
+	outReq.URL = &u
+
+	if p.Resumption.ResumeHeader != "" {
+		outReq.Header.Set(p.Resumption.ResumeHeader, "true")
+	}
+}
+
+// isListedTarget reports whether the backend is one of the backends currently listed by the Picker.
+func (p *ReverseProxy) isListedTarget(scheme, host string) bool {
+	lister, ok := p.Picker.(TargetLister)
+	if !ok {
+		return false
+	}
+
+	for _, target := range lister.Targets() {
+		if websocketScheme(target.Scheme) == scheme && target.Host == host {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package websocketproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newNamedBackend returns a backend answering its name as the first message, and reporting the handshake requests.
+func newNamedBackend(t *testing.T, name string, requests chan<- *http.Request) *httptest.Server {
+	t.Helper()
+
+	upgrader := gorillawebsocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests <- req
+
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		_ = conn.WriteMessage(gorillawebsocket.TextMessage, []byte(name))
+		_, _, _ = conn.ReadMessage()
+	}))
+}
+
+// newResumptionProxy returns a proxy issuing resumption tokens, picking the backends in turn.
+func newResumptionProxy(t *testing.T, resumption *Resumption, backends ...*httptest.Server) (*ReverseProxy, *httptest.Server) {
+	t.Helper()
+
+	var targets []WeightedTarget
+	for _, backend := range backends {
+		uri, err := url.Parse(backend.URL)
+		require.NoError(t, err)
+		targets = append(targets, WeightedTarget{URL: uri, Weight: 1})
+	}
+
+	p := NewSingleHostReverseProxy(targets[0].URL)
+	p.Logger = &printfRecorder{}
+	p.Picker = NewWeightedRoundRobinPicker(targets)
+	p.Resumption = resumption
+	return p, httptest.NewServer(p)
+}
+
+// dialResumption dials the proxy with the resumption token, if any,
+// and returns the name of the backend and the token of the response.
+func dialResumption(t *testing.T, proxy *httptest.Server, token string) (string, string) {
+	t.Helper()
+
+	header := http.Header{}
+	if token != "" {
+		header.Set(DefaultResumptionHeader, token)
+	}
+
+	conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), header)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	_, name, err := conn.ReadMessage()
+	require.NoError(t, err)
+	return string(name), resp.Header.Get(DefaultResumptionHeader)
+}
+
+func TestResumption(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+
+	backendA := newNamedBackend(t, "a", requests)
+	defer backendA.Close()
+	backendB := newNamedBackend(t, "b", requests)
+	defer backendB.Close()
+
+	// round-robin across the backends.
+	_, proxy := newResumptionProxy(t, &Resumption{Key: []byte("secret"), ResumeHeader: "X-Resumed"}, backendA, backendB)
+	defer proxy.Close()
+
+	first, token := dialResumption(t, proxy, "")
+	require.NotEmpty(t, token)
+	req := <-requests
+	assert.Empty(t, req.Header.Get("X-Resumed"))
+
+	for i := 0; i < 3; i++ {
+		name, _ := dialResumption(t, proxy, token)
+		assert.Equal(t, first, name)
+
+		req = <-requests
+		assert.Equal(t, "true", req.Header.Get("X-Resumed"))
+		assert.Empty(t, req.Header.Get(DefaultResumptionHeader))
+	}
+
+	// an invalid token is ignored.
+	_, _ = dialResumption(t, proxy, token+"x")
+	req = <-requests
+	assert.Empty(t, req.Header.Get("X-Resumed"))
+}
+
+func TestResumptionForgedToken(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+
+	backend := newNamedBackend(t, "public", requests)
+	defer backend.Close()
+	internal := newNamedBackend(t, "internal", requests)
+	defer internal.Close()
+
+	uri, err := url.Parse(internal.URL)
+	require.NoError(t, err)
+
+	// a token signed with the empty key, routing to a backend unknown to the picker.
+	payload := "0 ws://" + uri.Host
+	mac := hmac.New(sha256.New, nil)
+	_, _ = mac.Write([]byte(payload))
+	forged := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	p, proxy := newResumptionProxy(t, &Resumption{}, backend)
+	defer proxy.Close()
+
+	name, token := dialResumption(t, proxy, forged)
+	assert.Equal(t, "public", name)
+	assert.Empty(t, token, "no token without a key")
+	assert.Empty(t, (<-requests).Header.Get(DefaultResumptionHeader))
+
+	// even signed with the key, a token only routes to a backend of the picker.
+	p.Resumption.Key = []byte("secret")
+	name, _ = dialResumption(t, proxy, p.Resumption.issue(uri, time.Now()))
+	assert.Equal(t, "public", name)
+	<-requests
+}
+
+func TestResumptionRemovedTarget(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+
+	backendA := newNamedBackend(t, "a", requests)
+	defer backendA.Close()
+	backendB := newNamedBackend(t, "b", requests)
+	defer backendB.Close()
+
+	uriA, err := url.Parse(backendA.URL)
+	require.NoError(t, err)
+	uriB, err := url.Parse(backendB.URL)
+	require.NoError(t, err)
+
+	picker := NewConsistentHashPicker([]*url.URL{uriA, uriB}, func(*http.Request) string { return "key" })
+	p := NewSingleHostReverseProxy(uriA)
+	p.Logger = &printfRecorder{}
+	p.Picker = picker
+	p.Resumption = &Resumption{Key: []byte("secret")}
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	first, token := dialResumption(t, proxy, "")
+	require.NotEmpty(t, token)
+	<-requests
+
+	picked, other := uriA, uriB
+	if first == "b" {
+		picked, other = uriB, uriA
+	}
+
+	// the token of a removed backend routes to a current one.
+	picker.Remove(picked)
+	name, _ := dialResumption(t, proxy, token)
+	assert.NotEqual(t, first, name)
+	assert.Equal(t, other.Host, (<-requests).Host)
+}
+
+func TestResumptionToken(t *testing.T) {
+	target, err := url.Parse("ws://backend:8080/ws")
+	require.NoError(t, err)
+
+	now := time.Now()
+	r := &Resumption{Key: []byte("secret"), TTL: time.Minute}
+	token := r.issue(target, now)
+
+	scheme, host, ok := r.target(token, now)
+	require.True(t, ok)
+	assert.Equal(t, "ws", scheme)
+	assert.Equal(t, "backend:8080", host)
+
+	_, _, ok = r.target(token, now.Add(2*time.Minute))
+	assert.False(t, ok, "expired token")
+
+	_, _, ok = (&Resumption{Key: []byte("other")}).target(token, now)
+	assert.False(t, ok, "token signed with another key")
+
+	_, _, ok = r.target("garbage", now)
+	assert.False(t, ok)
+
+	assert.Empty(t, (&Resumption{}).issue(target, now), "token without a key")
+	_, _, ok = (&Resumption{}).target(token, now)
+	assert.False(t, ok, "token accepted without a key")
+}
@@ -0,0 +1,102 @@
+package websocketproxy
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// shutdownPollInterval is the interval between the checks of the active connections during a shutdown.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// ErrShuttingDown is reported when a connection is refused because the proxy is shutting down.
+var ErrShuttingDown = errors.New("websocket: proxy is shutting down")
+
+// ErrDraining is reported when a connection is refused because the proxy is draining.
+var ErrDraining = errors.New("websocket: proxy is draining")
+
+// SetDraining toggles the drain mode: while draining, the new connections are refused with a 503,
+// and the active connections go on until they terminate, e.g. to drain an instance before a deploy.
+// Unlike Shutdown, the drain mode can be left, and the background tasks keep running.
+func (p *ReverseProxy) SetDraining(draining bool) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	p.draining = draining
+}
+
+// Draining reports whether the proxy is draining.
+func (p *ReverseProxy) Draining() bool {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	return p.draining
+}
+
+// ActiveConnectionCount returns the number of active connections, e.g. for a health check during a drain.
+func (p *ReverseProxy) ActiveConnectionCount() int {
+	return p.activeConnections()
+}
+
+// Shutdown stops accepting new connections, closes the active connections with websocket.CloseGoingAway,
+// and waits for them to terminate, or for the context to expire.
+// It also stops the background tasks of the proxy.
+// A request admitted before the shutdown, but not yet upgraded, is rejected with a close frame once upgraded.
+func (p *ReverseProxy) Shutdown(ctx context.Context) error {
+	p.connsMu.Lock()
+	p.shuttingDown = true
+	conns := make([]*connection, 0, len(p.conns))
+	for _, c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.connsMu.Unlock()
+
+	p.shutdownOnce.Do(func() {
+		close(p.doneChan())
+	})
+
+	for _, c := range conns {
+		c.close(websocket.CloseGoingAway, ErrShuttingDown.Error())
+	}
+
+	// like http.Server.Shutdown, polls the active connections.
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if p.activeConnections() == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// activeConnections returns the number of registered connections.
+func (p *ReverseProxy) activeConnections() int {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	return len(p.conns)
+}
+
+// admit returns the reason why a new request can not be proxied, if any.
+func (p *ReverseProxy) admit() error {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	switch {
+	case p.shuttingDown:
+		return ErrShuttingDown
+	case p.draining:
+		return ErrDraining
+	default:
+		return nil
+	}
+}
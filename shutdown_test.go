@@ -0,0 +1,176 @@
+package websocketproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownRejectsNewConnections(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	p, proxy := newRegistryProxy(t, backend)
+	p.Logger = &printfRecorder{}
+	defer proxy.Close()
+
+	err := p.Shutdown(context.Background())
+	require.NoError(t, err)
+
+	_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestShutdownRacingUpgrades(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	p, proxy := newRegistryProxy(t, backend)
+	p.Logger = &printfRecorder{}
+	defer proxy.Close()
+
+	var mu sync.Mutex
+	var conns []*gorillawebsocket.Conn
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+			if err != nil {
+				if assert.NotNil(t, resp, err) {
+					assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+				}
+				return
+			}
+
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}()
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	err := p.Shutdown(context.Background())
+	require.NoError(t, err)
+	wg.Wait()
+
+	registered := make(map[string]bool)
+	for _, info := range p.ActiveConnections() {
+		registered[info.RemoteAddr] = true
+	}
+
+	for _, conn := range conns {
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err = conn.ReadMessage()
+
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			// the connection is still open, it must be known by the proxy.
+			assert.True(t, registered[conn.LocalAddr().String()], "unregistered connection survived the shutdown")
+		} else {
+			closeErr, ok := err.(*gorillawebsocket.CloseError)
+			if assert.True(t, ok, "unexpected error: %v", err) {
+				assert.Equal(t, gorillawebsocket.CloseGoingAway, closeErr.Code)
+			}
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestShutdownDrainsConnections(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	p, proxy := newRegistryProxy(t, backend)
+	p.Logger = &printfRecorder{}
+	defer proxy.Close()
+
+	var conns []*gorillawebsocket.Conn
+	for i := 0; i < 5; i++ {
+		conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		conns = append(conns, conn)
+	}
+	waitForActiveConnections(t, p, len(conns))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err := p.Shutdown(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, p.ActiveConnections())
+
+	for _, conn := range conns {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = conn.ReadMessage()
+
+		closeErr, ok := err.(*gorillawebsocket.CloseError)
+		if assert.True(t, ok, "unexpected error: %v", err) {
+			assert.Equal(t, gorillawebsocket.CloseGoingAway, closeErr.Code)
+			assert.Equal(t, ErrShuttingDown.Error(), closeErr.Text)
+		}
+	}
+}
+
+func TestShutdownContextExpired(t *testing.T) {
+	// a connection already closing, that never terminates.
+	busy := &connection{}
+	busy.closeOnce.Do(func() {})
+	p := &ReverseProxy{conns: map[string]*connection{"busy": busy}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := p.Shutdown(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestSetDraining(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	p, proxy := newRegistryProxy(t, backend)
+	p.Logger = &printfRecorder{}
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	waitForActiveConnections(t, p, 1)
+
+	p.SetDraining(true)
+	assert.True(t, p.Draining())
+
+	_, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	// the active connection survives the drain.
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("hello")))
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(msg))
+	assert.Equal(t, 1, p.ActiveConnectionCount())
+
+	p.SetDraining(false)
+	assert.False(t, p.Draining())
+
+	other, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	_ = other.Close()
+}
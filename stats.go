@@ -0,0 +1,63 @@
+package websocketproxy
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// proxyStats aggregate counters, reset on each stats log.
+type proxyStats struct {
+	bytes        int64
+	dialFailures int64
+}
+
+func (s *proxyStats) addBytes(n int64) {
+	atomic.AddInt64(&s.bytes, n)
+}
+
+func (s *proxyStats) incDialFailures() {
+	atomic.AddInt64(&s.dialFailures, 1)
+}
+
+// startBackground starts the background tasks of the proxy, once.
+func (p *ReverseProxy) startBackground() {
+	p.backgroundOnce.Do(func() {
+		if p.StatsLogInterval > 0 {
+			go p.logStats(p.StatsLogInterval, p.doneChan())
+		}
+	})
+}
+
+func (p *ReverseProxy) doneChan() chan struct{} {
+	p.doneMu.Lock()
+	defer p.doneMu.Unlock()
+
+	if p.done == nil {
+		p.done = make(chan struct{})
+	}
+	return p.done
+}
+
+func (p *ReverseProxy) logStats(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			p.connsMu.Lock()
+			active := len(p.conns)
+			p.connsMu.Unlock()
+
+			p.logEvent(context.Background(), slog.LevelInfo, "websocket: Stats",
+				slog.Int("active_connections", active),
+				slog.Int("queued_connections", p.QueuedConnections()),
+				slog.Int64("bytes", atomic.SwapInt64(&p.stats.bytes, 0)),
+				slog.Int64("dial_failures", atomic.SwapInt64(&p.stats.dialFailures, 0)))
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package websocketproxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func countStatsLines(lines []string) int {
+	var count int
+	for _, line := range lines {
+		if strings.HasPrefix(line, "websocket: Stats") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestStatsLog(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	legacy := &printfRecorder{}
+	p, proxy := newRegistryProxy(t, backend)
+	p.Logger = legacy
+	p.StatsLogInterval = 20 * time.Millisecond
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	err = conn.WriteMessage(gorillawebsocket.TextMessage, []byte("OK"))
+	require.NoError(t, err)
+	_, _, err = conn.ReadMessage()
+	require.NoError(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	var active bool
+	var bytes int
+	for (!active || bytes < 4) && time.Now().Before(deadline) {
+		active, bytes = false, 0
+		for _, line := range legacy.Lines() {
+			active = active || strings.Contains(line, "active_connections=1")
+
+			var n int
+			if i := strings.Index(line, "bytes="); i >= 0 {
+				_, _ = fmt.Sscanf(line[i:], "bytes=%d", &n)
+			}
+			bytes += n
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, active, "stats line not found in %v", legacy.Lines())
+	// 2 bytes forwarded each way.
+	assert.Equal(t, 4, bytes)
+
+	err = p.Shutdown(context.Background())
+	require.NoError(t, err)
+
+	// let a pending tick be logged.
+	time.Sleep(30 * time.Millisecond)
+	count := countStatsLines(legacy.Lines())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, count, countStatsLines(legacy.Lines()))
+}
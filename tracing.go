@@ -0,0 +1,91 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans of the proxy.
+const tracerName = "github.com/juliens/websocketproxy"
+
+// proxySpan the span of a proxied connection.
+// A nil span records nothing, when tracing is disabled.
+type proxySpan struct {
+	span       trace.Span
+	propagator propagation.TextMapPropagator
+}
+
+// startSpan starts the span of the request, as a child of the trace context of the request headers, if any.
+// It returns the request carrying the span context.
+func (p *ReverseProxy) startSpan(req *http.Request) (*http.Request, *proxySpan) {
+	if p.TracerProvider == nil {
+		return req, nil
+	}
+
+	propagator := p.Propagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+
+	ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := p.TracerProvider.Tracer(tracerName).Start(ctx, "websocket.proxy",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("url.path", req.URL.Path),
+			attribute.String("client.address", req.RemoteAddr),
+		))
+
+	return req.WithContext(ctx), &proxySpan{span: span, propagator: propagator}
+}
+
+// inject injects the trace context in the headers of the backend request.
+func (s *proxySpan) inject(outReq *http.Request) {
+	if s == nil {
+		return
+	}
+	s.propagator.Inject(outReq.Context(), propagation.HeaderCarrier(outReq.Header))
+}
+
+// event records an event with the duration since start.
+func (s *proxySpan) event(name string, start time.Time) {
+	if s == nil {
+		return
+	}
+	s.span.AddEvent(name, trace.WithAttributes(attribute.Int64("duration_ms", time.Since(start).Milliseconds())))
+}
+
+// fail records the error terminating the request.
+func (s *proxySpan) fail(err error) {
+	if s == nil {
+		return
+	}
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// closed records the termination of the connection.
+func (s *proxySpan) closed(info CloseInfo) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(
+		attribute.Int("websocket.close_code", info.Code),
+		attribute.String("websocket.close_initiator", string(info.Initiator)),
+	)
+	if info.Code == websocket.CloseAbnormalClosure {
+		s.span.SetStatus(codes.Error, "abnormal closure")
+	}
+}
+
+func (s *proxySpan) end() {
+	if s == nil {
+		return
+	}
+	s.span.End()
+}
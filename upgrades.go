@@ -0,0 +1,33 @@
+package websocketproxy
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrTooManyUpgrades is reported when a request is refused because MaxUpgradesInFlight is reached.
+var ErrTooManyUpgrades = errors.New("websocket: too many upgrades in progress")
+
+// acquireUpgrade reserves a slot for an upgrade in progress, without waiting.
+// It returns the function releasing the slot, which can be called more than once,
+// or false if MaxUpgradesInFlight is reached.
+func (p *ReverseProxy) acquireUpgrade() (func(), bool) {
+	if p.MaxUpgradesInFlight <= 0 {
+		return func() {}, true
+	}
+
+	p.upgradesOnce.Do(func() {
+		p.upgrades = make(chan struct{}, p.MaxUpgradesInFlight)
+	})
+
+	select {
+	case p.upgrades <- struct{}{}:
+	default:
+		return nil, false
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-p.upgrades })
+	}, true
+}
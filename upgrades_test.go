@@ -0,0 +1,85 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxUpgradesInFlight(t *testing.T) {
+	arrived := make(chan struct{}, 10)
+	release := make(chan struct{})
+	upgrader := gorillawebsocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		arrived <- struct{}{}
+		<-release
+
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer backend.Close()
+
+	proxy := newTestProxy(t, backend, func(p *ReverseProxy) {
+		p.Logger = &printfRecorder{}
+		p.MaxUpgradesInFlight = 2
+	})
+	defer proxy.Close()
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 5)
+	conns := make(chan *gorillawebsocket.Conn, 5)
+	dial := func() {
+		defer wg.Done()
+		conn, resp, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+		if err == nil {
+			conns <- conn
+		}
+		if resp != nil {
+			statuses <- resp.StatusCode
+		}
+	}
+
+	// the first upgrades are held by the backend.
+	wg.Add(2)
+	go dial()
+	go dial()
+	<-arrived
+	<-arrived
+
+	wg.Add(3)
+	for i := 0; i < 3; i++ {
+		go dial()
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusServiceUnavailable, <-statuses)
+	}
+
+	close(release)
+	wg.Wait()
+	close(statuses)
+	close(conns)
+
+	for status := range statuses {
+		assert.Equal(t, http.StatusSwitchingProtocols, status)
+	}
+	assert.Len(t, arrived, 0)
+
+	// the established connections don't hold the slots.
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial(wsURL(proxy, "/ws"), nil)
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	assert.Len(t, conns, 2)
+	for conn := range conns {
+		_ = conn.Close()
+	}
+}
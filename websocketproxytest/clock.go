@@ -0,0 +1,139 @@
+package websocketproxytest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a fake websocketproxy.Clock, whose time only advances with Advance.
+// It fires the timeouts of a proxy without waiting for them.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	changed chan struct{}
+}
+
+// fakeTimer a pending timer of a Clock, which either sends on c or calls f.
+type fakeTimer struct {
+	when time.Time
+	c    chan time.Time
+	f    func()
+}
+
+// NewClock creates a Clock, starting at now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// After returns a channel receiving the time of the clock once it advanced by d.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	ch, _ := c.NewTimer(d)
+	return ch
+}
+
+// NewTimer returns a channel receiving the time of the clock once it advanced by d, and a function stopping the timer.
+func (c *Clock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	t := &fakeTimer{c: make(chan time.Time, 1)}
+	return t.c, c.add(t, d)
+}
+
+// AfterFunc calls f in its own goroutine once the clock advanced by d, and returns a function stopping the timer.
+func (c *Clock) AfterFunc(d time.Duration, f func()) func() bool {
+	return c.add(&fakeTimer{f: f}, d)
+}
+
+// Advance advances the clock by d, and fires the timers expired meanwhile, in their order.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+
+	var expired, pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.when.After(now) {
+			pending = append(pending, t)
+		} else {
+			expired = append(expired, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	sort.SliceStable(expired, func(i, j int) bool {
+		return expired[i].when.Before(expired[j].when)
+	})
+
+	for _, t := range expired {
+		if t.f != nil {
+			go t.f()
+		} else {
+			t.c <- now
+		}
+	}
+}
+
+// WaitForTimers waits until at least n timers are pending, e.g. until a proxy armed the timeout of a connection.
+func (c *Clock) WaitForTimers(ctx context.Context, n int) error {
+	for {
+		c.mu.Lock()
+		if c.changed == nil {
+			c.changed = make(chan struct{})
+		}
+		pending, changed := len(c.timers), c.changed
+		c.mu.Unlock()
+
+		if pending >= n {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// add adds a timer expiring once the clock advanced by d, and returns the function stopping it.
+// A timer which already expired fires at the next Advance.
+func (c *Clock) add(t *fakeTimer, d time.Duration) func() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t.when = c.now.Add(d)
+	c.timers = append(c.timers, t)
+
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+
+	return func() bool {
+		return c.stop(t)
+	}
+}
+
+// stop removes the timer, and reports whether it was pending.
+func (c *Clock) stop(t *fakeTimer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package websocketproxytest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewClock(start)
+
+	fired := make(chan struct{})
+	clock.AfterFunc(2*time.Second, func() { close(fired) })
+	timer, _ := clock.NewTimer(time.Second)
+	_, stop := clock.NewTimer(time.Second)
+	require.NoError(t, clock.WaitForTimers(context.Background(), 3))
+	assert.True(t, stop())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), clock.Now())
+	select {
+	case now := <-timer:
+		assert.Equal(t, start.Add(time.Second), now)
+	default:
+		assert.Fail(t, "timer not fired")
+	}
+	select {
+	case <-fired:
+		assert.Fail(t, "func fired early")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		assert.Fail(t, "func not fired")
+	}
+	assert.False(t, stop())
+}
+
+func TestClockWaitForTimersContext(t *testing.T) {
+	clock := NewClock(time.Now())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := clock.WaitForTimers(ctx, 1)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
@@ -0,0 +1,128 @@
+// Package websocketproxytest provides utilities to test websocket proxies without backend servers.
+package websocketproxytest
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Backend is the backend side of a connection dialed by a Dialer.
+type Backend struct {
+	// Conn is the backend websocket connection, driven by the test.
+	Conn *websocket.Conn
+
+	// Request is the handshake request received by the backend.
+	Request *http.Request
+}
+
+// Dialer is a websocketproxy.Dialer connecting to in-process backends, over buffered in-memory connections.
+// Each dialed connection is upgraded, then handed to the test through Accept.
+type Dialer struct {
+	// Upgrader upgrades the backend side of the connections.
+	// If its CheckOrigin is nil, all the origins are accepted.
+	Upgrader websocket.Upgrader
+
+	once     sync.Once
+	backends chan *Backend
+}
+
+// NewDialer creates a Dialer.
+func NewDialer() *Dialer {
+	return &Dialer{}
+}
+
+// DialContext performs the websocket handshake with a new in-process backend.
+// The host of the URL is ignored.
+func (d *Dialer) DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (*websocket.Conn, *http.Response, error) {
+	clientSide, backendSide := bufferedPipe()
+	go d.serve(backendSide)
+
+	dialer := websocket.Dialer{
+		NetDialContext: func(context.Context, string, string) (net.Conn, error) {
+			return clientSide, nil
+		},
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, urlStr, requestHeader)
+	if err != nil {
+		_ = clientSide.Close()
+	}
+	return conn, resp, err
+}
+
+// Accept returns the backend side of the next dialed connection.
+// Each upgraded connection must be accepted.
+func (d *Dialer) Accept(ctx context.Context) (*Backend, error) {
+	select {
+	case b := <-d.backendChan():
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (d *Dialer) backendChan() chan *Backend {
+	d.once.Do(func() {
+		d.backends = make(chan *Backend)
+	})
+	return d.backends
+}
+
+// serve serves the handshake of the backend side of a connection.
+func (d *Dialer) serve(conn net.Conn) {
+	upgrader := d.Upgrader
+	if upgrader.CheckOrigin == nil {
+		upgrader.CheckOrigin = func(*http.Request) bool { return true }
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			ws, err := upgrader.Upgrade(rw, req, nil)
+			if err != nil {
+				return
+			}
+			d.backendChan() <- &Backend{Conn: ws, Request: req}
+		}),
+	}
+
+	// the connection outlives the listener once accepted.
+	_ = server.Serve(&connListener{conn: conn})
+}
+
+// connListener is a net.Listener accepting a single connection.
+type connListener struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		return nil, io.EOF
+	}
+
+	conn := l.conn
+	l.conn = nil
+	return conn, nil
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// pipeAddr is the address of an in-memory connection.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,47 @@
+package websocketproxytest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialer(t *testing.T) {
+	dialer := NewDialer()
+	dialer.Upgrader.Subprotocols = []string{"chat"}
+
+	header := http.Header{}
+	header.Set("Sec-WebSocket-Protocol", "chat")
+
+	conn, resp, err := dialer.DialContext(context.Background(), "ws://backend/path?q=1", header)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "chat", conn.Subprotocol())
+
+	backend, err := dialer.Accept(context.Background())
+	require.NoError(t, err)
+	defer func() { _ = backend.Conn.Close() }()
+	assert.Equal(t, "/path?q=1", backend.Request.RequestURI)
+
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("data")))
+	msgType, msg, err := backend.Conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, msgType)
+	assert.Equal(t, "data", string(msg))
+}
+
+func TestDialerAcceptContext(t *testing.T) {
+	dialer := NewDialer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := dialer.Accept(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
@@ -0,0 +1,102 @@
+package websocketproxytest_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/juliens/websocketproxy"
+	"github.com/juliens/websocketproxy/websocketproxytest"
+)
+
+func Example() {
+	dialer := websocketproxytest.NewDialer()
+
+	proxy := &websocketproxy.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "ws"
+			req.URL.Host = "backend"
+			req.Header.Set("X-Tenant", "acme")
+		},
+		Dialer: dialer,
+	}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/chat", nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer func() { _ = client.Close() }()
+
+	backend, err := dialer.Accept(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer func() { _ = backend.Conn.Close() }()
+
+	fmt.Println(backend.Request.URL.Path, backend.Request.Header.Get("X-Tenant"))
+
+	_ = client.WriteMessage(websocket.TextMessage, []byte("ping"))
+	_, msg, _ := backend.Conn.ReadMessage()
+	fmt.Println("backend received:", string(msg))
+
+	_ = backend.Conn.WriteMessage(websocket.TextMessage, []byte("pong"))
+	_, msg, _ = client.ReadMessage()
+	fmt.Println("client received:", string(msg))
+
+	// Output:
+	// /chat acme
+	// backend received: ping
+	// client received: pong
+}
+
+func ExampleClock() {
+	dialer := websocketproxytest.NewDialer()
+	clock := websocketproxytest.NewClock(time.Now())
+
+	proxy := &websocketproxy.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "ws"
+			req.URL.Host = "backend"
+		},
+		Dialer:              dialer,
+		Clock:               clock,
+		FirstMessageTimeout: time.Minute,
+	}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/chat", nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer func() { _ = client.Close() }()
+
+	backend, err := dialer.Accept(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer func() { _ = backend.Conn.Close() }()
+
+	// the client stays idle: the timeout fires as soon as the clock advances past it.
+	if err = clock.WaitForTimers(context.Background(), 1); err != nil {
+		fmt.Println(err)
+		return
+	}
+	clock.Advance(time.Minute)
+
+	_, _, err = client.ReadMessage()
+	fmt.Println(err)
+
+	// Output:
+	// websocket: close 1008 (policy violation): first message timeout
+}
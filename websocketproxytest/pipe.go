@@ -0,0 +1,95 @@
+package websocketproxytest
+
+import (
+	"net"
+	"sync"
+)
+
+// relayBufferSize is the size of the reads of the relays of a buffered pipe.
+const relayBufferSize = 32 * 1024
+
+// bufferedPipe is like net.Pipe, but the writes do not wait for the reads of the peer:
+// the data is buffered in memory, so a test can write and read the peers from a single goroutine.
+func bufferedPipe() (net.Conn, net.Conn) {
+	a, aRelay := net.Pipe()
+	bRelay, b := net.Pipe()
+
+	go relay(aRelay, bRelay)
+	go relay(bRelay, aRelay)
+
+	return a, b
+}
+
+// relay copies src to dst, reading src regardless of the pace of dst.
+func relay(src, dst net.Conn) {
+	q := &queue{}
+	q.cond = sync.NewCond(&q.mu)
+
+	go func() {
+		for {
+			chunk, ok := q.pop()
+			if !ok {
+				_ = dst.Close()
+				return
+			}
+
+			if _, err := dst.Write(chunk); err != nil {
+				_ = src.Close()
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, relayBufferSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			q.push(append([]byte(nil), buf[:n]...))
+		}
+		if err != nil {
+			q.close()
+			return
+		}
+	}
+}
+
+// queue is an unbounded queue of chunks.
+type queue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	chunks [][]byte
+	closed bool
+}
+
+func (q *queue) push(chunk []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.chunks = append(q.chunks, chunk)
+	q.cond.Signal()
+}
+
+// pop returns the next chunk, once available, or false once the queue is closed and empty.
+func (q *queue) pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.chunks) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.chunks) == 0 {
+		return nil, false
+	}
+
+	chunk := q.chunks[0]
+	q.chunks = q.chunks[1:]
+	return chunk, true
+}
+
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Signal()
+}